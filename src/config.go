@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"os"
+)
+
+// configuredTargets are the targets of a config file, their hostnames resolved.
+type configuredTargets struct {
+	names     []string
+	addresses []string
+	options   []*agent.PresentOptions
+	labels    []map[string]string
+}
+
+// validate checks a config file and prints every problem with it, like a compiler would.
+func validate(arguments []string) {
+	if len(arguments) != 1 {
+		fmt.Printf("usage: ping validate config-file\n")
+		os.Exit(1)
+	}
+	config, err := agent.LoadConfig(arguments[0])
+	if err != nil {
+		printConfigError(arguments[0], err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok, %d targets\n", arguments[0], len(config.Targets))
+}
+
+// loadConfig reads a config file and resolves the address of every target, exiting on any problem.
+func loadConfig(path string) *configuredTargets {
+	config, err := agent.LoadConfig(path)
+	if err != nil {
+		printConfigError(path, err)
+		os.Exit(1)
+	}
+	targets := &configuredTargets{}
+	for _, target := range config.Targets {
+		address, err := resolveDestination(target.Address)
+		if err != nil {
+			fmt.Printf("%s:%d: %s\n", path, target.Line, err.Error())
+			os.Exit(1)
+		}
+		options := target.Options
+		if err := options.ParseIPAddress(address); err != nil {
+			fmt.Printf("%s:%d: %s\n", path, target.Line, err.Error())
+			os.Exit(1)
+		}
+		targets.names = append(targets.names, target.Name)
+		targets.addresses = append(targets.addresses, address)
+		targets.options = append(targets.options, &options)
+		targets.labels = append(targets.labels, target.Labels)
+	}
+	return targets
+}
+
+func printConfigError(path string, err error) {
+	errs, ok := err.(agent.ConfigErrors)
+	if !ok {
+		fmt.Printf("%s: %s\n", path, err.Error())
+		return
+	}
+	for _, e := range errs {
+		fmt.Printf("%s:%d: %s\n", path, e.Line, e.Message)
+	}
+}
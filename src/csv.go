@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// csvHeader names the columns of -csv, one row per probe.
+var csvHeader = []string{"send_time", "icmp_seq", "destination", "bytes", "ttl", "rtt_ms"}
+
+// probeWriter writes exactly one CSV row for every probe, as it is answered or
+// given up on (-W), and once the ping is over for the ones still unanswered.
+// Lost probes leave bytes, ttl and rtt_ms empty.
+type probeWriter struct {
+	file   io.Closer
+	writer *csv.Writer
+	// every probe sent, until its icmp_seq comes around again
+	probes map[probeKey]*probeRow
+}
+
+// probeKey is a probe, by the 16 bit icmp_seq its replies carry.
+type probeKey struct {
+	destination string
+	sequence    int
+}
+
+// probeRow is whether a probe has its row yet.
+type probeRow struct {
+	sentAt  time.Time
+	written bool
+}
+
+// newProbeWriter creates (or truncates) the CSV file and writes its header.
+func newProbeWriter(path string) (*probeWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &probeWriter{file: file, writer: csv.NewWriter(file), probes: make(map[probeKey]*probeRow)}
+	if err := w.row(csvHeader); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// sent remembers a probe went out, so it gets a row even if nothing ever
+// says it was lost (no -W, or the ping ended first).
+func (w *probeWriter) sent(sequence int, destination string) {
+	key := probeKey{destination: destination, sequence: sequence}
+	// the icmp_seq came around again before the probe it was last got a row
+	if probe, ok := w.probes[key]; ok && !probe.written {
+		w.lost(&agent.PingPacket{SentAt: probe.sentAt, ICMPSequenceNumber: sequence, DestinationAddress: destination})
+	}
+	w.probes[key] = &probeRow{sentAt: time.Now()}
+}
+
+// reply writes the row of an answered probe, only the first answer to it
+// counts: not a DUP! or an untracked one, nor a late one after the probe was
+// already lost.
+func (w *probeWriter) reply(p *agent.PingPacket) {
+	if p.Duplicate || p.Untracked || !w.first(p) {
+		return
+	}
+	w.report(w.row([]string{sendTime(p), strconv.Itoa(p.ICMPSequenceNumber), p.DestinationAddress,
+		strconv.Itoa(p.NumberOfBytes), strconv.Itoa(p.TimeToLive), strconv.FormatFloat(milliseconds(p.RoundTripTime), 'f', 3, 64)}))
+}
+
+// lost writes the row of a probe that never got an answer.
+func (w *probeWriter) lost(p *agent.PingPacket) {
+	if !w.first(p) {
+		return
+	}
+	w.report(w.row([]string{sendTime(p), strconv.Itoa(p.ICMPSequenceNumber), p.DestinationAddress, "", "", ""}))
+}
+
+// first is true, once, for the first row of a probe.
+func (w *probeWriter) first(p *agent.PingPacket) bool {
+	key := probeKey{destination: p.DestinationAddress, sequence: p.ICMPSequenceNumber}
+	probe, ok := w.probes[key]
+	if !ok {
+		// sent before we were watching
+		probe = &probeRow{}
+		w.probes[key] = probe
+	}
+	if probe.written {
+		return false
+	}
+	probe.written = true
+	return true
+}
+
+// follow wraps an OnEchoComplete callback so every reply gets its row before it is printed (if at all).
+func (w *probeWriter) follow(onEchoComplete func(p *agent.PingPacket, exceededTTL bool)) func(p *agent.PingPacket, exceededTTL bool) {
+	return func(p *agent.PingPacket, exceededTTL bool) {
+		w.reply(p)
+		if onEchoComplete != nil {
+			onEchoComplete(p, exceededTTL)
+		}
+	}
+}
+
+// row writes one record through to the file, so a ping killed halfway still leaves every row so far.
+func (w *probeWriter) row(record []string) error {
+	if err := w.writer.Write(record); err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *probeWriter) report(err error) {
+	if err != nil {
+		fmt.Printf("error: -csv: %s\n", err.Error())
+	}
+}
+
+// sendTime is empty when we no longer know when the probe went out.
+func sendTime(p *agent.PingPacket) string {
+	if p.SentAt.IsZero() {
+		return ""
+	}
+	return timestamp(p.SentAt)
+}
+
+// close writes the rows of the probes still unanswered as lost, in the order
+// they were sent, and closes the file.
+func (w *probeWriter) close() {
+	var unanswered []probeKey
+	for key, probe := range w.probes {
+		if !probe.written {
+			unanswered = append(unanswered, key)
+		}
+	}
+	sort.Slice(unanswered, func(i, j int) bool {
+		return w.probes[unanswered[i]].sentAt.Before(w.probes[unanswered[j]].sentAt)
+	})
+	for _, key := range unanswered {
+		w.lost(&agent.PingPacket{SentAt: w.probes[key].sentAt, ICMPSequenceNumber: key.sequence, DestinationAddress: key.destination})
+	}
+	w.writer.Flush()
+	w.file.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProbeWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "probes.csv")
+	writer, err := newProbeWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentAt := time.Date(2020, 5, 6, 14, 57, 44, 0, time.UTC)
+	var printed int
+	onEchoComplete := writer.follow(func(p *agent.PingPacket, exceededTTL bool) {
+		printed++
+	})
+	for sequence := 0; sequence < 4; sequence++ {
+		writer.sent(sequence, "1.1.1.1")
+		writer.probes[probeKey{destination: "1.1.1.1", sequence: sequence}].sentAt = sentAt.Add(time.Duration(sequence) * time.Second)
+	}
+	reply := &agent.PingPacket{SentAt: sentAt, ICMPSequenceNumber: 0, DestinationAddress: "1.1.1.1", NumberOfBytes: 64,
+		TimeToLive: 57, RoundTripTime: 12345 * time.Microsecond}
+	onEchoComplete(reply, false)
+	// a DUP! is still printed, but the probe already has its row
+	onEchoComplete(&agent.PingPacket{SentAt: sentAt, DestinationAddress: "1.1.1.1", Duplicate: true}, false)
+	writer.lost(&agent.PingPacket{SentAt: sentAt.Add(time.Second), ICMPSequenceNumber: 1, DestinationAddress: "1.1.1.1"})
+	// so does the reply that showed up after it was lost
+	onEchoComplete(&agent.PingPacket{SentAt: sentAt.Add(time.Second), ICMPSequenceNumber: 1, DestinationAddress: "1.1.1.1",
+		NumberOfBytes: 64, TimeToLive: 57, RoundTripTime: 11 * time.Second}, false)
+	writer.lost(&agent.PingPacket{ICMPSequenceNumber: 2, DestinationAddress: "1.1.1.1"})
+	// 3 is still unanswered when the ping ends
+	writer.close()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "send_time,icmp_seq,destination,bytes,ttl,rtt_ms\n" +
+		"2020-05-06T14:57:44Z,0,1.1.1.1,64,57,12.345\n" +
+		"2020-05-06T14:57:45Z,1,1.1.1.1,,,\n" +
+		",2,1.1.1.1,,,\n" +
+		"2020-05-06T14:57:47Z,3,1.1.1.1,,,\n"
+	if string(contents) != expected || printed != 3 {
+		t.Errorf("expected %q (and 3 printed replies) got %q (%d)", expected, contents, printed)
+	}
+}
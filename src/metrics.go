@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rttBuckets are the upper bounds (in seconds) of the RTT histogram, from LAN to intercontinental.
+var rttBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// targetMetrics is everything /metrics knows about one target.
+type targetMetrics struct {
+	target string
+	// the target label and any from the config file, ready to go between { }
+	labels   string
+	sent     uint64
+	received uint64
+	lost     uint64
+	lastTTL  int
+	// 1 once the latest probe got an answer, 0 once one was lost
+	up bool
+	// replies per RTT bucket, the last one past every bound
+	buckets []uint64
+	rttSum  float64
+}
+
+// exporter keeps Prometheus metrics per target. The pinger's callbacks
+// update it while /metrics scrapes read it, hence the lock.
+type exporter struct {
+	lock    sync.Mutex
+	targets []*targetMetrics
+	// canonical resolved address -> target, the callbacks only know the address
+	addresses map[string]*targetMetrics
+}
+
+// newExporter makes the metrics of every target, names[i] resolved to addresses[i]
+// and labeled with labels[i]. Every target gets every label name, empty if it isn't its own.
+func newExporter(names []string, addresses []string, labels []map[string]string) *exporter {
+	e := &exporter{addresses: make(map[string]*targetMetrics)}
+	var labelNames []string
+	for _, targetLabels := range labels {
+		for name := range targetLabels {
+			if !containsString(labelNames, name) {
+				labelNames = append(labelNames, name)
+			}
+		}
+	}
+	sort.Strings(labelNames)
+	for i, name := range names {
+		rendered := []string{formatLabel("target", name)}
+		for _, labelName := range labelNames {
+			rendered = append(rendered, formatLabel(labelName, labels[i][labelName]))
+		}
+		metrics := &targetMetrics{target: name, labels: strings.Join(rendered, ","), buckets: make([]uint64, len(rttBuckets)+1)}
+		e.targets = append(e.targets, metrics)
+		e.addresses[canonicalAddress(addresses[i])] = metrics
+	}
+	return e
+}
+
+// watch points the pinger's callbacks at the exporter.
+func (e *exporter) watch(pinger *agent.MultiPingerAgent) {
+	pinger.OnEchoSent = e.sent
+	pinger.OnEchoComplete = e.reply
+	pinger.OnEchoLost = e.lost
+}
+
+func (e *exporter) sent(sequence int, destination string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if metrics, ok := e.addresses[canonicalAddress(destination)]; ok {
+		metrics.sent++
+	}
+}
+
+func (e *exporter) reply(p *agent.PingPacket, exceededTTL bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	metrics, ok := e.addresses[canonicalAddress(p.DestinationAddress)]
+	if !ok || p.Duplicate || p.Untracked {
+		return
+	}
+	metrics.received++
+	metrics.lastTTL = p.TimeToLive
+	metrics.up = true
+	seconds := p.RoundTripTime.Seconds()
+	metrics.rttSum += seconds
+	bucket := len(rttBuckets)
+	for i, bound := range rttBuckets {
+		if seconds <= bound {
+			bucket = i
+			break
+		}
+	}
+	metrics.buckets[bucket]++
+}
+
+func (e *exporter) lost(p *agent.PingPacket) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if metrics, ok := e.addresses[canonicalAddress(p.DestinationAddress)]; ok {
+		metrics.lost++
+		metrics.up = false
+	}
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.write(w)
+}
+
+func (e *exporter) write(w io.Writer) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	fmt.Fprintf(w, "# HELP ping_rtt_seconds Round trip time of echo replies.\n# TYPE ping_rtt_seconds histogram\n")
+	for _, metrics := range e.targets {
+		label := metrics.labels
+		var cumulative uint64
+		for i, bound := range rttBuckets {
+			cumulative += metrics.buckets[i]
+			fmt.Fprintf(w, "ping_rtt_seconds_bucket{%s,le=\"%s\"} %d\n", label, formatFloat(bound), cumulative)
+		}
+		cumulative += metrics.buckets[len(rttBuckets)]
+		fmt.Fprintf(w, "ping_rtt_seconds_bucket{%s,le=\"+Inf\"} %d\n", label, cumulative)
+		fmt.Fprintf(w, "ping_rtt_seconds_sum{%s} %s\n", label, formatFloat(metrics.rttSum))
+		fmt.Fprintf(w, "ping_rtt_seconds_count{%s} %d\n", label, cumulative)
+	}
+	e.writeMetric(w, "ping_packets_sent_total", "counter", "Echo requests sent.", func(m *targetMetrics) string {
+		return strconv.FormatUint(m.sent, 10)
+	})
+	e.writeMetric(w, "ping_packets_received_total", "counter", "Echo replies received, not counting duplicates.", func(m *targetMetrics) string {
+		return strconv.FormatUint(m.received, 10)
+	})
+	e.writeMetric(w, "ping_packets_lost_total", "counter", "Echo requests that went unanswered for the probe timeout.", func(m *targetMetrics) string {
+		return strconv.FormatUint(m.lost, 10)
+	})
+	e.writeMetric(w, "ping_last_ttl", "gauge", "Time to live of the latest echo reply.", func(m *targetMetrics) string {
+		return strconv.Itoa(m.lastTTL)
+	})
+	e.writeMetric(w, "ping_up", "gauge", "1 if the latest probe was answered, 0 if it was lost.", func(m *targetMetrics) string {
+		if m.up {
+			return "1"
+		}
+		return "0"
+	})
+}
+
+// writeMetric writes a single-valued metric for every target.
+func (e *exporter) writeMetric(w io.Writer, name string, kind string, help string, value func(m *targetMetrics) string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, metrics := range e.targets {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, metrics.labels, value(metrics))
+	}
+}
+
+// labelEscaper escapes label values the way the exposition format wants them.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(name string, value string) string {
+	return fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(value))
+}
+
+// validLabelName is true for names Prometheus takes, that aren't one of ours.
+func validLabelName(name string) bool {
+	if name == "" || name == "target" || name == "le" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalAddress is how an address is written once parsed, the way replies
+// carry it: 2001:DB8::1 and 2001:db8:0::1 are both 2001:db8::1.
+func canonicalAddress(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	return ip.String()
+}
+
+func containsString(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporter(t *testing.T) {
+	e := newExporter([]string{"one.example", `we"ird`}, []string{"192.0.2.1", "2001:db8::1"}, nil)
+	e.sent(0, "192.0.2.1")
+	e.sent(1, "192.0.2.1")
+	e.sent(0, "2001:db8::1")
+	e.sent(0, "198.51.100.1")
+	e.reply(&agent.PingPacket{DestinationAddress: "192.0.2.1", RoundTripTime: 3 * time.Millisecond, TimeToLive: 57}, false)
+	// DUP!s and strangers don't count
+	e.reply(&agent.PingPacket{DestinationAddress: "192.0.2.1", RoundTripTime: 20 * time.Second, Duplicate: true}, false)
+	e.reply(&agent.PingPacket{DestinationAddress: "198.51.100.1", RoundTripTime: time.Millisecond}, false)
+	e.reply(&agent.PingPacket{DestinationAddress: "192.0.2.1", RoundTripTime: 20 * time.Second, TimeToLive: 58}, false)
+	e.lost(&agent.PingPacket{DestinationAddress: "2001:db8::1"})
+	out := &bytes.Buffer{}
+	e.write(out)
+	for _, expected := range []string{
+		`ping_rtt_seconds_bucket{target="one.example",le="0.0025"} 0`,
+		`ping_rtt_seconds_bucket{target="one.example",le="0.005"} 1`,
+		`ping_rtt_seconds_bucket{target="one.example",le="10"} 1`,
+		`ping_rtt_seconds_bucket{target="one.example",le="+Inf"} 2`,
+		`ping_rtt_seconds_sum{target="one.example"} 20.003`,
+		`ping_rtt_seconds_count{target="one.example"} 2`,
+		`ping_packets_sent_total{target="one.example"} 2`,
+		`ping_packets_received_total{target="one.example"} 2`,
+		`ping_packets_lost_total{target="one.example"} 0`,
+		`ping_last_ttl{target="one.example"} 58`,
+		`ping_up{target="one.example"} 1`,
+		`ping_packets_sent_total{target="we\"ird"} 1`,
+		`ping_packets_lost_total{target="we\"ird"} 1`,
+		`ping_up{target="we\"ird"} 0`,
+		"# TYPE ping_rtt_seconds histogram",
+		"# TYPE ping_packets_sent_total counter",
+		"# TYPE ping_up gauge",
+	} {
+		if !strings.Contains(out.String(), expected+"\n") {
+			t.Errorf("expected %s in\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestExporter_Labels(t *testing.T) {
+	e := newExporter([]string{"a", "b"}, []string{"192.0.2.1", "192.0.2.2"},
+		[]map[string]string{{"site": "ams", "role": "dns"}, {"site": "fra"}})
+	out := &bytes.Buffer{}
+	e.write(out)
+	// every target has every label, sorted after the target
+	for _, expected := range []string{
+		`ping_up{target="a",role="dns",site="ams"} 0`,
+		`ping_up{target="b",role="",site="fra"} 0`,
+		`ping_rtt_seconds_bucket{target="b",role="",site="fra",le="+Inf"} 0`,
+	} {
+		if !strings.Contains(out.String(), expected+"\n") {
+			t.Errorf("expected %s in\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestExporter_CanonicalAddresses(t *testing.T) {
+	e := newExporter([]string{"upper", "zeros"}, []string{"2001:DB8::1", "2001:db8:0:0::2"}, nil)
+	// sent to the address as given, answered from the one the socket parsed
+	e.sent(0, "2001:DB8::1")
+	e.reply(&agent.PingPacket{DestinationAddress: "2001:db8::1", RoundTripTime: time.Millisecond}, false)
+	e.sent(0, "2001:db8:0:0::2")
+	e.lost(&agent.PingPacket{DestinationAddress: "2001:db8:0:0::2"})
+	out := &bytes.Buffer{}
+	e.write(out)
+	for _, expected := range []string{
+		`ping_packets_sent_total{target="upper"} 1`,
+		`ping_packets_received_total{target="upper"} 1`,
+		`ping_packets_sent_total{target="zeros"} 1`,
+		`ping_packets_lost_total{target="zeros"} 1`,
+	} {
+		if !strings.Contains(out.String(), expected+"\n") {
+			t.Errorf("expected %s in\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestValidLabelName(t *testing.T) {
+	tests := []struct {
+		desc     string
+		inName   string
+		expected bool
+	}{
+		{desc: "plain", inName: "site", expected: true},
+		{desc: "underscore-digits", inName: "_rack_2", expected: true},
+		{desc: "ours", inName: "target", expected: false},
+		{desc: "reserved", inName: "__name__", expected: false},
+		{desc: "dash", inName: "data-center", expected: false},
+		{desc: "leading-digit", inName: "2nd", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if valid := validLabelName(tt.inName); valid != tt.expected {
+				t.Errorf("%s: expected %v got %v", tt.desc, tt.expected, valid)
+			}
+		})
+	}
+}
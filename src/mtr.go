@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// clearScreen moves the cursor home and clears the terminal, for redrawing the table.
+const clearScreen = "\033[H\033[2J"
+
+// mtr keeps going over the route to a destination like mtr does, redrawing a
+// table of every hop's loss and round trip times every interval. With
+// -report (or when stdout isn't a terminal) only the final table is printed,
+// with -format json or ndjson the final statistics are JSON records instead.
+func mtr(arguments []string) {
+	flags := flag.NewFlagSet("mtr", flag.ExitOnError)
+	settings := agent.DefaultOptions()
+	firstHop := flags.Int("f", settings.FirstHop, "")
+	maxHops := flags.Int("m", settings.MaxHops, "")
+	count := flags.Int("c", 0, "")
+	deadline := flags.Duration("w", 2*time.Second, "")
+	interval := flags.Duration("i", time.Second, "")
+	packetSize := flags.Int("s", settings.Size, "")
+	report := flags.Bool("report", false, "")
+	format := flags.String("format", formatText, "")
+	flags.Usage = func() {
+		fmt.Printf(howToUse)
+	}
+	flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	records, err := newRecordWriter(*format, os.Stdout)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	// nobody is watching the table, so stop after as many rounds as mtr's report does
+	live := !*report && records == nil && isTerminal(os.Stdout)
+	if *count == 0 && !live {
+		*count = 10
+	}
+	ip, err := resolveDestination(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	settings.Destination = ip
+	settings.FirstHop = *firstHop
+	settings.MaxHops = *maxHops
+	if *count > 0 {
+		settings.Count = *count
+	}
+	settings.Deadline = *deadline
+	settings.Interval = *interval
+	settings.Size = *packetSize
+	options, err := agent.BuildOptions(settings)
+	if err != nil {
+		printOptionErrors(err)
+		os.Exit(1)
+	}
+	prober, err := agent.BuildMTR(options)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	interruptChannel := make(chan os.Signal, 1)
+	signal.Notify(interruptChannel, os.Interrupt)
+	go func() {
+		for range interruptChannel {
+			prober.Stop()
+		}
+	}()
+	started := time.Now()
+	if live {
+		prober.OnUpdate = func(hops []*agent.MTRHop) {
+			fmt.Print(clearScreen + mtrTable(flags.Arg(0), started, hops))
+		}
+	}
+	prober.OnError = printError
+	prober.OnMTRComplete = func(hops []*agent.MTRHop) {
+		if records != nil {
+			for _, hop := range hops {
+				records.mtrHop(ip, hop)
+			}
+			records.flush()
+			return
+		}
+		if live {
+			fmt.Print(clearScreen)
+		}
+		fmt.Print(mtrTable(flags.Arg(0), started, hops))
+	}
+	_, err = prober.Run(context.Background())
+	exitOnRunError(err)
+}
+
+// mtrTable is mtr's report: a row per hop with its loss and round trip times
+// in milliseconds, ??? for a hop nobody answered at, and every other address
+// that answered for a hop on a line of its own below it.
+func mtrTable(destination string, started time.Time, hops []*agent.MTRHop) string {
+	width := len("HOST: ") + len(destination)
+	for _, hop := range hops {
+		for _, responder := range hop.Responders {
+			if len(responder.Address)+len("  1.|-- ") > width {
+				width = len(responder.Address) + len("  1.|-- ")
+			}
+		}
+	}
+	var table strings.Builder
+	fmt.Fprintf(&table, "Start: %s\n", started.Format(time.RFC3339))
+	fmt.Fprintf(&table, "%-*s %6s %5s %6s %6s %6s %6s %6s\n", width, "HOST: "+destination,
+		"Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev")
+	for _, hop := range hops {
+		address := "???"
+		if len(hop.Responders) > 0 {
+			address = hop.Responders[0].Address
+		}
+		fmt.Fprintf(&table, "%-*s %5.1f%% %5d %6.1f %6.1f %6.1f %6.1f %6.1f\n", width, fmt.Sprintf("%3d.|-- %s", hop.TTL, address),
+			hop.PercentLost, hop.Sent, milliseconds(hop.LastRTT), milliseconds(hop.AverageRTT),
+			milliseconds(hop.BestRTT), milliseconds(hop.WorstRTT), milliseconds(hop.StdDevRTT))
+		for i := 1; i < len(hop.Responders); i++ {
+			fmt.Fprintf(&table, "    |  `-- %s\n", hop.Responders[i].Address)
+		}
+	}
+	return table.String()
+}
+
+// isTerminal is true when f is a terminal rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
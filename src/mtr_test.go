@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMtrTable(t *testing.T) {
+	tests := []struct {
+		desc          string
+		inHops        []*agent.MTRHop
+		expectedLines []string
+	}{
+		{
+			desc: "one-router",
+			inHops: []*agent.MTRHop{
+				{TTL: 1, Sent: 4, Received: 3, PercentLost: 25, LastRTT: 2 * time.Millisecond, AverageRTT: 1500 * time.Microsecond,
+					BestRTT: time.Millisecond, WorstRTT: 2 * time.Millisecond, StdDevRTT: 500 * time.Microsecond,
+					Responders: []*agent.MTRResponder{{Address: "192.0.2.1", Received: 3}}},
+			},
+			expectedLines: []string{
+				"HOST: example.com  Loss%   Snt   Last    Avg   Best   Wrst  StDev",
+				"  1.|-- 192.0.2.1  25.0%     4    2.0    1.5    1.0    2.0    0.5",
+			},
+		},
+		{
+			desc: "silent-and-load-balanced",
+			inHops: []*agent.MTRHop{
+				{TTL: 1, Sent: 2, PercentLost: 100},
+				{TTL: 2, Sent: 2, Received: 2, Responders: []*agent.MTRResponder{{Address: "198.51.100.1"}, {Address: "198.51.100.2"}}},
+			},
+			expectedLines: []string{
+				"HOST: example.com     Loss%   Snt   Last    Avg   Best   Wrst  StDev",
+				"  1.|-- ???          100.0%     2    0.0    0.0    0.0    0.0    0.0",
+				"  2.|-- 198.51.100.1   0.0%     2    0.0    0.0    0.0    0.0    0.0",
+				"    |  `-- 198.51.100.2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			table := mtrTable("example.com", time.Now(), tt.inHops)
+			lines := strings.Split(strings.TrimRight(table, "\n"), "\n")
+			if len(lines) != len(tt.expectedLines)+1 {
+				t.Fatalf("%s: expected a start line and %d more got\n%s", tt.desc, len(tt.expectedLines), table)
+			}
+			for i, expected := range tt.expectedLines {
+				if lines[i+1] != expected {
+					t.Errorf("%s: expected %q got %q", tt.desc, expected, lines[i+1])
+				}
+			}
+		})
+	}
+}
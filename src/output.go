@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"io"
+	"time"
+)
+
+// What -format can be: the human readable lines, one JSON array of every
+// record printed at the end, or one JSON record per line as they happen.
+const (
+	formatText   = "text"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// Every record has a type and an RFC 3339 timestamp, durations are in milliseconds.
+// These field names are what scripts parse, only ever add to them.
+
+type replyRecord struct {
+	Type           string  `json:"type"`
+	Timestamp      string  `json:"timestamp"`
+	Destination    string  `json:"destination"`
+	Sequence       int     `json:"icmp_seq"`
+	Bytes          int     `json:"bytes"`
+	TTL            int     `json:"ttl"`
+	RTT            float64 `json:"rtt_ms"`
+	Jitter         float64 `json:"jitter_ms"`
+	ExceededMaxTTL bool    `json:"exceeded_max_ttl"`
+	Duplicate      bool    `json:"duplicate"`
+	Untracked      bool    `json:"untracked"`
+	Reordered      bool    `json:"reordered"`
+	Late           bool    `json:"late"`
+	Corrupted      bool    `json:"corrupted"`
+	StampMismatch  bool    `json:"stamp_mismatch"`
+	// where the send and receive times came from: "kernel" or "userspace"
+	SendTimestamp    string `json:"send_timestamp"`
+	ReceiveTimestamp string `json:"receive_timestamp"`
+}
+
+type timeoutRecord struct {
+	Type        string `json:"type"`
+	Timestamp   string `json:"timestamp"`
+	Destination string `json:"destination"`
+	Sequence    int    `json:"icmp_seq"`
+}
+
+type icmpErrorRecord struct {
+	Type        string `json:"type"`
+	Timestamp   string `json:"timestamp"`
+	Destination string `json:"destination"`
+	Router      string `json:"router"`
+	Sequence    int    `json:"icmp_seq"`
+	// destination-unreachable, time-exceeded, redirect, parameter-problem or packet-too-big
+	ICMPType    string `json:"icmp_type"`
+	ICMPCode    int    `json:"icmp_code"`
+	Description string `json:"description"`
+}
+
+type corruptedRecord struct {
+	Type            string `json:"type"`
+	Timestamp       string `json:"timestamp"`
+	Destination     string `json:"destination"`
+	Sequence        int    `json:"icmp_seq"`
+	Offset          int    `json:"offset"`
+	Expected        byte   `json:"expected"`
+	Got             byte   `json:"got"`
+	MismatchedBytes int    `json:"mismatched_bytes"`
+	ExpectedLength  int    `json:"expected_length"`
+	GotLength       int    `json:"got_length"`
+}
+
+type summaryRecord struct {
+	Type               string  `json:"type"`
+	Timestamp          string  `json:"timestamp"`
+	Destination        string  `json:"destination"`
+	Transmitted        int     `json:"transmitted"`
+	Received           int     `json:"received"`
+	Lost               int     `json:"lost"`
+	PercentReceived    float64 `json:"percent_received"`
+	PercentLost        float64 `json:"percent_lost"`
+	ExceededMaxTTL     int     `json:"exceeded_max_ttl"`
+	MinRTT             float64 `json:"rtt_min_ms"`
+	AverageRTT         float64 `json:"rtt_avg_ms"`
+	MaxRTT             float64 `json:"rtt_max_ms"`
+	StdDevRTT          float64 `json:"rtt_mdev_ms"`
+	MedianRTT          float64 `json:"rtt_median_ms"`
+	P90RTT             float64 `json:"rtt_p90_ms"`
+	P95RTT             float64 `json:"rtt_p95_ms"`
+	P99RTT             float64 `json:"rtt_p99_ms"`
+	Jitter             float64 `json:"jitter_ms"`
+	MeanIPDV           float64 `json:"ipdv_mean_ms"`
+	MaxIPDV            float64 `json:"ipdv_max_ms"`
+	PDV99              float64 `json:"pdv_p99_ms"`
+	Duplicates         int     `json:"duplicates"`
+	Untracked          int     `json:"untracked"`
+	Reordered          int     `json:"reordered"`
+	MaxReorderDistance int     `json:"max_reorder_distance"`
+	Late               int     `json:"late"`
+	TimedOut           int     `json:"timed_out"`
+	TimeExceeded       int     `json:"time_exceeded"`
+	Unreachable        int     `json:"destination_unreachable"`
+	Redirects          int     `json:"redirect"`
+	ParameterProblems  int     `json:"parameter_problem"`
+	PacketTooBig       int     `json:"packet_too_big"`
+	Errors             int     `json:"errors"`
+	Corrupted          int     `json:"corrupted"`
+	StampMismatches    int     `json:"stamp_mismatches"`
+}
+
+// mtrHopRecord is one hop of an mtr's final report.
+type mtrHopRecord struct {
+	Type        string   `json:"type"`
+	Timestamp   string   `json:"timestamp"`
+	Destination string   `json:"destination"`
+	TTL         int      `json:"ttl"`
+	Responders  []string `json:"responders"`
+	Sent        int      `json:"sent"`
+	Received    int      `json:"received"`
+	PercentLost float64  `json:"percent_lost"`
+	LastRTT     float64  `json:"rtt_last_ms"`
+	AverageRTT  float64  `json:"rtt_avg_ms"`
+	BestRTT     float64  `json:"rtt_best_ms"`
+	WorstRTT    float64  `json:"rtt_worst_ms"`
+	StdDevRTT   float64  `json:"rtt_stdev_ms"`
+	Reached     bool     `json:"reached"`
+}
+
+// recordWriter prints structured records, either right away (ndjson) or
+// all of them as one JSON array once the ping is done (json).
+type recordWriter struct {
+	format  string
+	out     io.Writer
+	records []interface{}
+}
+
+// newRecordWriter gives back nil for text output, so callers can fall back to printing lines.
+func newRecordWriter(format string, out io.Writer) (*recordWriter, error) {
+	switch format {
+	case formatText:
+		return nil, nil
+	case formatJSON, formatNDJSON:
+		return &recordWriter{format: format, out: out}, nil
+	}
+	return nil, fmt.Errorf("unknown format %s, it can be %s, %s or %s", format, formatText, formatJSON, formatNDJSON)
+}
+
+func (w *recordWriter) reply(p *agent.PingPacket, exceededTTL bool) {
+	receivedAt := p.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	w.write(&replyRecord{
+		Type:             "reply",
+		Timestamp:        timestamp(receivedAt),
+		Destination:      p.DestinationAddress,
+		Sequence:         p.ICMPSequenceNumber,
+		Bytes:            p.NumberOfBytes,
+		TTL:              p.TimeToLive,
+		RTT:              milliseconds(p.RoundTripTime),
+		Jitter:           milliseconds(p.Jitter),
+		ExceededMaxTTL:   exceededTTL,
+		Duplicate:        p.Duplicate,
+		Untracked:        p.Untracked,
+		Reordered:        p.Reordered,
+		Late:             p.Late,
+		Corrupted:        p.Corrupted,
+		StampMismatch:    p.StampMismatch,
+		SendTimestamp:    string(p.SendTimestamp),
+		ReceiveTimestamp: string(p.ReceiveTimestamp),
+	})
+}
+
+func (w *recordWriter) timeout(sequence int, destination string) {
+	w.write(&timeoutRecord{
+		Type:        "timeout",
+		Timestamp:   timestamp(time.Now()),
+		Destination: destination,
+		Sequence:    sequence,
+	})
+}
+
+func (w *recordWriter) icmpError(e *agent.ICMPErrorPacket) {
+	w.write(&icmpErrorRecord{
+		Type:        "icmp_error",
+		Timestamp:   timestamp(time.Now()),
+		Destination: e.Destination,
+		Router:      e.Router,
+		Sequence:    e.ICMPSequenceNumber,
+		ICMPType:    string(e.Type),
+		ICMPCode:    e.Code,
+		Description: e.Description,
+	})
+}
+
+func (w *recordWriter) corrupted(c *agent.CorruptedReplyPacket) {
+	w.write(&corruptedRecord{
+		Type:            "corrupted",
+		Timestamp:       timestamp(time.Now()),
+		Destination:     c.Destination,
+		Sequence:        c.ICMPSequenceNumber,
+		Offset:          c.Offset,
+		Expected:        c.Expected,
+		Got:             c.Got,
+		MismatchedBytes: c.MismatchedBytes,
+		ExpectedLength:  c.ExpectedLength,
+		GotLength:       c.GotLength,
+	})
+}
+
+func (w *recordWriter) summary(p *agent.CompletedPingStatistics) {
+	w.write(&summaryRecord{
+		Type:               "summary",
+		Timestamp:          timestamp(time.Now()),
+		Destination:        p.Destination,
+		Transmitted:        p.PacketsReceived + p.PacketsLost,
+		Received:           p.PacketsReceived,
+		Lost:               p.PacketsLost,
+		PercentReceived:    p.PercentReceived,
+		PercentLost:        p.PercentLost,
+		ExceededMaxTTL:     p.ExceededTTL,
+		MinRTT:             milliseconds(p.MinRTT),
+		AverageRTT:         milliseconds(p.AverageRTT),
+		MaxRTT:             milliseconds(p.MaxRTT),
+		StdDevRTT:          milliseconds(p.StdDevRTT),
+		MedianRTT:          milliseconds(p.MedianRTT),
+		P90RTT:             milliseconds(p.P90RTT),
+		P95RTT:             milliseconds(p.P95RTT),
+		P99RTT:             milliseconds(p.P99RTT),
+		Jitter:             milliseconds(p.Jitter),
+		MeanIPDV:           milliseconds(p.MeanIPDV),
+		MaxIPDV:            milliseconds(p.MaxIPDV),
+		PDV99:              milliseconds(p.PDV99),
+		Duplicates:         p.DuplicateReplies,
+		Untracked:          p.UntrackedReplies,
+		Reordered:          p.ReorderedReplies,
+		MaxReorderDistance: p.MaxReorderDistance,
+		Late:               p.LateReplies,
+		TimedOut:           p.TimedOutProbes,
+		TimeExceeded:       p.TimeExceededReplies,
+		Unreachable:        p.DestinationUnreachableReplies,
+		Redirects:          p.RedirectReplies,
+		ParameterProblems:  p.ParameterProblemReplies,
+		PacketTooBig:       p.PacketTooBigReplies,
+		Errors:             icmpErrors(p),
+		Corrupted:          p.CorruptedReplies,
+		StampMismatches:    p.StampMismatches,
+	})
+}
+
+func (w *recordWriter) mtrHop(destination string, h *agent.MTRHop) {
+	responders := []string{}
+	for _, responder := range h.Responders {
+		responders = append(responders, responder.Address)
+	}
+	w.write(&mtrHopRecord{
+		Type:        "hop",
+		Timestamp:   timestamp(time.Now()),
+		Destination: destination,
+		TTL:         h.TTL,
+		Responders:  responders,
+		Sent:        h.Sent,
+		Received:    h.Received,
+		PercentLost: h.PercentLost,
+		LastRTT:     milliseconds(h.LastRTT),
+		AverageRTT:  milliseconds(h.AverageRTT),
+		BestRTT:     milliseconds(h.BestRTT),
+		WorstRTT:    milliseconds(h.WorstRTT),
+		StdDevRTT:   milliseconds(h.StdDevRTT),
+		Reached:     h.Reached,
+	})
+}
+
+func (w *recordWriter) write(record interface{}) {
+	if w.format == formatJSON {
+		w.records = append(w.records, record)
+		return
+	}
+	if err := json.NewEncoder(w.out).Encode(record); err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+	}
+}
+
+// flush prints the JSON array, ndjson records are already out.
+func (w *recordWriter) flush() {
+	if w.format != formatJSON {
+		return
+	}
+	if w.records == nil {
+		w.records = []interface{}{}
+	}
+	encoder := json.NewEncoder(w.out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(w.records); err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+	}
+}
+
+func timestamp(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
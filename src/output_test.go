@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"testing"
+	"time"
+)
+
+func TestNewRecordWriter(t *testing.T) {
+	tests := []struct {
+		desc        string
+		inFormat    string
+		expectedNil bool
+		expectedErr bool
+	}{
+		{desc: "text", inFormat: formatText, expectedNil: true},
+		{desc: "json", inFormat: formatJSON},
+		{desc: "ndjson", inFormat: formatNDJSON},
+		{desc: "unknown", inFormat: "xml", expectedNil: true, expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			writer, err := newRecordWriter(tt.inFormat, &bytes.Buffer{})
+			if (err != nil) != tt.expectedErr || (writer == nil) != tt.expectedNil {
+				t.Errorf("%s: expected err %v and nil %v got %v, %v", tt.desc, tt.expectedErr, tt.expectedNil, err, writer)
+			}
+		})
+	}
+}
+
+// scripts parse these field names, changing one is a breaking change
+func TestRecordWriter_NDJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	writer, _ := newRecordWriter(formatNDJSON, out)
+	receivedAt := time.Date(2020, 5, 6, 14, 57, 44, 500000000, time.UTC)
+	writer.reply(&agent.PingPacket{
+		RoundTripTime:      1500 * time.Microsecond,
+		DestinationAddress: "1.1.1.1",
+		ICMPSequenceNumber: 3,
+		TimeToLive:         57,
+		NumberOfBytes:      64,
+		Duplicate:          true,
+		ReceivedAt:         receivedAt,
+	}, false)
+	writer.timeout(4, "1.1.1.1")
+	writer.summary(&agent.CompletedPingStatistics{Destination: "1.1.1.1", PacketsReceived: 1, PacketsLost: 1, AverageRTT: 1500 * time.Microsecond})
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 records got %d: %s", len(lines), out.String())
+	}
+	var reply, timeout, summary map[string]interface{}
+	for i, record := range []*map[string]interface{}{&reply, &timeout, &summary} {
+		if err := json.Unmarshal(lines[i], record); err != nil {
+			t.Fatalf("record %d is not JSON: %s", i, err.Error())
+		}
+	}
+	if reply["type"] != "reply" || reply["timestamp"] != "2020-05-06T14:57:44.5Z" || reply["icmp_seq"] != 3.0 ||
+		reply["rtt_ms"] != 1.5 || reply["ttl"] != 57.0 || reply["duplicate"] != true {
+		t.Errorf("unexpected reply record %s", lines[0])
+	}
+	if timeout["type"] != "timeout" || timeout["icmp_seq"] != 4.0 || timeout["destination"] != "1.1.1.1" {
+		t.Errorf("unexpected timeout record %s", lines[1])
+	}
+	if _, err := time.Parse(time.RFC3339, timeout["timestamp"].(string)); err != nil {
+		t.Errorf("timestamp is not RFC 3339: %s", err.Error())
+	}
+	if summary["type"] != "summary" || summary["transmitted"] != 2.0 || summary["percent_lost"] != 0.0 || summary["rtt_avg_ms"] != 1.5 {
+		t.Errorf("unexpected summary record %s", lines[2])
+	}
+}
+
+func TestRecordWriter_JSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	writer, _ := newRecordWriter(formatJSON, out)
+	writer.timeout(0, "::1")
+	if out.Len() != 0 {
+		t.Errorf("json should hold records back until flush, got %s", out.String())
+	}
+	writer.summary(&agent.CompletedPingStatistics{Destination: "::1"})
+	writer.flush()
+	var records []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &records); err != nil || len(records) != 2 || records[1]["type"] != "summary" {
+		t.Errorf("expected an array of 2 records got %s (%v)", out.String(), err)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/adiprerepa/ping-go/src/pkg/agent"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -17,7 +22,15 @@ Check Me Out: http://adiprerepa.github.io/
 
 Usage:
 
-	ping [-c count] [-w deadline] [-t timeout] [-p pad pattern] [-q quiet output] [-i interval] [-ttl max time to live] destination
+	ping [-c count] [-w deadline] [-W probe timeout] [-O report timeouts] [-t timeout] [-p pad pattern] [-s packet size] [-pattern pad|random|increment] [-q quiet output] [-i interval] [-ttl outgoing time to live] [-max_ttl max received time to live] [-privileged] [-format text|json|ndjson] [-csv file] [-f destination file] destination...
+	ping -sweep [-rate packets per second] [-allow cidrs] [-block cidrs] [-w deadline] cidr|range...
+	ping [-format text|json|ndjson] [-csv file] [-q quiet output] [-O report timeouts] -config config-file
+	ping serve [-listen address] [-i interval] [-W probe timeout] [-s packet size] [-ttl outgoing time to live] [-privileged] [-f destination file] destination...
+	ping serve [-listen address] -config config-file
+	ping validate config-file
+	ping traceroute [-f first ttl] [-m max hops] [-q queries per hop] [-w wait per probe] [-i interval] [-s packet size] destination
+	ping mtr [-f first ttl] [-m max hops] [-c rounds] [-w wait per probe] [-i interval] [-s packet size] [-report] [-format text|json|ndjson] destination
+	ping pmtu [-m max mtu] [-q tries per size] [-w wait per try] [-i interval] destination
 
 Some Examples:	
 	
@@ -30,8 +43,15 @@ Some Examples:
 	# Give the ping a deadline to complete (in seconds)
 	sudo ./ping -w 10s adiprerepa.github.io
 	
-	# Give the ping a pad pattern (Works only in special cases)
-	sudo ./ping -p 01010101010 adiprerepa.github.io
+	# Fill the payload with a pad pattern (up to 16 bytes in hex, like iputils)
+	sudo ./ping -p ff00aa55 adiprerepa.github.io
+
+	# Send 1472 data bytes per ping (default 56, the first 16 are a timestamp and tracker)
+	sudo ./ping -s 1472 adiprerepa.github.io
+
+	# Fill the payload with random bytes, or with each byte's offset
+	sudo ./ping -s 1000 -pattern random adiprerepa.github.io
+	sudo ./ping -s 1000 -pattern increment adiprerepa.github.io
 
 	# Make the Ping shut up (No output until completion)
 	sudo ./ping --quiet_output adiprerepa.github.io
@@ -39,63 +59,216 @@ Some Examples:
 	# Give the ping a timeout (in seconds)
 	sudo ./ping -t 5s adiprerepa.github.io
 
+	# Flag replies that take longer than 500ms as late (default 10s)
+	sudo ./ping -W 500ms adiprerepa.github.io
+
+	# Print "no answer yet" as soon as a probe goes 2s without a reply
+	sudo ./ping -O -W 2s adiprerepa.github.io
+
 	# Give the ping an interval (time in between pings, in seconds)
 	sudo ./ping -i 1s adiprerepa.github.io
 
-	# Give the ping a max Time to live
-	sudo ./ping -ttl 100 adiprerepa.github.io
+	# Send the pings with a Time to live of 3 (routers further away answer with Time Exceeded)
+	sudo ./ping -ttl 3 adiprerepa.github.io
+
+	# Flag replies that come back with a Time to live above 100
+	sudo ./ping -max_ttl 100 adiprerepa.github.io
+
+	# Ping many destinations at once, with a summary per destination
+	sudo ./ping -c 5 adiprerepa.github.io 1.1.1.1 8.8.8.8
+
+	# Ping every destination listed in a file (one per line, - reads stdin)
+	sudo ./ping -c 5 -f hosts.txt
+	cat hosts.txt | sudo ./ping -c 5 -f -
+
+	# Find the live hosts of a network, 50 packets a second, never touching 10.0.1.0/24
+	sudo ./ping -sweep -rate 50 -block 10.0.1.0/24 10.0.0.0/22
+
+	# Sweep a range, but only if it is inside the allowlist
+	sudo ./ping -sweep -allow 192.168.1.0/24 192.168.1.10-192.168.1.50
+
+	# Print every reply, timeout and the summary as one JSON record per line
+	./ping -c 5 -format ndjson adiprerepa.github.io
+
+	# Or as a single JSON array once the ping is done
+	./ping -c 5 -format json adiprerepa.github.io 1.1.1.1
+
+	# Also write every probe (send time, icmp_seq, destination, bytes, ttl, rtt) to a CSV file
+	./ping -c 100 -W 2s -csv probes.csv adiprerepa.github.io
+
+	# Ping forever and expose RTT histograms, counters and up gauges on :9427/metrics for Prometheus
+	./ping serve -listen :9427 -i 5s -W 2s adiprerepa.github.io 1.1.1.1
+
+	# Ping every target of a config file, each with its own interval, count, timeout, size, TTL and labels
+	./ping -config targets.conf
+
+	# Check a config file, every problem is printed with its line number
+	./ping validate targets.conf
+
+	# Find the routers on the way to a destination, 2 echo requests per TTL, up to 20 hops
+	sudo ./ping traceroute -q 2 -m 20 adiprerepa.github.io
+
+	# Keep going over the route, redrawing every hop's loss and round trip times each second
+	sudo ./ping mtr adiprerepa.github.io
+
+	# Or print the table (or JSON records) once, after 100 rounds
+	sudo ./ping mtr -report -c 100 adiprerepa.github.io
+	sudo ./ping mtr -c 100 -format json adiprerepa.github.io
+
+	# Find the biggest packet (up to 9000 bytes) that gets to a destination without being fragmented
+	sudo ./ping pmtu -m 9000 adiprerepa.github.io
+
+	# Skip the unprivileged socket and use a raw ICMP socket
+	sudo ./ping -privileged adiprerepa.github.io
 	
 You can ping Ipv6, set a max TTL, and much more. 
 Unit Tests cover all the core functions.
 Happy Pinging!
 
-NOTE: Ping needs to be run in sudo mode for ICMP to work.
+NOTE: Ping first tries unprivileged ICMP sockets, which work without sudo when
+your group is inside net.ipv4.ping_group_range. Otherwise it falls back to raw
+ICMP sockets, which need to be run in sudo mode.
 `
 
 func main() {
-	timeout := flag.Duration("t", time.Second*100000, "")
-	deadline := flag.Duration("w", time.Second, "")
-	count := flag.Int("c", int(^uint(0) >> 1), "")
-	pad := flag.String("p", "00000000", "")
-	ttl := flag.String("ttl", "255", "")
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "traceroute" {
+		traceroute(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mtr" {
+		mtr(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "pmtu" {
+		pmtu(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+		return
+	}
+	// the flags start out as the library's defaults
+	settings := agent.DefaultOptions()
+	timeout := flag.Duration("t", settings.Timeout, "")
+	deadline := flag.Duration("w", settings.Deadline, "")
+	probeTimeout := flag.Duration("W", settings.ProbeTimeout, "")
+	count := flag.Int("c", settings.Count, "")
+	pad := flag.String("p", settings.Pad, "")
+	packetSize := flag.Int("s", settings.Size, "")
+	pattern := flag.String("pattern", settings.Pattern, "")
+	ttl := flag.Int("ttl", settings.TTL, "")
+	maxTTL := flag.Int("max_ttl", settings.MaxTTL, "")
 	quietOutput := flag.Bool("quiet_output", false, "")
-	interval := flag.Duration("i", time.Second, "")
+	reportTimeouts := flag.Bool("O", false, "")
+	interval := flag.Duration("i", settings.Interval, "")
+	privileged := flag.Bool("privileged", settings.Privileged, "")
+	targetFile := flag.String("f", "", "")
+	sweepMode := flag.Bool("sweep", false, "")
+	rate := flag.Int("rate", settings.Rate, "")
+	allow := flag.String("allow", "", "")
+	block := flag.String("block", "", "")
+	format := flag.String("format", formatText, "")
+	csvFile := flag.String("csv", "", "")
+	configFile := flag.String("config", "", "")
 	flag.Usage = func() {
 		fmt.Printf(howToUse)
 	}
 	flag.Parse()
-	if flag.NArg() == 0 {
+	destinations := flag.Args()
+	if *targetFile != "" {
+		fileDestinations, err := readDestinations(*targetFile)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		destinations = append(destinations, fileDestinations...)
+	}
+	if len(destinations) == 0 && *configFile == "" {
 		flag.Usage()
 		return
 	}
-	var ip string
-	pingDestination := flag.Arg(0)
-	res, err := agent.IsIPv4(pingDestination)
+	if *configFile != "" && (len(destinations) > 0 || *sweepMode) {
+		fmt.Printf("error: -config: the targets come from the config file\n")
+		os.Exit(1)
+	}
+	settings.Count = *count
+	settings.Interval = *interval
+	settings.Timeout = *timeout
+	settings.Deadline = *deadline
+	settings.ProbeTimeout = *probeTimeout
+	settings.TTL = *ttl
+	settings.MaxTTL = *maxTTL
+	settings.Pad = *pad
+	settings.Size = *packetSize
+	settings.Pattern = *pattern
+	settings.Privileged = *privileged
+	settings.Rate = *rate
+	options, err := agent.BuildOptions(settings)
 	if err != nil {
-		fmt.Printf("error: %s\n", err.Error())
+		printOptionErrors(err)
 		os.Exit(1)
 	}
-	if res {
-		addr, err := net.LookupIP(pingDestination)
+	records, err := newRecordWriter(*format, os.Stdout)
+	if err != nil {
+		fmt.Printf("error: -format: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *sweepMode {
+		if records != nil {
+			fmt.Printf("error: -format: sweeps only print text\n")
+			os.Exit(1)
+		}
+		if *csvFile != "" {
+			fmt.Printf("error: -csv: sweeps don't write probe CSVs\n")
+			os.Exit(1)
+		}
+		sweep(options, destinations, *allow, *block, *quietOutput)
+		return
+	}
+	var probeRows *probeWriter
+	if *csvFile != "" {
+		probeRows, err = newProbeWriter(*csvFile)
 		if err != nil {
-			fmt.Printf("LOOKUP ERR :%s\n", err.Error())
+			fmt.Printf("error: -csv: %s\n", err.Error())
+			os.Exit(1)
 		}
-		ip = addr[0].String()
-	} else {
-		ip = pingDestination
 	}
-	options := &agent.PresentOptions{}
-	_ = options.ParseCountFlag(*count)
-	_ = options.ParseTimeoutFlag(*timeout)
-	_ = options.ParseDeadlineFlag(*deadline)
-	err = options.ParsePadding(*pad)
-	if err != nil {
-		fmt.Printf(err.Error())
-		os.Exit(1)
+	// every target of a config file has its own settings, the flags only pick the output
+	if *configFile != "" {
+		targets := loadConfig(*configFile)
+		pinger, err := agent.BuildMultiPingerFromOptions(targets.options)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		multiPing(pinger, targets.names, *quietOutput, *reportTimeouts, records, probeRows)
+		return
+	}
+	var ips []string
+	for _, pingDestination := range destinations {
+		ip, err := resolveDestination(pingDestination)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		ips = append(ips, ip)
+	}
+	// more than one destination (or a list of them) pings them all at once
+	if len(ips) > 1 || *targetFile != "" {
+		pinger, err := agent.BuildMultiPinger(options, ips)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		multiPing(pinger, ips, *quietOutput, *reportTimeouts, records, probeRows)
+		return
 	}
-	_ = options.ParseIntervalFlag(*interval)
+	ip := ips[0]
 	_ = options.ParseIPAddress(ip)
-	_ = options.ParseTTL(*ttl)
 	pinger := agent.BuildPinger(options)
 	interruptChannel := make(chan os.Signal, 1)
 	signal.Notify(interruptChannel, os.Interrupt)
@@ -104,20 +277,301 @@ func main() {
 			pinger.Stop()
 		}
 	}()
+	// structured records carry every timeout, -O only decides whether text prints them
+	if !*quietOutput && (*reportTimeouts || records != nil) {
+		pinger.OnEchoTimeout = func(sequence int, destination string) {
+			if records != nil {
+				records.timeout(sequence, destination)
+				return
+			}
+			fmt.Printf("no answer yet for icmp_seq=%d\n", sequence)
+		}
+	}
 	if !*quietOutput {
+		pinger.OnICMPError = func(e *agent.ICMPErrorPacket) {
+			if records != nil {
+				records.icmpError(e)
+				return
+			}
+			fmt.Printf("From %s icmp_seq=%d %s\n", e.Router, e.ICMPSequenceNumber, e.Description)
+		}
+		pinger.OnCorruptedReply = func(c *agent.CorruptedReplyPacket) {
+			if records != nil {
+				records.corrupted(c)
+				return
+			}
+			fmt.Printf("icmp_seq=%d %s\n", c.ICMPSequenceNumber, corruption(c))
+		}
 		pinger.OnEchoComplete = func(p *agent.PingPacket, exceededTTL bool) {
-			fmt.Printf("%d Bytes from %s: icmp_seq=%d time=%v ttl=%v exceeded_max_ttl:%v\n", p.NumberOfBytes, p.DestinationAddress, p.ICMPSequenceNumber, p.RoundTripTime,
-				p.TimeToLive, exceededTTL)
+			if records != nil {
+				records.reply(p, exceededTTL)
+				return
+			}
+			fmt.Printf("%d Bytes from %s: icmp_seq=%d time=%v ttl=%v jitter=%v exceeded_max_ttl:%v%s\n", p.NumberOfBytes, p.DestinationAddress, p.ICMPSequenceNumber, p.RoundTripTime,
+				p.TimeToLive, p.Jitter, exceededTTL, replyFlags(p))
 		}
 	}
+	// -csv gets every probe, even with -quiet_output
+	if probeRows != nil {
+		pinger.OnEchoSent = probeRows.sent
+		pinger.OnEchoComplete = probeRows.follow(pinger.OnEchoComplete)
+		pinger.OnEchoLost = probeRows.lost
+	}
 	pinger.OnProcessComplete = func(p *agent.CompletedPingStatistics) {
+		if records != nil {
+			records.summary(p)
+			records.flush()
+			return
+		}
 		fmt.Printf("\n-----------ping statistics-----------\n")
 		fmt.Printf("%d transmitted packets, %d received packets, %d lost packets, %v%% packet recovery, %v%% packet loss\n",
 			p.PacketsReceived + p.PacketsLost, p.PacketsReceived, p.PacketsLost, p.PercentReceived, p.PercentLost)
+		// like iputils' "+N errors", the echo requests they are about are still lost
+		if count := icmpErrors(p); count > 0 {
+			fmt.Printf("+%d errors: %d destination unreachable, %d time exceeded, %d redirects, %d parameter problems, %d packet too big\n",
+				count, p.DestinationUnreachableReplies, p.TimeExceededReplies, p.RedirectReplies, p.ParameterProblemReplies,
+				p.PacketTooBigReplies)
+		}
 		fmt.Printf("packets exceeded max ttl: %v avg round trip: %v\n", p.ExceededTTL, p.AverageRTT)
+		if p.DuplicateReplies > 0 || p.UntrackedReplies > 0 || p.ReorderedReplies > 0 || p.LateReplies > 0 || p.TimedOutProbes > 0 ||
+			p.CorruptedReplies > 0 || p.StampMismatches > 0 {
+			fmt.Printf("+%d duplicates, %d untracked, %d reordered (max distance %d), %d late, %d timed out, %d corrupted, %d stamp mismatches\n",
+				p.DuplicateReplies, p.UntrackedReplies, p.ReorderedReplies, p.MaxReorderDistance, p.LateReplies, p.TimedOutProbes,
+				p.CorruptedReplies, p.StampMismatches)
+		}
+		// same format as iputils, which only prints it once something came back
+		if p.PacketsReceived > 0 {
+			fmt.Printf("rtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms\n", milliseconds(p.MinRTT), milliseconds(p.AverageRTT),
+				milliseconds(p.MaxRTT), milliseconds(p.StdDevRTT))
+			fmt.Printf("rtt median/p90/p95/p99 = %.3f/%.3f/%.3f/%.3f ms\n", milliseconds(p.MedianRTT), milliseconds(p.P90RTT),
+				milliseconds(p.P95RTT), milliseconds(p.P99RTT))
+			fmt.Printf("jitter = %.3f ms, ipdv mean/max = %.3f/%.3f ms, pdv p99 = %.3f ms\n", milliseconds(p.Jitter),
+				milliseconds(p.MeanIPDV), milliseconds(p.MaxIPDV), milliseconds(p.PDV99))
+		}
 	}
 
-	fmt.Println("Aditya's Pinger!")
-	fmt.Printf("PING: %s:\n", ip)
-	pinger.Driver()
+	if records == nil {
+		fmt.Println("Aditya's Pinger!")
+		fmt.Printf("PING: %s:\n", ip)
+	}
+	pinger.OnError = printError
+	_, err = pinger.Run(context.Background())
+	// the probes still unanswered get their rows before we (maybe) exit
+	if probeRows != nil {
+		probeRows.close()
+	}
+	exitOnRunError(err)
+}
+
+// multiPing pings every destination at once over a shared socket, printing
+// per-destination replies and a summary table, or records when there is a writer for them,
+// and a CSV row per probe with -csv.
+func multiPing(pinger *agent.MultiPingerAgent, names []string, quietOutput bool, reportTimeouts bool, records *recordWriter, probeRows *probeWriter) {
+	interruptChannel := make(chan os.Signal, 1)
+	signal.Notify(interruptChannel, os.Interrupt)
+	go func() {
+		for range interruptChannel {
+			pinger.Stop()
+		}
+	}()
+	if !quietOutput && (reportTimeouts || records != nil) {
+		pinger.OnEchoTimeout = func(sequence int, destination string) {
+			if records != nil {
+				records.timeout(sequence, destination)
+				return
+			}
+			fmt.Printf("%s: no answer yet for icmp_seq=%d\n", destination, sequence)
+		}
+	}
+	if !quietOutput {
+		pinger.OnICMPError = func(e *agent.ICMPErrorPacket) {
+			if records != nil {
+				records.icmpError(e)
+				return
+			}
+			fmt.Printf("%s: From %s icmp_seq=%d %s\n", e.Destination, e.Router, e.ICMPSequenceNumber, e.Description)
+		}
+		pinger.OnCorruptedReply = func(c *agent.CorruptedReplyPacket) {
+			if records != nil {
+				records.corrupted(c)
+				return
+			}
+			fmt.Printf("%s: icmp_seq=%d %s\n", c.Destination, c.ICMPSequenceNumber, corruption(c))
+		}
+		pinger.OnEchoComplete = func(p *agent.PingPacket, exceededTTL bool) {
+			if records != nil {
+				records.reply(p, exceededTTL)
+				return
+			}
+			fmt.Printf("%s: %d Bytes icmp_seq=%d time=%v ttl=%v jitter=%v exceeded_max_ttl:%v%s\n", p.DestinationAddress, p.NumberOfBytes, p.ICMPSequenceNumber, p.RoundTripTime,
+				p.TimeToLive, p.Jitter, exceededTTL, replyFlags(p))
+		}
+	}
+	if probeRows != nil {
+		pinger.OnEchoSent = probeRows.sent
+		pinger.OnEchoComplete = probeRows.follow(pinger.OnEchoComplete)
+		pinger.OnEchoLost = probeRows.lost
+	}
+	pinger.OnProcessComplete = func(stats []*agent.CompletedPingStatistics) {
+		if records != nil {
+			for _, p := range stats {
+				records.summary(p)
+			}
+			records.flush()
+			return
+		}
+		fmt.Printf("\n-----------ping statistics-----------\n")
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "destination\ttransmitted\treceived\tlost\tloss\tmin/avg/max/mdev (ms)\tmedian/p90/p95/p99 (ms)\tjitter (ms)\t")
+		for _, p := range stats {
+			fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%.1f%%\t%.3f/%.3f/%.3f/%.3f\t%.3f/%.3f/%.3f/%.3f\t%.3f\t\n", p.Destination,
+				p.PacketsReceived + p.PacketsLost, p.PacketsReceived, p.PacketsLost, p.PercentLost,
+				milliseconds(p.MinRTT), milliseconds(p.AverageRTT), milliseconds(p.MaxRTT), milliseconds(p.StdDevRTT),
+				milliseconds(p.MedianRTT), milliseconds(p.P90RTT), milliseconds(p.P95RTT), milliseconds(p.P99RTT), milliseconds(p.Jitter))
+		}
+		table.Flush()
+	}
+	if records == nil {
+		fmt.Println("Aditya's Pinger!")
+		fmt.Printf("PING: %s:\n", strings.Join(names, ", "))
+	}
+	pinger.OnError = printError
+	_, err := pinger.Run(context.Background())
+	if probeRows != nil {
+		probeRows.close()
+	}
+	exitOnRunError(err)
+}
+
+// optionFlags are the flags behind each field of agent.Options.
+var optionFlags = map[string]string{
+	"Count":        "-c",
+	"Interval":     "-i",
+	"Timeout":      "-t",
+	"Deadline":     "-w",
+	"ProbeTimeout": "-W",
+	"TTL":          "-ttl",
+	"MaxTTL":       "-max_ttl",
+	"Pad":          "-p",
+	"Size":         "-s",
+	"Pattern":      "-pattern",
+	"Rate":         "-rate",
+	// traceroute's
+	"FirstHop": "-f",
+	"MaxHops":  "-m",
+	"Queries":  "-q",
+}
+
+// printOptionErrors prints every problem with the flags, each with the flag it came from.
+func printOptionErrors(err error) {
+	errs, ok := err.(agent.OptionErrors)
+	if !ok {
+		fmt.Printf("error: %s\n", err.Error())
+		return
+	}
+	for _, e := range errs {
+		fmt.Printf("error: %s: %s\n", optionFlags[e.Option], strings.TrimSpace(e.Err.Error()))
+	}
+}
+
+// printError prints a problem the ping carries on after, on stderr so records on stdout stay parseable.
+func printError(err error) {
+	fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+}
+
+// exitOnRunError prints why a ping couldn't run (or stopped receiving) and exits,
+// with a hint when we weren't allowed to open the socket.
+func exitOnRunError(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Printf("error: %s\n", err.Error())
+	var permission *agent.PermissionError
+	if errors.As(err, &permission) {
+		fmt.Print("Did you forget to run in sudo mode (or allow your group in net.ipv4.ping_group_range)?\n")
+	}
+	os.Exit(1)
+}
+
+// replyFlags marks duplicated, untracked, reordered, late, corrupted and restamped replies like iputils marks DUP!s.
+func replyFlags(p *agent.PingPacket) string {
+	var flags string
+	if p.Duplicate {
+		flags += " (DUP!)"
+	}
+	if p.Untracked {
+		flags += " (untracked)"
+	}
+	if p.Reordered {
+		flags += " (reordered)"
+	}
+	if p.Late {
+		flags += " (late)"
+	}
+	if p.Corrupted {
+		flags += " (corrupted)"
+	}
+	if p.StampMismatch {
+		flags += " (stamp mismatch)"
+	}
+	return flags
+}
+
+// corruption describes where a corrupted reply first differs, like iputils' "wrong data byte".
+func corruption(c *agent.CorruptedReplyPacket) string {
+	if c.Offset >= c.ExpectedLength || c.Offset >= c.GotLength {
+		return fmt.Sprintf("truncated/padded reply: expected %d data bytes but got %d", c.ExpectedLength, c.GotLength)
+	}
+	return fmt.Sprintf("wrong data byte #%d should be 0x%x but was 0x%x (%d bytes differ)", c.Offset, c.Expected, c.Got, c.MismatchedBytes)
+}
+
+// icmpErrors is how many ICMP errors came back about our echo requests, of every type.
+func icmpErrors(p *agent.CompletedPingStatistics) int {
+	return p.DestinationUnreachableReplies + p.TimeExceededReplies + p.RedirectReplies + p.ParameterProblemReplies +
+		p.PacketTooBigReplies
+}
+
+// milliseconds is how iputils prints round trip times.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// resolveDestination turns a hostname into an IP address, IP addresses are left alone.
+func resolveDestination(pingDestination string) (string, error) {
+	res, err := agent.IsIPv4(pingDestination)
+	if err != nil {
+		return "", err
+	}
+	if !res {
+		return pingDestination, nil
+	}
+	addr, err := net.LookupIP(pingDestination)
+	if err != nil {
+		return "", fmt.Errorf("lookup %s: %s", pingDestination, err.Error())
+	}
+	return addr[0].String(), nil
+}
+
+// readDestinations reads one destination per line from a file, or from stdin for "-".
+// Blank lines and lines starting with # are skipped.
+func readDestinations(path string) ([]string, error) {
+	input := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		input = file
+	}
+	var destinations []string
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		destinations = append(destinations, line)
+	}
+	return destinations, scanner.Err()
 }
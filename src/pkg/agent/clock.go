@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where the agents get the time, their timers and their tickers
+// from: the real time unless their Clock says otherwise, e.g. a FakeClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls f once d has passed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a time.Timer of a Clock, C is nil for AfterFunc's.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// clockOrReal is the real clock for a nil Clock.
+func clockOrReal(clock Clock) Clock {
+	if clock == nil {
+		return realClock{}
+	}
+	return clock
+}
+
+// fakeClockSettle is how long a FakeClock gives goroutines to react to a
+// timer it fired before it moves on, in real time.
+const fakeClockSettle = time.Millisecond
+
+// FakeClock is a Clock for tests that only moves when it is told to. Its
+// timers and tickers fire in order as Advance goes past them, waiting for
+// each one to be received, so a pinger on a FakeClock (and a SimulatedNetwork
+// on the same one) sees exact intervals, timeouts and round trip times while
+// the test runs in a fraction of the time.
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+	// to keep timers due at the same time in the order they were made
+	created int
+}
+
+// NewFakeClock makes a FakeClock that starts at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(&fakeTimer{c: make(chan time.Time, 1)}, d)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.add(&fakeTimer{c: make(chan time.Time, 1), period: d}, d)}
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(&fakeTimer{f: f}, d)
+}
+
+func (c *FakeClock) add(timer *fakeTimer, d time.Duration) *fakeTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer.clock = c
+	c.schedule(timer, d)
+	return timer
+}
+
+// schedule (re)starts a timer d from now, the lock has to be held.
+func (c *FakeClock) schedule(timer *fakeTimer, d time.Duration) {
+	c.created++
+	timer.at = c.now.Add(d)
+	timer.order = c.created
+	if !timer.waiting {
+		timer.waiting = true
+		c.waiters = append(c.waiters, timer)
+	}
+}
+
+// Next is when the next timer or ticker fires, false if there is none.
+func (c *FakeClock) Next() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	next := c.next()
+	if next == nil {
+		return time.Time{}, false
+	}
+	return next.at, true
+}
+
+// next is the waiting timer that fires first, the lock has to be held.
+func (c *FakeClock) next() *fakeTimer {
+	if len(c.waiters) == 0 {
+		return nil
+	}
+	sort.Slice(c.waiters, func(i, j int) bool {
+		if c.waiters[i].at.Equal(c.waiters[j].at) {
+			return c.waiters[i].order < c.waiters[j].order
+		}
+		return c.waiters[i].at.Before(c.waiters[j].at)
+	})
+	return c.waiters[0]
+}
+
+// Advance moves the clock d forward, firing every timer and ticker on the way in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	c.lock.Unlock()
+	for {
+		c.lock.Lock()
+		timer := c.next()
+		if timer == nil || timer.at.After(end) {
+			c.now = end
+			c.lock.Unlock()
+			return
+		}
+		c.now = timer.at
+		now := c.now
+		if timer.period > 0 {
+			timer.at = timer.at.Add(timer.period)
+		} else {
+			c.remove(timer)
+		}
+		c.lock.Unlock()
+		timer.fire(now)
+	}
+}
+
+// Run calls f on its own goroutine, and keeps moving the clock to its next
+// timer until f is done, e.g. to run a pinger from start to end.
+func (c *FakeClock) Run(f func()) {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		f()
+	}()
+	for {
+		// give f a moment (in real time) to set its timers
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * fakeClockSettle):
+		}
+		if next, ok := c.Next(); ok {
+			c.Advance(next.Sub(c.Now()))
+		}
+	}
+}
+
+// remove stops a timer from waiting, the lock has to be held.
+func (c *FakeClock) remove(timer *fakeTimer) bool {
+	if !timer.waiting {
+		return false
+	}
+	timer.waiting = false
+	for i, waiter := range c.waiters {
+		if waiter == timer {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// fakeTimer is a timer, ticker or AfterFunc of a FakeClock.
+type fakeTimer struct {
+	clock   *FakeClock
+	at      time.Time
+	order   int
+	period  time.Duration
+	c       chan time.Time
+	f       func()
+	waiting bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	wasWaiting := t.waiting
+	t.clock.schedule(t, d)
+	return wasWaiting
+}
+
+// fakeTicker is a fakeTimer that fires every period.
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// fire runs an AfterFunc, or sends the time like a time.Timer does (dropping
+// it if the last one wasn't received yet). Then it waits a bit for whoever is
+// waiting on it to be done reacting.
+func (t *fakeTimer) fire(now time.Time) {
+	if t.f != nil {
+		t.f()
+		time.Sleep(fakeClockSettle)
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+	for waited := time.Duration(0); len(t.c) > 0 && waited < 10*fakeClockSettle; waited += fakeClockSettle / 10 {
+		time.Sleep(fakeClockSettle / 10)
+	}
+	time.Sleep(fakeClockSettle)
+}
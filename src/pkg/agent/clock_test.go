@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Tests for the fake clock, and for pinging on one
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	var fired []time.Duration
+	record := func(at time.Time) {
+		fired = append(fired, at.Sub(start))
+	}
+	ticker := clock.NewTicker(2 * time.Second)
+	timer := clock.NewTimer(3 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+	reset := clock.NewTimer(time.Second)
+	clock.AfterFunc(5*time.Second, func() {
+		record(clock.Now())
+	})
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("expected only the first Stop to stop the timer")
+	}
+	reset.Reset(4 * time.Second)
+	if next, ok := clock.Next(); !ok || next.Sub(start) != 2*time.Second {
+		t.Errorf("expected the ticker to be next at 2s got %v %v", next.Sub(start), ok)
+	}
+	for i := 0; i < 6; i++ {
+		clock.Advance(time.Second)
+		for _, timer := range []Timer{timer, reset} {
+			select {
+			case at := <-timer.C():
+				record(at)
+			default:
+			}
+		}
+		select {
+		case at := <-ticker.C():
+			record(at)
+		case <-stopped.C():
+			t.Errorf("a stopped timer fired")
+		default:
+		}
+	}
+	ticker.Stop()
+	// the ticker and the reset timer both fire at 4s
+	expected := []time.Duration{2 * time.Second, 3 * time.Second, 4 * time.Second, 4 * time.Second, 5 * time.Second, 6 * time.Second}
+	if len(fired) != len(expected) {
+		t.Fatalf("expected timers at %v got %v", expected, fired)
+	}
+	for i := range fired {
+		if fired[i] != expected[i] {
+			t.Errorf("expected timers at %v got %v", expected, fired)
+			break
+		}
+	}
+	if clock.Now().Sub(start) != 6*time.Second {
+		t.Errorf("expected the clock at 6s got %v", clock.Now().Sub(start))
+	}
+	if _, ok := clock.Next(); ok {
+		t.Errorf("expected no timers left")
+	}
+}
+
+func TestPingerAgent_Run_FakeClock(t *testing.T) {
+	tests := []struct {
+		desc             string
+		inCount          int
+		inTimeout        time.Duration
+		inProbeTimeout   time.Duration
+		inLoss           float64
+		expectedSent     int
+		expectedReceived int
+		expectedTimedOut []time.Duration
+		// when Run is done, from the start
+		expectedElapsed time.Duration
+	}{
+		{
+			desc:             "count-reached",
+			inCount:          3,
+			expectedSent:     3,
+			expectedReceived: 3,
+			// the third reply, sent at 2s, is the last one we wait for
+			expectedElapsed: 2*time.Second + 20*time.Millisecond,
+		},
+		{
+			desc:             "timeout-first",
+			inCount:          100,
+			inTimeout:        2500 * time.Millisecond,
+			expectedSent:     3,
+			expectedReceived: 3,
+			expectedElapsed:  2500 * time.Millisecond,
+		},
+		{
+			desc:             "no-count",
+			inTimeout:        2500 * time.Millisecond,
+			expectedSent:     3,
+			expectedReceived: 3,
+			expectedElapsed:  2500 * time.Millisecond,
+		},
+		{
+			desc:             "all-lost",
+			inCount:          2,
+			inProbeTimeout:   1500 * time.Millisecond,
+			inLoss:           1,
+			expectedSent:     2,
+			expectedTimedOut: []time.Duration{1500 * time.Millisecond, 2500 * time.Millisecond},
+			// one deadline (3s) after the last echo request
+			expectedElapsed: 4 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			start := time.Unix(1000, 0)
+			clock := NewFakeClock(start)
+			network := NewSimulatedNetwork(1)
+			network.Clock = clock
+			network.Latency = 20 * time.Millisecond
+			network.Loss = tt.inLoss
+			settings := DefaultOptions()
+			settings.Destination = "192.0.2.1"
+			settings.Count = tt.inCount
+			settings.Timeout = tt.inTimeout
+			settings.Deadline = 3 * time.Second
+			settings.ProbeTimeout = tt.inProbeTimeout
+			options, err := BuildOptions(settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pinger := BuildPinger(options)
+			pinger.Listen = network.Listen
+			pinger.Clock = clock
+			var sentAt, timedOut []time.Duration
+			pinger.OnEchoSent = func(sequence int, destination string) {
+				sentAt = append(sentAt, clock.Now().Sub(start))
+			}
+			pinger.OnEchoComplete = func(p *PingPacket, exceededTTL bool) {
+				if p.RoundTripTime != network.Latency {
+					t.Errorf("%s: expected a %v round trip got %v", tt.desc, network.Latency, p.RoundTripTime)
+				}
+			}
+			pinger.OnEchoTimeout = func(sequence int, destination string) {
+				timedOut = append(timedOut, clock.Now().Sub(start))
+			}
+			var stats *CompletedPingStatistics
+			clock.Run(func() {
+				stats, err = pinger.Run(context.Background())
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// one echo request every second on the second
+			for i, at := range sentAt {
+				if at != time.Duration(i)*time.Second {
+					t.Errorf("%s: expected an echo request every second got %v", tt.desc, sentAt)
+					break
+				}
+			}
+			if len(sentAt) != tt.expectedSent || stats.PacketsReceived != tt.expectedReceived {
+				t.Errorf("%s: expected %d sent and %d received got %v and %+v", tt.desc, tt.expectedSent, tt.expectedReceived, sentAt, stats)
+			}
+			if len(timedOut) != len(tt.expectedTimedOut) {
+				t.Fatalf("%s: expected timeouts at %v got %v", tt.desc, tt.expectedTimedOut, timedOut)
+			}
+			for i := range timedOut {
+				if timedOut[i] != tt.expectedTimedOut[i] {
+					t.Errorf("%s: expected timeouts at %v got %v", tt.desc, tt.expectedTimedOut, timedOut)
+					break
+				}
+			}
+			if elapsed := clock.Now().Sub(start); elapsed != tt.expectedElapsed {
+				t.Errorf("%s: expected to be done after %v got %v", tt.desc, tt.expectedElapsed, elapsed)
+			}
+		})
+	}
+}
+
+// countingClock counts the timers a pinger sets on its clock, and cancels
+// the pinger once it set more than limit.
+type countingClock struct {
+	Clock
+	limit  int
+	cancel context.CancelFunc
+	timers int
+}
+
+func (c *countingClock) set() {
+	c.timers++
+	if c.timers > c.limit {
+		c.cancel()
+	}
+}
+
+func (c *countingClock) NewTimer(d time.Duration) Timer {
+	c.set()
+	return countingTimer{c.Clock.NewTimer(d), c}
+}
+
+type countingTimer struct {
+	Timer
+	clock *countingClock
+}
+
+func (t countingTimer) Reset(d time.Duration) bool {
+	t.clock.set()
+	return t.Timer.Reset(d)
+}
+
+func TestMultiPingerAgent_Run_FakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	network := NewSimulatedNetwork(1)
+	network.Clock = clock
+	network.Latency = time.Millisecond
+	var targets []*PresentOptions
+	for _, destination := range []struct {
+		address string
+		count   int
+	}{{"192.0.2.1", 1}, {"192.0.2.2", 30}} {
+		settings := DefaultOptions()
+		settings.Destination = destination.address
+		settings.Count = destination.count
+		settings.Interval = 10 * time.Millisecond
+		// the first destination is done well before the second one
+		settings.Deadline = 100 * time.Millisecond
+		options, err := BuildOptions(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, options)
+	}
+	pinger, err := BuildMultiPingerFromOptions(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinger.Listen = network.Listen
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// a wakeup for each echo request of the second destination, and one
+	// for its deadline after the last
+	counting := &countingClock{Clock: clock, limit: 31, cancel: cancel}
+	pinger.Clock = counting
+	var stats []*CompletedPingStatistics
+	clock.Run(func() {
+		stats, err = pinger.Run(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counting.timers > counting.limit {
+		t.Fatalf("expected at most %d wakeups got more", counting.limit)
+	}
+	for i, target := range stats {
+		if target.PacketsReceived != targets[i].count {
+			t.Errorf("expected %d replies from %s got %+v", targets[i].count, target.Destination, target)
+		}
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 291*time.Millisecond {
+		t.Errorf("expected to be done with the last reply got %v", elapsed)
+	}
+}
@@ -0,0 +1,542 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A config file describes many targets in a restricted key = value format.
+// It looks like TOML but isn't: one key per line, values are strings,
+// integers, booleans or one line { } tables of them, and there are no
+// arrays, dotted keys, floats or dates.
+//
+//	# every target starts out with these
+//	[defaults]
+//	interval = "1s"
+//	count = 10
+//	labels = { team = "netops" }
+//
+//	# targets in a group get its settings over the defaults
+//	[groups.edge]
+//	interval = "500ms"
+//	probe_timeout = "2s"
+//
+//	# and their own settings over both
+//	[[targets]]
+//	address = "1.1.1.1"
+//	name = "cloudflare"
+//	group = "edge"
+//	ttl = 64
+//	labels = { role = "dns" }
+//
+// Durations are strings like "1s", labels are merged rather than replaced.
+// What isn't set is DefaultOptions, and every target's settings go through
+// BuildOptions like the command line flags do.
+
+// Config is every target of a config file, with its settings resolved.
+type Config struct {
+	Targets []*TargetConfig
+}
+
+// TargetConfig is one [[targets]] entry of a config file.
+type TargetConfig struct {
+	// a hostname or an IP address, Options only has the address set when it is an IP
+	Address string
+	// what the target is called in reports, the address unless it is set
+	Name   string
+	Group  string
+	Labels map[string]string
+	// the defaults, then the group, then the target's own settings
+	Options PresentOptions
+	// where its [[targets]] header is
+	Line int
+}
+
+// ConfigError is one problem with a config file, and the line it is on.
+type ConfigError struct {
+	Line    int
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ConfigErrors is every problem with a config file, so they can all be fixed at once.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// configValue is a parsed value, with the line it was on.
+type configValue struct {
+	line    int
+	text    string
+	integer int64
+	boolean bool
+	table   map[string]*configValue
+	kind    string
+}
+
+// What a configValue can be.
+const (
+	configString  = "string"
+	configInteger = "integer"
+	configBoolean = "boolean"
+	configTable   = "table"
+)
+
+// configSection is a [table] or [[array]] entry, in the order they came.
+type configSection struct {
+	name   string
+	array  bool
+	line   int
+	values map[string]*configValue
+}
+
+// configSetting sets a key's value on Options, BuildOptions checks it.
+type configSetting struct {
+	kind  string
+	apply func(options *Options, value *configValue) error
+}
+
+// configSettings are the keys that map onto Options, they are allowed in the
+// defaults, in a group and in a target.
+var configSettings = map[string]configSetting{
+	"count": {configInteger, func(options *Options, value *configValue) error {
+		options.Count = int(value.integer)
+		return nil
+	}},
+	"interval": {configString, func(options *Options, value *configValue) error {
+		return parseConfigDuration(value.text, &options.Interval)
+	}},
+	"timeout": {configString, func(options *Options, value *configValue) error {
+		return parseConfigDuration(value.text, &options.Timeout)
+	}},
+	"deadline": {configString, func(options *Options, value *configValue) error {
+		return parseConfigDuration(value.text, &options.Deadline)
+	}},
+	"probe_timeout": {configString, func(options *Options, value *configValue) error {
+		return parseConfigDuration(value.text, &options.ProbeTimeout)
+	}},
+	"size": {configInteger, func(options *Options, value *configValue) error {
+		options.Size = int(value.integer)
+		return nil
+	}},
+	"ttl": {configInteger, func(options *Options, value *configValue) error {
+		options.TTL = int(value.integer)
+		return nil
+	}},
+	"max_ttl": {configInteger, func(options *Options, value *configValue) error {
+		options.MaxTTL = int(value.integer)
+		return nil
+	}},
+	"pad": {configString, func(options *Options, value *configValue) error {
+		options.Pad = value.text
+		return nil
+	}},
+	"pattern": {configString, func(options *Options, value *configValue) error {
+		options.Pattern = value.text
+		return nil
+	}},
+	"privileged": {configBoolean, func(options *Options, value *configValue) error {
+		options.Privileged = value.boolean
+		return nil
+	}},
+}
+
+// LoadConfig reads the config file at path, see ParseConfig.
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseConfig(file)
+}
+
+// ParseConfig reads a config file, giving back every problem with it as ConfigErrors.
+func ParseConfig(reader io.Reader) (*Config, error) {
+	sections, errs := parseConfigSections(reader)
+	config := &Config{}
+	var defaults *configSection
+	groups := make(map[string]*configSection)
+	var targets []*configSection
+	// sections with a problem, their targets' options aren't checked as a whole
+	invalid := make(map[*configSection]bool)
+	check := func(section *configSection, extraKeys []string) {
+		sectionErrs := checkConfigSection(section, extraKeys)
+		invalid[section] = len(sectionErrs) > 0
+		errs = append(errs, sectionErrs...)
+	}
+	for _, section := range sections {
+		switch {
+		case section.name == "defaults" && !section.array:
+			if defaults != nil {
+				errs = append(errs, &ConfigError{section.line, fmt.Sprintf("[defaults] is already on line %d", defaults.line)})
+				continue
+			}
+			defaults = section
+			check(section, nil)
+		case strings.HasPrefix(section.name, "groups.") && !section.array:
+			group := strings.TrimPrefix(section.name, "groups.")
+			if other, ok := groups[group]; ok {
+				errs = append(errs, &ConfigError{section.line, fmt.Sprintf("[%s] is already on line %d", section.name, other.line)})
+				continue
+			}
+			groups[group] = section
+			check(section, nil)
+		case section.name == "targets" && section.array:
+			targets = append(targets, section)
+			check(section, []string{"address", "name", "group"})
+		default:
+			name := "[" + section.name + "]"
+			if section.array {
+				name = "[" + name + "]"
+			}
+			errs = append(errs, &ConfigError{section.line, fmt.Sprintf("unknown section %s, it can be [defaults], [groups.<name>] or [[targets]]", name)})
+		}
+	}
+	for _, section := range targets {
+		target := &TargetConfig{Labels: make(map[string]string), Line: section.line}
+		settings := DefaultOptions()
+		layers := []*configSection{defaults}
+		if group, ok := section.values["group"]; ok && group.kind == configString {
+			target.Group = group.text
+			if _, ok := groups[group.text]; !ok {
+				errs = append(errs, &ConfigError{group.line, fmt.Sprintf("group %s has no [groups.%s]", group.text, group.text)})
+			}
+			layers = append(layers, groups[group.text])
+		}
+		layers = append(layers, section)
+		valid := true
+		for _, layer := range layers {
+			if layer != nil {
+				// problems were already reported when the section was checked
+				applyConfigSection(layer, &settings, target.Labels)
+				valid = valid && !invalid[layer]
+			}
+		}
+		if address, ok := section.values["address"]; ok && address.kind == configString && address.text != "" {
+			target.Address = address.text
+			if net.ParseIP(address.text) != nil {
+				settings.Destination = address.text
+			}
+		} else {
+			errs = append(errs, &ConfigError{section.line, "a target needs an address"})
+		}
+		// every key was checked on its own, this is how they go together
+		if options, err := BuildOptions(settings); err == nil {
+			target.Options = *options
+		} else if valid {
+			errs = append(errs, &ConfigError{section.line, err.Error()})
+		}
+		target.Name = target.Address
+		if name, ok := section.values["name"]; ok && name.kind == configString {
+			target.Name = name.text
+		}
+		config.Targets = append(config.Targets, target)
+	}
+	if len(config.Targets) == 0 && len(errs) == 0 {
+		errs = append(errs, &ConfigError{1, "there are no [[targets]]"})
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Line < errs[j].Line
+		})
+		return nil, errs
+	}
+	return config, nil
+}
+
+// checkConfigSection reports every key of a section that is unknown, of the
+// wrong type or has a value its option doesn't take.
+func checkConfigSection(section *configSection, extraKeys []string) ConfigErrors {
+	var errs ConfigErrors
+	keys := make([]string, 0, len(section.values))
+	for key := range section.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := section.values[key]
+		if key == "labels" {
+			if value.kind != configTable {
+				errs = append(errs, &ConfigError{value.line, "labels needs to be a table like { site = \"ams\" }"})
+				continue
+			}
+			for label, labelValue := range value.table {
+				if labelValue.kind != configString {
+					errs = append(errs, &ConfigError{labelValue.line, fmt.Sprintf("label %s needs to be a string", label)})
+				}
+			}
+			continue
+		}
+		if contains(extraKeys, key) {
+			if value.kind != configString {
+				errs = append(errs, &ConfigError{value.line, fmt.Sprintf("%s needs to be a string", key)})
+			}
+			continue
+		}
+		setting, ok := configSettings[key]
+		if !ok {
+			errs = append(errs, &ConfigError{value.line, fmt.Sprintf("unknown key %s in [%s]", key, section.name)})
+			continue
+		}
+		if value.kind != setting.kind {
+			errs = append(errs, &ConfigError{value.line, fmt.Sprintf("%s needs to be %s, not %s", key, withArticle(setting.kind), withArticle(value.kind))})
+			continue
+		}
+		// the defaults are valid, so whatever BuildOptions finds is about this key
+		scratch := DefaultOptions()
+		err := setting.apply(&scratch, value)
+		if err == nil {
+			_, err = BuildOptions(scratch)
+		}
+		if optionErrs, ok := err.(OptionErrors); ok {
+			// they already say which setting it is
+			for _, optionErr := range optionErrs {
+				errs = append(errs, &ConfigError{value.line, strings.TrimSpace(optionErr.Err.Error())})
+			}
+		} else if err != nil {
+			errs = append(errs, &ConfigError{value.line, fmt.Sprintf("%s: %s", key, strings.TrimSpace(err.Error()))})
+		}
+	}
+	return errs
+}
+
+// applyConfigSection applies every setting and label of a section that is of the right type.
+func applyConfigSection(section *configSection, options *Options, labels map[string]string) {
+	for key, value := range section.values {
+		if key == "labels" && value.kind == configTable {
+			for label, labelValue := range value.table {
+				labels[label] = labelValue.text
+			}
+			continue
+		}
+		if setting, ok := configSettings[key]; ok && value.kind == setting.kind {
+			_ = setting.apply(options, value)
+		}
+	}
+}
+
+// parseConfigSections splits a config file into its sections, keys outside
+// of any section are an error.
+func parseConfigSections(reader io.Reader) ([]*configSection, ConfigErrors) {
+	var sections []*configSection
+	var errs ConfigErrors
+	var current *configSection
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			array := strings.HasPrefix(line, "[[")
+			name := strings.TrimPrefix(line, "[")
+			closing := "]"
+			if array {
+				name = strings.TrimPrefix(name, "[")
+				closing = "]]"
+			}
+			if !strings.HasSuffix(name, closing) {
+				errs = append(errs, &ConfigError{number, fmt.Sprintf("section header %s is missing its %s", line, closing)})
+				current = nil
+				continue
+			}
+			current = &configSection{
+				name:   strings.TrimSpace(strings.TrimSuffix(name, closing)),
+				array:  array,
+				line:   number,
+				values: make(map[string]*configValue),
+			}
+			sections = append(sections, current)
+			continue
+		}
+		key, value, err := parseConfigKeyValue(line, number)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if current == nil {
+			errs = append(errs, &ConfigError{number, fmt.Sprintf("%s is outside of any section", key)})
+			continue
+		}
+		if other, ok := current.values[key]; ok {
+			errs = append(errs, &ConfigError{number, fmt.Sprintf("%s is already set on line %d", key, other.line)})
+			continue
+		}
+		current.values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, &ConfigError{0, err.Error()})
+	}
+	return sections, errs
+}
+
+// parseConfigKeyValue parses a key = value line.
+func parseConfigKeyValue(line string, number int) (string, *configValue, *ConfigError) {
+	equals := strings.Index(line, "=")
+	if equals < 0 {
+		return "", nil, &ConfigError{number, fmt.Sprintf("expected key = value, got %s", line)}
+	}
+	key := strings.TrimSpace(line[:equals])
+	if !isBareKey(key) {
+		return "", nil, &ConfigError{number, fmt.Sprintf("%q is not a valid key", key)}
+	}
+	value, rest, err := parseConfigValue(strings.TrimSpace(line[equals+1:]), number)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return "", nil, &ConfigError{number, fmt.Sprintf("unexpected %s after the value of %s", strings.TrimSpace(rest), key)}
+	}
+	return key, value, nil
+}
+
+// parseConfigValue parses the value at the start of text, giving back what is after it.
+func parseConfigValue(text string, number int) (*configValue, string, *ConfigError) {
+	switch {
+	case text == "":
+		return nil, "", &ConfigError{number, "missing value"}
+	case text[0] == '"' || text[0] == '\'':
+		end := closingQuote(text)
+		if end < 0 {
+			return nil, "", &ConfigError{number, fmt.Sprintf("unterminated string %s", text)}
+		}
+		literal := text[:end+1]
+		if text[0] == '\'' {
+			// literal strings have no escapes
+			return &configValue{line: number, kind: configString, text: literal[1:end]}, text[end+1:], nil
+		}
+		unquoted, err := strconv.Unquote(literal)
+		if err != nil {
+			return nil, "", &ConfigError{number, fmt.Sprintf("invalid string %s", literal)}
+		}
+		return &configValue{line: number, kind: configString, text: unquoted}, text[end+1:], nil
+	case text[0] == '{':
+		value := &configValue{line: number, kind: configTable, table: make(map[string]*configValue)}
+		rest := strings.TrimSpace(text[1:])
+		for !strings.HasPrefix(rest, "}") {
+			equals := strings.Index(rest, "=")
+			if equals < 0 {
+				return nil, "", &ConfigError{number, "expected key = value inside { }"}
+			}
+			key := strings.TrimSpace(rest[:equals])
+			if !isBareKey(key) {
+				return nil, "", &ConfigError{number, fmt.Sprintf("%q is not a valid key", key)}
+			}
+			entry, after, err := parseConfigValue(strings.TrimSpace(rest[equals+1:]), number)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, ok := value.table[key]; ok {
+				return nil, "", &ConfigError{number, fmt.Sprintf("%s is set twice", key)}
+			}
+			value.table[key] = entry
+			rest = strings.TrimSpace(after)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "}") {
+				return nil, "", &ConfigError{number, "expected , or } inside { }"}
+			}
+		}
+		return value, rest[1:], nil
+	}
+	end := strings.IndexAny(text, ",} \t")
+	if end < 0 {
+		end = len(text)
+	}
+	word := text[:end]
+	switch word {
+	case "true", "false":
+		return &configValue{line: number, kind: configBoolean, boolean: word == "true"}, text[end:], nil
+	}
+	integer, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, "", &ConfigError{number, fmt.Sprintf("%s is not a string, an integer, a boolean or a table (strings need quotes)", word)}
+	}
+	return &configValue{line: number, kind: configInteger, integer: integer}, text[end:], nil
+}
+
+// closingQuote is the index of the quote that ends the string text starts with, or -1.
+func closingQuote(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch {
+		case text[0] == '"' && text[i] == '\\':
+			i++
+		case text[i] == text[0]:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment cuts a # comment off a line, unless the # is inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote == 0 && line[i] == '#':
+			return line[:i]
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == '"' && line[i] == '\\':
+			i++
+		case line[i] == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+// isBareKey is true for keys made of letters, digits, _ and -.
+func isBareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseConfigDuration(text string, duration *time.Duration) error {
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*duration = parsed
+	return nil
+}
+
+func withArticle(kind string) string {
+	if kind == configInteger {
+		return "an " + kind
+	}
+	return "a " + kind
+}
+
+func contains(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
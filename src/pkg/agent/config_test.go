@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests for the config file
+
+const exampleConfig = `
+# every target starts out with these
+[defaults]
+interval = "2s"
+count = 10
+labels = { team = "netops", env = "prod" }
+
+[groups.edge]
+interval = "500ms"
+probe_timeout = "2s" # trailing comments are fine
+labels = { env = "edge" }
+
+[[targets]]
+address = "1.1.1.1"
+name = "cloudflare"
+group = "edge"
+ttl = 64
+pad = "ff"
+
+[[targets]]
+address = "example.com"
+size = 1_000
+labels = { role = 'web #1' }
+`
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(exampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Targets) != 2 {
+		t.Fatalf("expected 2 targets got %d", len(config.Targets))
+	}
+	edge, web := config.Targets[0], config.Targets[1]
+	if edge.Name != "cloudflare" || edge.Group != "edge" || edge.Line != 13 || edge.Options.ipAddress != "1.1.1.1" || !edge.Options.isIpv4 {
+		t.Errorf("unexpected edge target %+v", edge)
+	}
+	// the group wins over the defaults, the target over both
+	if edge.Options.interval != 500*time.Millisecond || edge.Options.count != 10 || edge.Options.probeTimeout != 2*time.Second ||
+		edge.Options.timeToLive != 64 || len(edge.Options.padBytes) != 1 || edge.Options.payloadSize != 56 {
+		t.Errorf("unexpected edge options %+v", edge.Options)
+	}
+	if edge.Labels["team"] != "netops" || edge.Labels["env"] != "edge" || len(edge.Labels) != 2 {
+		t.Errorf("unexpected edge labels %v", edge.Labels)
+	}
+	// hostnames are left for the caller to resolve
+	if web.Name != "example.com" || web.Options.ipAddress != "" || web.Options.interval != 2*time.Second ||
+		web.Options.payloadSize != 1000 || web.Options.probeTimeout != 10*time.Second {
+		t.Errorf("unexpected web target %+v", web)
+	}
+	if web.Labels["role"] != "web #1" || web.Labels["env"] != "prod" {
+		t.Errorf("unexpected web labels %v", web.Labels)
+	}
+}
+
+func TestParseConfig_Errors(t *testing.T) {
+	tests := []struct {
+		desc          string
+		inConfig      string
+		expectedLines []int
+		expectedText  string
+	}{
+		{
+			desc:          "no-targets",
+			inConfig:      "[defaults]\ncount = 3\n",
+			expectedLines: []int{1},
+			expectedText:  "no [[targets]]",
+		},
+		{
+			desc:          "bad-values",
+			inConfig:      "[defaults]\ninterval = \"0s\"\ncount = -1\nttl = 300\n\n[[targets]]\naddress = \"::1\"\nsize = \"big\"\n",
+			expectedLines: []int{2, 3, 4, 8},
+			expectedText:  "size needs to be an integer, not a string",
+		},
+		{
+			desc:          "unknown-keys-and-sections",
+			inConfig:      "[target]\naddress = \"::1\"\n[[targets]]\nadress = \"::1\"\n",
+			expectedLines: []int{1, 3, 4},
+			expectedText:  "unknown key adress in [targets]",
+		},
+		{
+			desc:          "unknown-group",
+			inConfig:      "[[targets]]\naddress = \"::1\"\ngroup = \"core\"\n",
+			expectedLines: []int{3},
+			expectedText:  "group core has no [groups.core]",
+		},
+		{
+			desc:          "syntax",
+			inConfig:      "count = 1\n[[targets]\naddress = \"::1\naddress\n[[targets]]\naddress = \"::1\"\naddress = \"::2\"\nlabels = { a = 1 }\n",
+			expectedLines: []int{1, 2, 3, 4, 7, 8},
+			expectedText:  "address is already set on line 6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			config, err := ParseConfig(strings.NewReader(tt.inConfig))
+			errs, ok := err.(ConfigErrors)
+			if config != nil || !ok {
+				t.Fatalf("%s: expected ConfigErrors got %v", tt.desc, err)
+			}
+			var lines []int
+			for _, e := range errs {
+				lines = append(lines, e.Line)
+			}
+			if len(lines) != len(tt.expectedLines) {
+				t.Fatalf("%s: expected errors on lines %v got %v", tt.desc, tt.expectedLines, err)
+			}
+			for i := range lines {
+				if lines[i] != tt.expectedLines[i] {
+					t.Errorf("%s: expected errors on lines %v got %v", tt.desc, tt.expectedLines, err)
+				}
+			}
+			if !strings.Contains(err.Error(), tt.expectedText) {
+				t.Errorf("%s: expected %q in %v", tt.desc, tt.expectedText, err)
+			}
+		})
+	}
+}
+
+func TestParseConfig_SameAsBuildOptions(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader("[[targets]]\naddress = \"192.0.2.1\"\ncount = 0\ntimeout = \"0s\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what isn't set is DefaultOptions, and 0 is as fine as it is for the flags
+	settings := DefaultOptions()
+	settings.Destination = "192.0.2.1"
+	settings.Count = 0
+	settings.Timeout = 0
+	expected, err := BuildOptions(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Targets[0].Options, *expected) {
+		t.Errorf("expected %+v got %+v", *expected, config.Targets[0].Options)
+	}
+}
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"syscall"
+
+	"golang.org/x/net/icmp"
+)
+
+// setDontFragment sets the Don't Fragment bit on everything an ICMP socket
+// sends (ipv6 packets are never fragmented on the way anyway) and keeps the
+// kernel from fragmenting them itself. Sends bigger than the path MTU the
+// kernel learned still go out, finding it out is what they are for.
+func setDontFragment(connection *icmp.PacketConn, isIpv4 bool) error {
+	raw, err := socketRawConn(connection, isIpv4)
+	if err != nil {
+		return err
+	}
+	level, option := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER
+	if !isIpv4 {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER
+	}
+	var optionErr error
+	err = raw.Control(func(fd uintptr) {
+		// IPV6_PMTUDISC_PROBE is the same value
+		optionErr = syscall.SetsockoptInt(int(fd), level, option, syscall.IP_PMTUDISC_PROBE)
+	})
+	if err != nil {
+		return err
+	}
+	return optionErr
+}
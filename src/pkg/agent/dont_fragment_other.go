@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+
+	"golang.org/x/net/icmp"
+)
+
+// setDontFragment needs Linux's IP_MTU_DISCOVER.
+func setDontFragment(connection *icmp.PacketConn, isIpv4 bool) error {
+	return errors.New("setting Don't Fragment is only supported on Linux")
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ResolutionError is a destination that couldn't be resolved to an address.
+type ResolutionError struct {
+	Destination string
+	Err         error
+}
+
+func (e *ResolutionError) Error() string {
+	return fmt.Sprintf("could not resolve %s: %s", e.Destination, e.Err.Error())
+}
+
+func (e *ResolutionError) Unwrap() error {
+	return e.Err
+}
+
+// PermissionError is an ICMP socket we weren't allowed to open: raw sockets
+// need root (or CAP_NET_RAW), datagram ones a group inside net.ipv4.ping_group_range.
+type PermissionError struct {
+	Network string
+	Err     error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("not allowed to open an ICMP socket (%s): %s", e.Network, e.Err.Error())
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// SendError is an echo request that couldn't be sent.
+type SendError struct {
+	Destination string
+	// the 16 bit icmp_seq it would have had
+	Sequence int
+	Err      error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("could not send icmp_seq=%d to %s: %s", e.Sequence, e.Destination, e.Err.Error())
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// listenError wraps what opening a socket gave back, as a PermissionError when that's what it was.
+func listenError(network string, err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return &PermissionError{Network: network, Err: err}
+	}
+	return fmt.Errorf("could not open an ICMP socket (%s): %w", network, err)
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// Tests for the errors the agent gives back
+
+func TestListenError(t *testing.T) {
+	tests := []struct {
+		desc               string
+		inErr              error
+		expectedPermission bool
+	}{
+		{
+			desc:               "eperm",
+			inErr:              os.NewSyscallError("socket", syscall.EPERM),
+			expectedPermission: true,
+		},
+		{
+			desc:               "eacces",
+			inErr:              os.NewSyscallError("socket", syscall.EACCES),
+			expectedPermission: true,
+		},
+		{
+			desc:               "no-protocol",
+			inErr:              os.NewSyscallError("socket", syscall.EPROTONOSUPPORT),
+			expectedPermission: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := listenError("ip4:icmp", tt.inErr)
+			var permission *PermissionError
+			if errors.As(err, &permission) != tt.expectedPermission {
+				t.Errorf("%s: expected a PermissionError %v got %v", tt.desc, tt.expectedPermission, err)
+			}
+			// the syscall error is still there to check for
+			if !errors.Is(err, tt.inErr.(*os.SyscallError).Err) {
+				t.Errorf("%s: expected %v to wrap %v", tt.desc, err, tt.inErr)
+			}
+		})
+	}
+}
+
+func TestSendError(t *testing.T) {
+	err := error(&SendError{Destination: "192.0.2.1", Sequence: 7, Err: syscall.ENETUNREACH})
+	if err.Error() != "could not send icmp_seq=7 to 192.0.2.1: network is unreachable" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+	if !errors.Is(err, syscall.ENETUNREACH) {
+		t.Errorf("expected %v to wrap ENETUNREACH", err)
+	}
+}
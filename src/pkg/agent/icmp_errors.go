@@ -0,0 +1,285 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ICMPErrorType is the kind of ICMP error a router (or the destination) sent
+// back about one of our echo requests.
+type ICMPErrorType string
+
+const (
+	ICMPDestinationUnreachable ICMPErrorType = "destination-unreachable"
+	ICMPTimeExceeded           ICMPErrorType = "time-exceeded"
+	ICMPRedirect               ICMPErrorType = "redirect"
+	ICMPParameterProblem       ICMPErrorType = "parameter-problem"
+	// ipv6 only, ipv4 says it with a Destination Unreachable
+	ICMPPacketTooBig ICMPErrorType = "packet-too-big"
+)
+
+// ICMPErrorPacket is an ICMP error about one of our echo requests, which
+// doesn't count as a reply: the echo request is still lost.
+type ICMPErrorPacket struct {
+	Type ICMPErrorType
+	Code int
+	// who sent it
+	Router             string
+	Destination        string
+	ICMPSequenceNumber int
+	// what iputils prints for it, e.g. "Destination Host Unreachable"
+	Description string
+}
+
+// icmpErrorType is the kind of ICMP error a message type is, false for
+// anything else (echo replies, and messages nobody sends about our echoes).
+func icmpErrorType(messageType icmp.Type) (ICMPErrorType, bool) {
+	switch messageType {
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+		return ICMPDestinationUnreachable, true
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		return ICMPTimeExceeded, true
+	case ipv4.ICMPTypeRedirect, ipv6.ICMPTypeRedirect:
+		return ICMPRedirect, true
+	case ipv4.ICMPTypeParameterProblem, ipv6.ICMPTypeParameterProblem:
+		return ICMPParameterProblem, true
+	case ipv6.ICMPTypePacketTooBig:
+		return ICMPPacketTooBig, true
+	}
+	return "", false
+}
+
+// icmpErrorQuote is the packet an ICMP error (the whole message, header
+// included) quotes: after its 8 byte header, or for an ipv6 Redirect in its
+// Redirected Header option, which it doesn't always carry.
+func icmpErrorQuote(isIpv4 bool, kind ICMPErrorType, data []byte) ([]byte, bool) {
+	if isIpv4 || kind != ICMPRedirect {
+		if len(data) < 8 {
+			return nil, false
+		}
+		return data[8:], true
+	}
+	// RFC 4861: the header, the target and destination addresses, then options
+	if len(data) < 40 {
+		return nil, false
+	}
+	for options := data[40:]; len(options) >= 8; {
+		length := int(options[1]) * 8
+		if length == 0 || length > len(options) {
+			return nil, false
+		}
+		// type 4, the Redirected Header: 6 reserved bytes, then the packet
+		if options[0] == 4 {
+			return options[8:length], true
+		}
+		options = options[length:]
+	}
+	return nil, false
+}
+
+// icmpErrorDescription is what iputils prints for an ICMP error, from its
+// type, code and the type specific bytes of its header (a pointer, the next
+// hop MTU or the new gateway).
+func icmpErrorDescription(isIpv4 bool, kind ICMPErrorType, code int, data []byte) string {
+	var extra [4]byte
+	if len(data) >= 8 {
+		copy(extra[:], data[4:8])
+	}
+	if isIpv4 {
+		return icmpv4ErrorDescription(kind, code, extra)
+	}
+	return icmpv6ErrorDescription(kind, code, extra, data)
+}
+
+func icmpv4ErrorDescription(kind ICMPErrorType, code int, extra [4]byte) string {
+	switch kind {
+	case ICMPDestinationUnreachable:
+		descriptions := []string{"Destination Net Unreachable", "Destination Host Unreachable",
+			"Destination Protocol Unreachable", "Destination Port Unreachable", "", "Source Route Failed",
+			"Destination Net Unknown", "Destination Host Unknown", "Source Host Isolated",
+			"Destination Net Prohibited", "Destination Host Prohibited",
+			"Destination Net Unreachable for Type of Service", "Destination Host Unreachable for Type of Service",
+			"Packet filtered", "Precedence Violation", "Precedence Cutoff"}
+		if code == fragmentationNeeded {
+			return fmt.Sprintf("Frag needed and DF set (mtu = %d)", int(extra[2])<<8|int(extra[3]))
+		}
+		if code < len(descriptions) {
+			return descriptions[code]
+		}
+		return fmt.Sprintf("Dest Unreachable, Bad Code: %d", code)
+	case ICMPTimeExceeded:
+		switch code {
+		case 0:
+			return "Time to live exceeded"
+		case 1:
+			return "Frag reassembly time exceeded"
+		}
+		return fmt.Sprintf("Time exceeded, Bad Code: %d", code)
+	case ICMPRedirect:
+		descriptions := []string{"Redirect Network", "Redirect Host", "Redirect Type of Service and Network",
+			"Redirect Type of Service and Host"}
+		description := fmt.Sprintf("Redirect, Bad Code: %d", code)
+		if code < len(descriptions) {
+			description = descriptions[code]
+		}
+		return fmt.Sprintf("%s(New nexthop: %s)", description, net.IP(extra[:]))
+	case ICMPParameterProblem:
+		return fmt.Sprintf("Parameter problem: pointer = %d", extra[0])
+	}
+	return string(kind)
+}
+
+func icmpv6ErrorDescription(kind ICMPErrorType, code int, extra [4]byte, data []byte) string {
+	// the pointer of a Parameter Problem and the MTU of a Packet Too Big
+	value := int(extra[0])<<24 | int(extra[1])<<16 | int(extra[2])<<8 | int(extra[3])
+	switch kind {
+	case ICMPDestinationUnreachable:
+		descriptions := []string{"No route", "Administratively prohibited", "Beyond scope of source address",
+			"Address unreachable", "Port unreachable", "Source address failed ingress/egress policy",
+			"Reject route to destination"}
+		if code < len(descriptions) {
+			return "Destination unreachable: " + descriptions[code]
+		}
+		return fmt.Sprintf("Destination unreachable: Unknown code %d", code)
+	case ICMPPacketTooBig:
+		return fmt.Sprintf("Packet too big: mtu=%d", value)
+	case ICMPTimeExceeded:
+		switch code {
+		case 0:
+			return "Time exceeded: Hop limit"
+		case 1:
+			return "Time exceeded: Defragmentation failure"
+		}
+		return fmt.Sprintf("Time exceeded: code %d", code)
+	case ICMPParameterProblem:
+		descriptions := []string{"Wrong header field ", "Unknown header ", "Unknown option "}
+		description := fmt.Sprintf("code %d ", code)
+		if code < len(descriptions) {
+			description = descriptions[code]
+		}
+		return fmt.Sprintf("Parameter problem: %sat %d", description, value)
+	case ICMPRedirect:
+		if len(data) >= 24 {
+			return fmt.Sprintf("Redirect (New nexthop: %s)", net.IP(data[8:24]))
+		}
+		return "Redirect"
+	}
+	return string(kind)
+}
+
+// logICMPError reports an ICMP error if the echo request it quotes is ours,
+// counting it by its type.
+// Unprivileged (udp4/udp6) sockets get these off their error queue on Linux,
+// rebuilt into the message a raw socket would have received.
+func (p *PingerAgent) logICMPError(received *PingPacket, message *icmp.Message, kind ICMPErrorType) {
+	quoted, ok := icmpErrorQuote(p.options.isIpv4, kind, received.data)
+	if !ok {
+		return
+	}
+	echo, ok := quotedEcho(p.options.isIpv4, quoted)
+	if !ok || !p.ownsQuotedEcho(echo) {
+		return
+	}
+	switch kind {
+	case ICMPDestinationUnreachable:
+		p.numUnreachable++
+	case ICMPTimeExceeded:
+		p.numTimeExceeded++
+	case ICMPRedirect:
+		p.numRedirects++
+	case ICMPParameterProblem:
+		p.numParameterProblems++
+	case ICMPPacketTooBig:
+		p.numPacketTooBig++
+	}
+	errorHandler := p.OnICMPError
+	if errorHandler != nil {
+		errorHandler(&ICMPErrorPacket{
+			Type:               kind,
+			Code:               message.Code,
+			Router:             received.DestinationAddress,
+			Destination:        p.options.ipAddress,
+			ICMPSequenceNumber: echo.Seq,
+			Description:        icmpErrorDescription(p.options.isIpv4, kind, message.Code, received.data),
+		})
+	}
+}
+
+// quotedProbe finds the echo request of ours an ICMP error quotes in its
+// data, giving back its wire sequence and how long the error took to come back.
+func (p *PingerAgent) quotedProbe(received *PingPacket, data []byte) (int, time.Duration, bool) {
+	echo, ok := quotedEcho(p.options.isIpv4, data)
+	if !ok || !p.ownsQuotedEcho(echo) {
+		return 0, 0, false
+	}
+	probe := p.probes.lookup(echo.Seq)
+	if probe == nil {
+		return 0, 0, false
+	}
+	receivedAt := received.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = clockOrReal(p.Clock).Now()
+	}
+	return echo.Seq, receivedAt.Sub(probe.departedAt), true
+}
+
+// ownsQuotedEcho is true if an echo request quoted back to us in an ICMP
+// error is one we sent. Routers only have to quote 8 bytes of it, so the
+// tracker is only checked when it made it back.
+func (p *PingerAgent) ownsQuotedEcho(echo *icmp.Echo) bool {
+	if !p.unprivileged && echo.ID != p.packetId {
+		return false
+	}
+	if len(echo.Data) >= 16 && BytesToInt(echo.Data[8:16]) != p.packetTracker {
+		return false
+	}
+	return true
+}
+
+// quotedDestination is where the packet an ICMP error quotes was sent, from
+// its IP header.
+func quotedDestination(isIpv4 bool, data []byte) net.IP {
+	if isIpv4 {
+		if len(data) < 20 {
+			return nil
+		}
+		return net.IP(data[16:20])
+	}
+	if len(data) < 40 {
+		return nil
+	}
+	return net.IP(data[24:40])
+}
+
+// quotedEcho pulls our original echo request out of an ICMP error's data,
+// which is the IP header of the packet that caused it followed by (at least)
+// the first 8 bytes of its ICMP message.
+func quotedEcho(isIpv4 bool, data []byte) (*icmp.Echo, bool) {
+	var headerLength int
+	if isIpv4 {
+		if len(data) < 20 {
+			return nil, false
+		}
+		headerLength = int(data[0]&0x0f) * 4
+	} else {
+		// the fixed ipv6 header, echo requests don't carry extension headers
+		headerLength = 40
+	}
+	if len(data) < headerLength+8 {
+		return nil, false
+	}
+	message, err := icmp.ParseMessage(icmpProtocol(isIpv4), data[headerLength:])
+	if err != nil {
+		return nil, false
+	}
+	echo, ok := message.Body.(*icmp.Echo)
+	if !ok || message.Type != echoRequestType(isIpv4) {
+		return nil, false
+	}
+	return echo, true
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// linux/errqueue.h
+const (
+	errOriginICMP  = 2
+	errOriginICMP6 = 3
+)
+
+// enableICMPErrors has the kernel keep the ICMP errors about what a datagram
+// ICMP socket sent on its error queue. Without it they are thrown away, only
+// raw sockets get them like any other ICMP message.
+func enableICMPErrors(raw syscall.RawConn, isIpv4 bool) error {
+	level, option := syscall.IPPROTO_IP, syscall.IP_RECVERR
+	if !isIpv4 {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+	}
+	var optionErr error
+	err := raw.Control(func(fd uintptr) {
+		optionErr = syscall.SetsockoptInt(int(fd), level, option, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return optionErr
+}
+
+// queuedICMPError turns an ICMP error taken off the error queue back into the
+// ICMP message a raw socket would have received, and who sent it. The error
+// queue gives us its type, code and type specific value in the control
+// messages (a struct sock_extended_err followed by the offender's address),
+// the echo request it is about as the data and that echo request's
+// destination as the source. It is false for anything else on the queue,
+// like errors of our own (a send that was too big) or send timestamps.
+func queuedICMPError(isIpv4 bool, oob []byte, destination net.IP, payload []byte) ([]byte, net.IP, bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, nil, false
+	}
+	for _, message := range messages {
+		if !(message.Header.Level == syscall.SOL_IP && message.Header.Type == syscall.IP_RECVERR) &&
+			!(message.Header.Level == syscall.SOL_IPV6 && message.Header.Type == syscall.IPV6_RECVERR) {
+			continue
+		}
+		// errno, origin, type, code, pad, info, data, then the offender
+		extended := message.Data
+		if len(extended) < 16 || (extended[4] != errOriginICMP && extended[4] != errOriginICMP6) {
+			return nil, nil, false
+		}
+		info := *(*uint32)(unsafe.Pointer(&extended[8]))
+		// the pointer, next hop MTU or gateway in the header, where the kernel took info from
+		extra := make([]byte, 4)
+		binary.BigEndian.PutUint32(extra, info)
+		var messageType icmp.Type = ipv6.ICMPType(extended[5])
+		if isIpv4 {
+			messageType = ipv4.ICMPType(extended[5])
+			if messageType == ipv4.ICMPTypeParameterProblem {
+				extra = []byte{byte(info), 0, 0, 0}
+			}
+		}
+		// routers quote the IP header too, the kernel leaves it out
+		quoted := append(quotedHeader(isIpv4, destination, len(payload)), payload...)
+		data, err := (&icmp.Message{
+			Type: messageType,
+			Code: int(extended[6]),
+			Body: &icmp.RawBody{Data: append(extra, quoted...)},
+		}).Marshal(nil)
+		if err != nil {
+			return nil, nil, false
+		}
+		return data, offender(extended[16:]), true
+	}
+	return nil, nil, false
+}
+
+// quotedHeader is an IP header for an echo request we sent to destination,
+// as an ICMP error about it would quote it.
+func quotedHeader(isIpv4 bool, destination net.IP, payloadLength int) []byte {
+	if isIpv4 {
+		header := make([]byte, ipv4.HeaderLen)
+		header[0] = 4<<4 | ipv4.HeaderLen/4
+		binary.BigEndian.PutUint16(header[2:4], uint16(ipv4.HeaderLen+payloadLength))
+		header[9] = byte(icmpProtocol(true))
+		copy(header[16:20], destination.To4())
+		return header
+	}
+	header := make([]byte, ipv6.HeaderLen)
+	header[0] = 6 << 4
+	binary.BigEndian.PutUint16(header[4:6], uint16(payloadLength))
+	header[6] = byte(icmpProtocol(false))
+	copy(header[24:40], destination.To16())
+	return header
+}
+
+// offender is the address in the struct sockaddr after a sock_extended_err.
+func offender(address []byte) net.IP {
+	if len(address) < 2 {
+		return nil
+	}
+	switch *(*uint16)(unsafe.Pointer(&address[0])) {
+	case syscall.AF_INET:
+		if len(address) >= 8 {
+			return net.IP(address[4:8]).To16()
+		}
+	case syscall.AF_INET6:
+		if len(address) >= 24 {
+			return net.IP(address[8:24])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// queuedError is the IP_RECVERR (IPV6_RECVERR) control message the kernel
+// hands a datagram socket an ICMP error from the error queue with: a struct
+// sock_extended_err, then the struct sockaddr of who sent it.
+func queuedError(isIpv4 bool, origin byte, messageType byte, code byte, info uint32, from net.IP) []byte {
+	b := make([]byte, 16)
+	b[4], b[5], b[6] = origin, messageType, code
+	*(*uint32)(unsafe.Pointer(&b[8])) = info
+	if isIpv4 {
+		address := make([]byte, 16)
+		*(*uint16)(unsafe.Pointer(&address[0])) = syscall.AF_INET
+		copy(address[4:8], from.To4())
+		return controlMessage(syscall.SOL_IP, syscall.IP_RECVERR, append(b, address...))
+	}
+	address := make([]byte, 28)
+	*(*uint16)(unsafe.Pointer(&address[0])) = syscall.AF_INET6
+	copy(address[8:24], from.To16())
+	return controlMessage(syscall.SOL_IPV6, syscall.IPV6_RECVERR, append(b, address...))
+}
+
+func TestPingerAgent_LogQueuedICMPError(t *testing.T) {
+	tests := []struct {
+		desc   string
+		inIpv4 bool
+		// what the kernel put in the control messages
+		inOrigin byte
+		inType   byte
+		inCode   byte
+		inInfo   uint32
+		// not an ICMP error when empty
+		expectedType        ICMPErrorType
+		expectedDescription string
+	}{
+		{
+			desc:                "ipv4-host-unreachable",
+			inIpv4:              true,
+			inOrigin:            errOriginICMP,
+			inType:              3,
+			inCode:              1,
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Destination Host Unreachable",
+		},
+		{
+			desc:                "ipv4-admin-prohibited",
+			inIpv4:              true,
+			inOrigin:            errOriginICMP,
+			inType:              3,
+			inCode:              13,
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Packet filtered",
+		},
+		{
+			desc:                "ipv4-fragmentation-needed",
+			inIpv4:              true,
+			inOrigin:            errOriginICMP,
+			inType:              3,
+			inCode:              4,
+			inInfo:              1400,
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Frag needed and DF set (mtu = 1400)",
+		},
+		{
+			desc:                "ipv4-time-exceeded",
+			inIpv4:              true,
+			inOrigin:            errOriginICMP,
+			inType:              11,
+			expectedType:        ICMPTimeExceeded,
+			expectedDescription: "Time to live exceeded",
+		},
+		{
+			desc:                "ipv4-parameter-problem",
+			inIpv4:              true,
+			inOrigin:            errOriginICMP,
+			inType:              12,
+			inInfo:              9,
+			expectedType:        ICMPParameterProblem,
+			expectedDescription: "Parameter problem: pointer = 9",
+		},
+		{
+			desc:                "ipv6-admin-prohibited",
+			inOrigin:            errOriginICMP6,
+			inType:              1,
+			inCode:              1,
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Destination unreachable: Administratively prohibited",
+		},
+		{
+			desc:                "ipv6-packet-too-big",
+			inOrigin:            errOriginICMP6,
+			inType:              2,
+			inInfo:              1280,
+			expectedType:        ICMPPacketTooBig,
+			expectedDescription: "Packet too big: mtu=1280",
+		},
+		{
+			desc:     "ipv4-our-own-error",
+			inIpv4:   true,
+			inOrigin: 1,
+			inInfo:   1400,
+		},
+		{
+			desc:     "ipv6-send-timestamp",
+			inOrigin: errOriginTimestamping,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := BuildPinger(&PresentOptions{isIpv4: tt.inIpv4, ipAddress: "192.0.2.9"})
+			p.unprivileged = true
+			destination, router := net.ParseIP("2001:db8::9"), net.ParseIP("2001:db8::1")
+			if tt.inIpv4 {
+				destination, router = net.ParseIP("192.0.2.9"), net.ParseIP("10.0.0.1")
+			}
+			// the kernel gives back the echo request without its IP header, with
+			// the ID the kernel gave it
+			request := quotedRequest(t, p, 4, 24)
+			p.packetId++
+			oob := queuedError(tt.inIpv4, tt.inOrigin, tt.inType, tt.inCode, tt.inInfo, router)
+			data, source, ok := queuedICMPError(tt.inIpv4, oob, destination, request[len(request)-24:])
+			if ok != (tt.expectedType != "") {
+				t.Fatalf("%s: expected an ICMP error %v got %v", tt.desc, tt.expectedType != "", ok)
+			}
+			if !ok {
+				return
+			}
+			if !source.Equal(router) {
+				t.Errorf("%s: expected it from %s got %s", tt.desc, router, source)
+			}
+			var reported *ICMPErrorPacket
+			p.OnICMPError = func(e *ICMPErrorPacket) {
+				reported = e
+			}
+			if err := p.logPacket(&PingPacket{data: data, DestinationAddress: source.String()}); err != nil {
+				t.Fatal(err)
+			}
+			if reported == nil {
+				t.Fatalf("%s: expected a %q reported", tt.desc, tt.expectedType)
+			}
+			if reported.Type != tt.expectedType || reported.Description != tt.expectedDescription ||
+				reported.ICMPSequenceNumber != 4 || reported.Router != router.String() {
+				t.Errorf("%s: expected a %q saying %q got %+v", tt.desc, tt.expectedType, tt.expectedDescription, reported)
+			}
+			stats := p.GetPingStatistics()
+			if stats.PacketsReceived != 0 || stats.DestinationUnreachableReplies+stats.TimeExceededReplies+
+				stats.ParameterProblemReplies+stats.PacketTooBigReplies != 1 {
+				t.Errorf("%s: expected the error counted (and no reply) got %+v", tt.desc, stats)
+			}
+		})
+	}
+}
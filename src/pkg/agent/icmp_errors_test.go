@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Tests for ICMP errors quoting our echo requests back to us
+
+// quotedRequest is the part of one of p's echo requests a router quotes in
+// an ICMP error: a bare IP header, then the first quotedBytes of the echo.
+func quotedRequest(t *testing.T, p *PingerAgent, sequence int, quotedBytes int) []byte {
+	message := &icmp.Message{
+		Type: echoRequestType(p.options.isIpv4),
+		Body: &icmp.Echo{
+			ID:   p.packetId,
+			Seq:  sequence,
+			Data: append(TimeToBytes(time.Now()), IntToBytes(p.packetTracker)...),
+		},
+	}
+	echo, err := message.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 40)
+	if p.options.isIpv4 {
+		header = make([]byte, 20)
+		header[0] = 0x45
+	}
+	return append(header, echo[:quotedBytes]...)
+}
+
+// timeExceeded builds the Time Exceeded a router sends back for one of p's echo requests.
+func timeExceeded(t *testing.T, p *PingerAgent, sequence int, quotedBytes int) *PingPacket {
+	packetType := icmp.Type(ipv4.ICMPTypeTimeExceeded)
+	if !p.options.isIpv4 {
+		packetType = ipv6.ICMPTypeTimeExceeded
+	}
+	message := &icmp.Message{Type: packetType, Body: &icmp.TimeExceeded{Data: quotedRequest(t, p, sequence, quotedBytes)}}
+	data, err := message.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PingPacket{data: data, DestinationAddress: "10.0.0.1"}
+}
+
+func TestQuotedEcho(t *testing.T) {
+	p := BuildPinger(&PresentOptions{isIpv4: true})
+	p6 := BuildPinger(&PresentOptions{isIpv4: false})
+	tests := []struct {
+		desc             string
+		inIpv4           bool
+		in               []byte
+		expectedSequence int
+		expectedData     int
+		expectedOk       bool
+	}{
+		{
+			desc:             "ipv4-whole-echo",
+			inIpv4:           true,
+			in:               quotedRequest(t, p, 7, 24),
+			expectedSequence: 7,
+			expectedData:     16,
+			expectedOk:       true,
+		},
+		{
+			desc:             "ipv4-only-8-bytes",
+			inIpv4:           true,
+			in:               quotedRequest(t, p, 9, 8),
+			expectedSequence: 9,
+			expectedData:     0,
+			expectedOk:       true,
+		},
+		{
+			desc:             "ipv6-whole-echo",
+			inIpv4:           false,
+			in:               quotedRequest(t, p6, 3, 24),
+			expectedSequence: 3,
+			expectedData:     16,
+			expectedOk:       true,
+		},
+		{
+			desc:   "too-short",
+			inIpv4: true,
+			in:     quotedRequest(t, p, 1, 4),
+		},
+		{
+			desc:   "empty",
+			inIpv4: true,
+			in:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			echo, ok := quotedEcho(tt.inIpv4, tt.in)
+			if ok != tt.expectedOk || (ok && (echo.Seq != tt.expectedSequence || len(echo.Data) != tt.expectedData)) {
+				t.Errorf("%s: expected seq %v data %v ok %v got %+v %v", tt.desc, tt.expectedSequence, tt.expectedData, tt.expectedOk, echo, ok)
+			}
+		})
+	}
+}
+
+func TestPingerAgent_LogTimeExceeded(t *testing.T) {
+	tests := []struct {
+		desc          string
+		inIpv4        bool
+		inQuoted      int
+		inOtherPinger bool
+		expected      bool
+	}{
+		{
+			desc:     "ipv4-ours",
+			inIpv4:   true,
+			inQuoted: 24,
+			expected: true,
+		},
+		{
+			desc:     "ipv4-ours-by-id-only",
+			inIpv4:   true,
+			inQuoted: 8,
+			expected: true,
+		},
+		{
+			desc:     "ipv6-ours",
+			inIpv4:   false,
+			inQuoted: 24,
+			expected: true,
+		},
+		{
+			desc:          "someone-elses",
+			inIpv4:        true,
+			inQuoted:      24,
+			inOtherPinger: true,
+			expected:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := BuildPinger(&PresentOptions{isIpv4: tt.inIpv4, ipAddress: "192.0.2.9"})
+			sender := p
+			if tt.inOtherPinger {
+				sender = BuildPinger(&PresentOptions{isIpv4: tt.inIpv4})
+				sender.packetId = p.packetId + 1
+			}
+			var reported *ICMPErrorPacket
+			p.OnICMPError = func(e *ICMPErrorPacket) {
+				reported = e
+			}
+			if err := p.logPacket(timeExceeded(t, sender, 4, tt.inQuoted)); err != nil {
+				t.Fatal(err)
+			}
+			if (reported != nil) != tt.expected || p.GetPingStatistics().PacketsReceived != 0 {
+				t.Fatalf("%s: expected reported %v got %+v", tt.desc, tt.expected, reported)
+			}
+			if reported != nil && (reported.Type != ICMPTimeExceeded || reported.Router != "10.0.0.1" || reported.ICMPSequenceNumber != 4 ||
+				reported.Destination != "192.0.2.9" || p.GetPingStatistics().TimeExceededReplies != 1) {
+				t.Errorf("%s: got %+v", tt.desc, reported)
+			}
+		})
+	}
+}
+
+func TestPingerAgent_QuotedProbe(t *testing.T) {
+	tests := []struct {
+		desc        string
+		inSent      bool
+		inQuoted    int
+		expectedRTT time.Duration
+		expectedOk  bool
+	}{
+		{
+			desc:        "ours",
+			inSent:      true,
+			inQuoted:    24,
+			expectedRTT: 30 * time.Millisecond,
+			expectedOk:  true,
+		},
+		{
+			desc:        "only-8-bytes",
+			inSent:      true,
+			inQuoted:    8,
+			expectedRTT: 30 * time.Millisecond,
+			expectedOk:  true,
+		},
+		{
+			desc:     "never-sent",
+			inQuoted: 24,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := BuildPinger(&PresentOptions{isIpv4: true})
+			sentAt := time.Now()
+			if tt.inSent {
+				p.probes.sent(4, sentAt)
+			}
+			received := &PingPacket{ReceivedAt: sentAt.Add(30 * time.Millisecond)}
+			sequence, rtt, ok := p.quotedProbe(received, quotedRequest(t, p, 4, tt.inQuoted))
+			if ok != tt.expectedOk || (ok && (sequence != 4 || rtt != tt.expectedRTT)) {
+				t.Errorf("%s: expected sequence 4 after %v (%v) got %d after %v (%v)", tt.desc, tt.expectedRTT, tt.expectedOk, sequence, rtt, ok)
+			}
+		})
+	}
+}
+
+// icmpError builds an ICMP error about one of p's echo requests: its type
+// specific bytes (a pointer, MTU or gateway), then the whole request quoted.
+func icmpError(t *testing.T, p *PingerAgent, messageType icmp.Type, code int, extra []byte) *PingPacket {
+	message := &icmp.Message{Type: messageType, Code: code, Body: &icmp.RawBody{Data: append(extra, quotedRequest(t, p, 4, 24)...)}}
+	data, err := message.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PingPacket{data: data, DestinationAddress: "10.0.0.1"}
+}
+
+// ipv6Redirect builds an ipv6 Redirect, with one of p's echo requests in its
+// Redirected Header option unless it is left out.
+func ipv6Redirect(t *testing.T, p *PingerAgent, withHeader bool) *PingPacket {
+	body := make([]byte, 36)
+	copy(body[4:], net.ParseIP("fe80::1"))
+	copy(body[20:], net.ParseIP("2001:db8::9"))
+	if withHeader {
+		quoted := quotedRequest(t, p, 4, 24)
+		option := append([]byte{4, byte((8 + len(quoted) + 7) / 8), 0, 0, 0, 0, 0, 0}, quoted...)
+		body = append(body, append(option, make([]byte, int(option[1])*8-len(option))...)...)
+	}
+	message := &icmp.Message{Type: ipv6.ICMPTypeRedirect, Body: &icmp.RawBody{Data: body}}
+	data, err := message.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PingPacket{data: data, DestinationAddress: "fe80::1"}
+}
+
+func TestPingerAgent_LogICMPError(t *testing.T) {
+	tests := []struct {
+		desc          string
+		inIpv4        bool
+		inPacket      func(t *testing.T, p *PingerAgent) *PingPacket
+		inOtherPinger bool
+		// nothing reported when empty
+		expectedType        ICMPErrorType
+		expectedDescription string
+	}{
+		{
+			desc:   "ipv4-host-unreachable",
+			inIpv4: true,
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv4.ICMPTypeDestinationUnreachable, 1, make([]byte, 4))
+			},
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Destination Host Unreachable",
+		},
+		{
+			desc:   "ipv4-admin-prohibited",
+			inIpv4: true,
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv4.ICMPTypeDestinationUnreachable, 13, make([]byte, 4))
+			},
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Packet filtered",
+		},
+		{
+			desc:   "ipv4-fragmentation-needed",
+			inIpv4: true,
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv4.ICMPTypeDestinationUnreachable, 4, []byte{0, 0, 0x05, 0x78})
+			},
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Frag needed and DF set (mtu = 1400)",
+		},
+		{
+			desc:   "ipv4-time-exceeded",
+			inIpv4: true,
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv4.ICMPTypeTimeExceeded, 0, make([]byte, 4))
+			},
+			expectedType:        ICMPTimeExceeded,
+			expectedDescription: "Time to live exceeded",
+		},
+		{
+			desc:   "ipv4-redirect",
+			inIpv4: true,
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv4.ICMPTypeRedirect, 1, []byte{10, 0, 0, 254})
+			},
+			expectedType:        ICMPRedirect,
+			expectedDescription: "Redirect Host(New nexthop: 10.0.0.254)",
+		},
+		{
+			desc:   "ipv4-parameter-problem",
+			inIpv4: true,
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv4.ICMPTypeParameterProblem, 0, []byte{9, 0, 0, 0})
+			},
+			expectedType:        ICMPParameterProblem,
+			expectedDescription: "Parameter problem: pointer = 9",
+		},
+		{
+			desc: "ipv6-admin-prohibited",
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv6.ICMPTypeDestinationUnreachable, 1, make([]byte, 4))
+			},
+			expectedType:        ICMPDestinationUnreachable,
+			expectedDescription: "Destination unreachable: Administratively prohibited",
+		},
+		{
+			desc: "ipv6-packet-too-big",
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv6.ICMPTypePacketTooBig, 0, []byte{0, 0, 0x05, 0x00})
+			},
+			expectedType:        ICMPPacketTooBig,
+			expectedDescription: "Packet too big: mtu=1280",
+		},
+		{
+			desc: "ipv6-hop-limit",
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv6.ICMPTypeTimeExceeded, 0, make([]byte, 4))
+			},
+			expectedType:        ICMPTimeExceeded,
+			expectedDescription: "Time exceeded: Hop limit",
+		},
+		{
+			desc: "ipv6-parameter-problem",
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv6.ICMPTypeParameterProblem, 1, []byte{0, 0, 0, 6})
+			},
+			expectedType:        ICMPParameterProblem,
+			expectedDescription: "Parameter problem: Unknown header at 6",
+		},
+		{
+			desc: "ipv6-redirect",
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return ipv6Redirect(t, p, true)
+			},
+			expectedType:        ICMPRedirect,
+			expectedDescription: "Redirect (New nexthop: fe80::1)",
+		},
+		{
+			desc: "ipv6-redirect-without-our-header",
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return ipv6Redirect(t, p, false)
+			},
+		},
+		{
+			desc:   "someone-elses",
+			inIpv4: true,
+			inPacket: func(t *testing.T, p *PingerAgent) *PingPacket {
+				return icmpError(t, p, ipv4.ICMPTypeDestinationUnreachable, 1, make([]byte, 4))
+			},
+			inOtherPinger: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := BuildPinger(&PresentOptions{isIpv4: tt.inIpv4, ipAddress: "192.0.2.9"})
+			sender := p
+			if tt.inOtherPinger {
+				sender = BuildPinger(&PresentOptions{isIpv4: tt.inIpv4})
+				sender.packetId = p.packetId + 1
+			}
+			var reported *ICMPErrorPacket
+			p.OnICMPError = func(e *ICMPErrorPacket) {
+				reported = e
+			}
+			received := tt.inPacket(t, sender)
+			if err := p.logPacket(received); err != nil {
+				t.Fatal(err)
+			}
+			stats := p.GetPingStatistics()
+			if (reported != nil) != (tt.expectedType != "") || stats.PacketsReceived != 0 {
+				t.Fatalf("%s: expected a %q reported got %+v", tt.desc, tt.expectedType, reported)
+			}
+			if reported == nil {
+				return
+			}
+			if reported.Type != tt.expectedType || reported.Description != tt.expectedDescription || reported.ICMPSequenceNumber != 4 ||
+				reported.Router != received.DestinationAddress || reported.Destination != "192.0.2.9" {
+				t.Errorf("%s: expected a %q saying %q got %+v", tt.desc, tt.expectedType, tt.expectedDescription, reported)
+			}
+			counted := map[ICMPErrorType]int{
+				ICMPDestinationUnreachable: stats.DestinationUnreachableReplies,
+				ICMPTimeExceeded:           stats.TimeExceededReplies,
+				ICMPRedirect:               stats.RedirectReplies,
+				ICMPParameterProblem:       stats.ParameterProblemReplies,
+				ICMPPacketTooBig:           stats.PacketTooBigReplies,
+			}
+			for kind, count := range counted {
+				if expected := map[bool]int{true: 1}[kind == tt.expectedType]; count != expected {
+					t.Errorf("%s: expected %d %q counted got %d", tt.desc, expected, kind, count)
+				}
+			}
+		})
+	}
+}
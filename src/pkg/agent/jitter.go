@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"time"
+)
+
+// JitterEstimator follows delay variation over the stream of replies, in the
+// order they arrive:
+//   - interarrival jitter as the smoothed estimator of RFC 3550 section 6.4.1,
+//     J += (|D| - J) / 16, where D is the difference between consecutive RTTs
+//   - IPDV (RFC 5481), those same consecutive differences, as a mean and max of their size
+//
+// PDV (RFC 5481, delay above the minimum delay) needs percentiles, so it is
+// taken from the RTT statistics instead.
+type JitterEstimator struct {
+	lastRTT   time.Duration
+	replies   int
+	jitter    float64
+	ipdvTotal time.Duration
+	maxIPDV   time.Duration
+}
+
+// Add logs the next reply's RTT and gives back the jitter so far.
+func (j *JitterEstimator) Add(rtt time.Duration) time.Duration {
+	j.replies++
+	if j.replies > 1 {
+		ipdv := rtt - j.lastRTT
+		if ipdv < 0 {
+			ipdv = -ipdv
+		}
+		j.jitter += (float64(ipdv) - j.jitter) / 16
+		j.ipdvTotal += ipdv
+		if ipdv > j.maxIPDV {
+			j.maxIPDV = ipdv
+		}
+	}
+	j.lastRTT = rtt
+	return j.Jitter()
+}
+
+// Jitter is the RFC 3550 interarrival jitter.
+func (j *JitterEstimator) Jitter() time.Duration {
+	return time.Duration(j.jitter)
+}
+
+// MeanIPDV is the average size of the difference between consecutive RTTs.
+func (j *JitterEstimator) MeanIPDV() time.Duration {
+	if j.replies < 2 {
+		return 0
+	}
+	return j.ipdvTotal / time.Duration(j.replies-1)
+}
+
+// MaxIPDV is the biggest difference between consecutive RTTs.
+func (j *JitterEstimator) MaxIPDV() time.Duration {
+	return j.maxIPDV
+}
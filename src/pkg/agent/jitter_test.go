@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests for the RFC 3550 / RFC 5481 delay variation
+
+func TestJitterEstimator(t *testing.T) {
+	tests := []struct {
+		desc             string
+		in               []time.Duration
+		expectedJitter   time.Duration
+		expectedMeanIPDV time.Duration
+		expectedMaxIPDV  time.Duration
+	}{
+		{
+			desc: "no-replies",
+		},
+		{
+			desc: "one-reply",
+			in:   []time.Duration{10 * time.Millisecond},
+		},
+		{
+			desc:             "steady",
+			in:               []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond},
+			expectedJitter:   0,
+			expectedMeanIPDV: 0,
+			expectedMaxIPDV:  0,
+		},
+		{
+			// J = 16/16 = 1ms, then J = 1 + (32 - 1)/16 = 2.9375ms
+			desc:             "up-and-down",
+			in:               []time.Duration{10 * time.Millisecond, 26 * time.Millisecond, 58 * time.Millisecond},
+			expectedJitter:   2937500 * time.Nanosecond,
+			expectedMeanIPDV: 24 * time.Millisecond,
+			expectedMaxIPDV:  32 * time.Millisecond,
+		},
+		{
+			desc:             "decreasing-counts-the-size",
+			in:               []time.Duration{26 * time.Millisecond, 10 * time.Millisecond},
+			expectedJitter:   time.Millisecond,
+			expectedMeanIPDV: 16 * time.Millisecond,
+			expectedMaxIPDV:  16 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var j JitterEstimator
+			var running time.Duration
+			for _, rtt := range tt.in {
+				running = j.Add(rtt)
+			}
+			if running != j.Jitter() || j.Jitter() != tt.expectedJitter || j.MeanIPDV() != tt.expectedMeanIPDV || j.MaxIPDV() != tt.expectedMaxIPDV {
+				t.Errorf("%s: expected jitter/ipdv mean/max %v/%v/%v got %v(%v)/%v/%v", tt.desc, tt.expectedJitter, tt.expectedMeanIPDV,
+					tt.expectedMaxIPDV, j.Jitter(), running, j.MeanIPDV(), j.MaxIPDV())
+			}
+		})
+	}
+}
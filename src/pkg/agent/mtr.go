@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MTRResponder is one address that answered for a hop, load balancers can
+// make that more than one.
+type MTRResponder struct {
+	Address  string
+	Received int
+}
+
+// MTRHop is the statistics of every echo request an MTR sent with one TTL.
+type MTRHop struct {
+	TTL int
+	// probes that were answered or given up on, the ones still in flight are left out
+	Sent        int
+	Received    int
+	PercentLost float64
+	// the round trip time of the most recent answer
+	LastRTT    time.Duration
+	AverageRTT time.Duration
+	BestRTT    time.Duration
+	WorstRTT   time.Duration
+	StdDevRTT  time.Duration
+	// a snapshot of the streaming statistics behind the numbers above
+	RoundTripTimes *RTTStatistics
+	// in the order they first answered
+	Responders []*MTRResponder
+	// the destination answered (or couldn't be reached) at this hop
+	Reached bool
+}
+
+// mtrHop is what an MTR keeps of one TTL while it runs.
+type mtrHop struct {
+	ttl            int
+	sent           int
+	received       int
+	last           time.Duration
+	roundTripTimes RTTStatistics
+	responders     []*MTRResponder
+}
+
+// mtrWait is an echo request we are still waiting on an answer for.
+type mtrWait struct {
+	hop     *mtrHop
+	expires time.Time
+}
+
+// MTRAgent is a traceroute that never stops going over the route: every
+// interval it sends a round of echo requests, one per TTL from the first hop
+// up to the destination (or the max hops), and keeps ping statistics for
+// every hop. It stops after count rounds.
+type MTRAgent struct {
+	options PresentOptions
+	// does the actual sending and matching
+	pinger *PingerAgent
+	// one per TTL, from the first hop on
+	hops []*mtrHop
+	// ICMP sequence -> echo request still waiting on an answer
+	outstanding map[int]*mtrWait
+	rounds      int
+	// the lowest TTL the destination (or an unreachable) answered at, 0 until one does
+	reachedAt int
+	stopPing  *stopSignal
+	// Callbacks to the main function: the statistics of every hop up to the
+	// destination every interval, to keep a view up to date, and once we are done.
+	OnUpdate func(hops []*MTRHop)
+	// an echo request that couldn't be sent, or an answer we couldn't make sense of
+	OnError       func(err error)
+	OnMTRComplete func(hops []*MTRHop)
+	// opens the Transport of the destination's family instead of an ICMP
+	// socket, it has to be a TTLTransport
+	Listen func(isIpv4 bool) (Transport, error)
+	// where the time, timers and tickers come from, the real time if nil
+	Clock Clock
+}
+
+// BuildMTR builds an MTR to the options' destination.
+func BuildMTR(options *PresentOptions) (*MTRAgent, error) {
+	if options.ipAddress == "" {
+		return nil, errors.New("an mtr needs a destination")
+	}
+	if options.firstHop < 1 || options.firstHop > options.maxHops || options.count < 1 {
+		return nil, errors.New("an mtr needs a first hop up to its max hops, and at least one round")
+	}
+	m := &MTRAgent{
+		options:     *options,
+		pinger:      BuildPinger(options),
+		outstanding: make(map[int]*mtrWait),
+		stopPing:    newStopSignal(),
+	}
+	m.pinger.stopPing = m.stopPing
+	return m, nil
+}
+
+// Driver sends a round every interval, collects the answers and gives up on
+// each echo request once its deadline passes.
+func (m *MTRAgent) Driver() {
+	m.Run(context.Background())
+}
+
+// Run is Driver that also stops once ctx is done, and gives back the
+// statistics of every hop up to the destination (or the max hops). It gives
+// back an error when the socket couldn't be opened (then there are no hops)
+// or receiving failed.
+func (m *MTRAgent) Run(ctx context.Context) ([]*MTRHop, error) {
+	m.pinger.Listen = m.Listen
+	m.pinger.Clock = m.Clock
+	connection, err := m.pinger.openTTLTransport()
+	if err != nil {
+		m.Stop()
+		return nil, err
+	}
+	packetChannels := map[bool]chan *PingPacket{m.options.isIpv4: make(chan *PingPacket, 64)}
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go m.pinger.ReceiveICMPPacket(connection, packetChannels[m.options.isIpv4], &waitGroup)
+	clock := clockOrReal(m.Clock)
+	ticker := clock.NewTicker(m.options.interval)
+	defer ticker.Stop()
+	var timeout <-chan time.Time
+	if m.options.timeout > 0 {
+		timeoutTimer := clock.NewTimer(m.options.timeout)
+		defer timeoutTimer.Stop()
+		timeout = timeoutTimer.C()
+	}
+	// the first round goes out right away
+	m.sendRound(connection)
+	for !m.stopPing.stopped() {
+		select {
+		// Ctrl+C, or the receiver gave up
+		case <-m.stopPing.done:
+		case <-ctx.Done():
+			m.Stop()
+		case <-timeout:
+			m.Stop()
+		case now := <-ticker.C():
+			m.expire(now)
+			updateHandler := m.OnUpdate
+			if updateHandler != nil {
+				updateHandler(m.statistics())
+			}
+			if m.rounds < m.options.count {
+				m.sendRound(connection)
+			}
+		case receivedPacket := <-packetChannels[m.options.isIpv4]:
+			m.collect(receivedPacket)
+		}
+		if m.rounds >= m.options.count && len(m.outstanding) == 0 {
+			m.Stop()
+		}
+	}
+	// closing the connection is what gets the receiver out of a read right away
+	connection.Close()
+	drainReceivers(&waitGroup, packetChannels)
+	hops := m.statistics()
+	completeHandler := m.OnMTRComplete
+	if completeHandler != nil {
+		completeHandler(hops)
+	}
+	return hops, m.pinger.receiveErr
+}
+
+// Stop notifies all goroutines to stop, the echo requests still in flight are left out.
+func (m *MTRAgent) Stop() {
+	m.stopPing.stop()
+}
+
+// lastHop is the TTL the destination answered at, or the max hops until it does.
+func (m *MTRAgent) lastHop() int {
+	if m.reachedAt > 0 {
+		return m.reachedAt
+	}
+	return m.options.maxHops
+}
+
+// sendRound sends one echo request with every TTL up to the last hop.
+func (m *MTRAgent) sendRound(connection TTLTransport) {
+	m.rounds++
+	for ttl := m.options.firstHop; ttl <= m.lastHop(); ttl++ {
+		index := ttl - m.options.firstHop
+		if index == len(m.hops) {
+			m.hops = append(m.hops, &mtrHop{ttl: ttl})
+		}
+		// the sequence goes out on the wire as 16 bits
+		sequence := m.pinger.sequence & 0xffff
+		if err := connection.SetTTL(ttl); err != nil {
+			m.reportError(fmt.Errorf("could not set the TTL to %d: %w", ttl, err))
+			continue
+		}
+		if err := m.pinger.sendEcho(connection, m.options.ipAddress); err != nil {
+			m.reportError(err)
+			continue
+		}
+		m.outstanding[sequence] = &mtrWait{
+			hop:     m.hops[index],
+			expires: clockOrReal(m.Clock).Now().Add(m.options.deadline),
+		}
+	}
+}
+
+// collect logs an answer on the hop its echo request went out to.
+func (m *MTRAgent) collect(received *PingPacket) {
+	answer, ours, err := m.pinger.answer(received)
+	if err != nil {
+		m.reportError(err)
+		return
+	}
+	if !ours {
+		return
+	}
+	wait, ok := m.outstanding[answer.sequence]
+	if !ok {
+		// a duplicate, or it showed up after we gave up on it
+		return
+	}
+	delete(m.outstanding, answer.sequence)
+	hop := wait.hop
+	hop.sent++
+	hop.received++
+	hop.last = answer.roundTripTime
+	hop.roundTripTimes.Add(answer.roundTripTime)
+	hop.responded(answer.responder)
+	// nothing gets any further than this
+	if answer.reply != ReplyTimeExceeded && (m.reachedAt == 0 || hop.ttl < m.reachedAt) {
+		m.reachedAt = hop.ttl
+	}
+}
+
+// expire gives up on every echo request whose deadline has passed.
+func (m *MTRAgent) expire(now time.Time) {
+	for sequence, wait := range m.outstanding {
+		if now.After(wait.expires) {
+			delete(m.outstanding, sequence)
+			wait.hop.sent++
+		}
+	}
+}
+
+// responded counts an answer from an address.
+func (h *mtrHop) responded(address string) {
+	for _, responder := range h.responders {
+		if responder.Address == address {
+			responder.Received++
+			return
+		}
+	}
+	h.responders = append(h.responders, &MTRResponder{Address: address, Received: 1})
+}
+
+// statistics is a snapshot of every hop up to the last one, leaving out the
+// ones we sent past the destination before it answered.
+func (m *MTRAgent) statistics() []*MTRHop {
+	hops := m.hops
+	if last := m.lastHop() - m.options.firstHop + 1; last < len(hops) {
+		hops = hops[:last]
+	}
+	statistics := make([]*MTRHop, 0, len(hops))
+	for _, hop := range hops {
+		snapshot := &MTRHop{
+			TTL:            hop.ttl,
+			Sent:           hop.sent,
+			Received:       hop.received,
+			LastRTT:        hop.last,
+			AverageRTT:     hop.roundTripTimes.Mean(),
+			BestRTT:        hop.roundTripTimes.Min(),
+			WorstRTT:       hop.roundTripTimes.Max(),
+			StdDevRTT:      hop.roundTripTimes.StdDev(),
+			RoundTripTimes: hop.roundTripTimes.Clone(),
+			Reached:        hop.ttl == m.reachedAt,
+		}
+		if hop.sent > 0 {
+			snapshot.PercentLost = float64(hop.sent-hop.received) / float64(hop.sent) * 100
+		}
+		for _, responder := range hop.responders {
+			copied := *responder
+			snapshot.Responders = append(snapshot.Responders, &copied)
+		}
+		statistics = append(statistics, snapshot)
+	}
+	return statistics
+}
+
+func (m *MTRAgent) reportError(err error) {
+	errorHandler := m.OnError
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
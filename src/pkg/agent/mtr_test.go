@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMTRAgent_Run_SimulatedNetwork(t *testing.T) {
+	tests := []struct {
+		desc      string
+		inMaxHops int
+		inNetwork func(n *SimulatedNetwork)
+		// every responder of every hop, in the order they first answered
+		expectedResponders [][]string
+		expectedLost       []float64
+		expectedReached    bool
+	}{
+		{
+			desc:      "reaches-the-destination",
+			inMaxHops: 30,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1", "198.51.100.2"}
+			},
+			expectedResponders: [][]string{{"198.51.100.1"}, {"198.51.100.2"}, {"192.0.2.1"}},
+			expectedLost:       []float64{0, 0, 0},
+			expectedReached:    true,
+		},
+		{
+			desc:      "load-balanced",
+			inMaxHops: 30,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Paths = [][]string{{"198.51.100.1", "198.51.100.3"}, {"198.51.100.2", "198.51.100.3"}}
+			},
+			expectedResponders: [][]string{{"198.51.100.1", "198.51.100.2"}, {"198.51.100.3"}, {"192.0.2.1"}},
+			expectedLost:       []float64{0, 0, 0},
+			expectedReached:    true,
+		},
+		{
+			desc:      "silent-router",
+			inMaxHops: 30,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1", "198.51.100.2"}
+				n.Alive = func(address string) bool {
+					return address != "198.51.100.2"
+				}
+			},
+			expectedResponders: [][]string{{"198.51.100.1"}, nil, {"192.0.2.1"}},
+			expectedLost:       []float64{0, 100, 0},
+			expectedReached:    true,
+		},
+		{
+			desc:      "destination-never-answers",
+			inMaxHops: 3,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1"}
+				n.Alive = func(address string) bool {
+					return address != "192.0.2.1"
+				}
+			},
+			expectedResponders: [][]string{{"198.51.100.1"}, nil, nil},
+			expectedLost:       []float64{0, 100, 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			network := NewSimulatedNetwork(1)
+			network.Latency = time.Millisecond
+			tt.inNetwork(network)
+			options := tracerouteOptions(t, "192.0.2.1", 1, tt.inMaxHops)
+			options.count = 4
+			mtr, err := BuildMTR(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mtr.Listen = network.Listen
+			updates := 0
+			mtr.OnUpdate = func(hops []*MTRHop) {
+				updates++
+			}
+			hops, err := mtr.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hops) != len(tt.expectedResponders) || updates == 0 {
+				t.Fatalf("%s: expected %d hops and updates on the way got %d after %d updates", tt.desc, len(tt.expectedResponders), len(hops), updates)
+			}
+			for i, hop := range hops {
+				if hop.TTL != i+1 || hop.Sent != 4 || hop.PercentLost != tt.expectedLost[i] || len(hop.Responders) != len(tt.expectedResponders[i]) {
+					t.Fatalf("%s: expected TTL %d to lose %v%% of 4 to %v got %+v", tt.desc, i+1, tt.expectedLost[i], tt.expectedResponders[i], hop)
+				}
+				received := 0
+				for j, responder := range hop.Responders {
+					if responder.Address != tt.expectedResponders[i][j] {
+						t.Errorf("%s: expected TTL %d to be answered by %v got %+v", tt.desc, hop.TTL, tt.expectedResponders[i], responder)
+					}
+					received += responder.Received
+				}
+				if received != hop.Received || hop.RoundTripTimes.Count() != hop.Received {
+					t.Errorf("%s: expected the responders and round trip times to add up to %d got %d and %d", tt.desc, hop.Received, received, hop.RoundTripTimes.Count())
+				}
+				if hop.Received > 0 && (hop.BestRTT < time.Millisecond || hop.BestRTT > hop.AverageRTT || hop.AverageRTT > hop.WorstRTT || hop.LastRTT == 0) {
+					t.Errorf("%s: expected round trip times of at least the latency in order got %+v", tt.desc, hop)
+				}
+			}
+			if hops[len(hops)-1].Reached != tt.expectedReached {
+				t.Errorf("%s: expected reached %v got %+v", tt.desc, tt.expectedReached, hops[len(hops)-1])
+			}
+		})
+	}
+}
+
+func TestBuildMTR(t *testing.T) {
+	if _, err := BuildMTR(tracerouteOptions(t, "192.0.2.1", 1, 30)); err != nil {
+		t.Errorf("expected an mtr got %v", err)
+	}
+	if _, err := BuildMTR(tracerouteOptions(t, "", 1, 30)); err == nil {
+		t.Errorf("expected an error without a destination")
+	}
+	// options from the Parse* calls alone have no hops or rounds
+	if _, err := BuildMTR(&PresentOptions{ipAddress: "192.0.2.1", isIpv4: true}); err == nil {
+		t.Errorf("expected an error without hops")
+	}
+}
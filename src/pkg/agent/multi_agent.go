@@ -0,0 +1,438 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MultiPingerAgent pings many destinations at once (fping-style). Every
+// destination is a regular PingerAgent with its own statistics, but all of
+// them share one ICMP socket per address family, and replies are handed
+// back to the right destination by their tracker.
+type MultiPingerAgent struct {
+	targets []*PingerAgent
+	// when each destination sends next and when it is done, in the same order as targets
+	schedules []targetSchedule
+	// packet tracker -> destination, to demultiplex replies
+	trackers map[int64]*PingerAgent
+	// echo ID -> destination, for ICMP errors that only quote the echo header (on raw sockets)
+	ids map[int]*PingerAgent
+	// shared with every target so a single stop stops all goroutines.
+	stopPing *stopSignal
+	// Callbacks to the main function to print per-target replies and statistics.
+	OnEchoComplete    func(p *PingPacket, exceededTTL bool)
+	OnEchoSent        func(sequence int, destination string)
+	OnEchoTimeout     func(sequence int, destination string)
+	OnEchoLost        func(p *PingPacket)
+	OnICMPError       func(e *ICMPErrorPacket)
+	OnCorruptedReply  func(c *CorruptedReplyPacket)
+	OnError           func(err error)
+	OnProcessComplete func(c []*CompletedPingStatistics)
+	// opens the Transport of an address family instead of an ICMP socket
+	Listen func(isIpv4 bool) (Transport, error)
+	// where the time, timers and tickers come from, the real time if nil
+	Clock Clock
+}
+
+// targetSchedule is when a destination sends its next echo request, and
+// when it is done: its timeout (-t) ran out, or its last echo request has
+// had its deadline (-w) to come back. A zero time is never.
+type targetSchedule struct {
+	nextSend time.Time
+	timesOut time.Time
+	lastCall time.Time
+}
+
+// BuildMultiPinger builds a pinger for every address, all of them sharing
+// the command line options.
+func BuildMultiPinger(options *PresentOptions, ipAddresses []string) (*MultiPingerAgent, error) {
+	targetOptions := make([]*PresentOptions, 0, len(ipAddresses))
+	for _, ipAddress := range ipAddresses {
+		target := *options
+		if err := target.ParseIPAddress(ipAddress); err != nil {
+			return nil, err
+		}
+		targetOptions = append(targetOptions, &target)
+	}
+	return BuildMultiPingerFromOptions(targetOptions)
+}
+
+// BuildMultiPingerFromOptions builds a pinger for every destination with
+// options of its own (e.g. from a config file), each of them sending at its
+// own interval. Every one of them needs its IP address set.
+func BuildMultiPingerFromOptions(targetOptions []*PresentOptions) (*MultiPingerAgent, error) {
+	m := &MultiPingerAgent{
+		trackers:  make(map[int64]*PingerAgent),
+		ids:       make(map[int]*PingerAgent),
+		stopPing:  newStopSignal(),
+		schedules: make([]targetSchedule, len(targetOptions)),
+	}
+	// one source for every target, seeding per target could hand out the same tracker twice.
+	tracker := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, options := range targetOptions {
+		if options.ipAddress == "" {
+			return nil, errors.New("every destination needs an IP address")
+		}
+		target := BuildPinger(options)
+		target.stopPing = m.stopPing
+		for {
+			target.packetId = tracker.Intn(math.MaxInt16)
+			if _, taken := m.ids[target.packetId]; !taken || len(m.ids) >= math.MaxInt16 {
+				break
+			}
+		}
+		for {
+			target.packetTracker = tracker.Int63n(math.MaxInt64)
+			if _, taken := m.trackers[target.packetTracker]; !taken {
+				break
+			}
+		}
+		m.trackers[target.packetTracker] = target
+		m.ids[target.packetId] = target
+		m.targets = append(m.targets, target)
+	}
+	return m, nil
+}
+
+// Driver sends to and receives from every destination until each one has
+// finished its count, the timeout fires, or we are interrupted.
+func (m *MultiPingerAgent) Driver() {
+	m.Run(context.Background())
+}
+
+// Run is Driver that also stops once ctx is done, and gives back the
+// statistics of every destination. It gives back an error when a socket
+// couldn't be opened (then there are no statistics) or receiving failed,
+// echo requests that couldn't be sent only go to OnError.
+func (m *MultiPingerAgent) Run(ctx context.Context) ([]*CompletedPingStatistics, error) {
+	for _, target := range m.targets {
+		target.OnEchoComplete = m.OnEchoComplete
+		target.OnEchoSent = m.OnEchoSent
+		target.OnEchoTimeout = m.OnEchoTimeout
+		target.OnEchoLost = m.OnEchoLost
+		target.OnICMPError = m.OnICMPError
+		target.OnCorruptedReply = m.OnCorruptedReply
+		target.OnError = m.OnError
+		target.Listen = m.Listen
+		target.Clock = m.Clock
+	}
+	// one connection and packet channel per address family, nil channels never fire in the select.
+	connections := make(map[bool]Transport)
+	packetChannels := make(map[bool]chan *PingPacket)
+	var waitGroup sync.WaitGroup
+	for _, isIpv4 := range []bool{true, false} {
+		family := m.family(isIpv4)
+		if len(family) == 0 {
+			continue
+		}
+		connection, err := family[0].openTransport()
+		if err != nil {
+			// let any started receivers finish.
+			m.stop()
+			closeConnections(connections)
+			drainReceivers(&waitGroup, packetChannels)
+			return nil, err
+		}
+		for _, target := range family {
+			target.unprivileged = family[0].unprivileged
+		}
+		connections[isIpv4] = connection
+		packetChannels[isIpv4] = make(chan *PingPacket, 5*len(family))
+		waitGroup.Add(1)
+		go family[0].ReceiveICMPPacket(connection, packetChannels[isIpv4], &waitGroup)
+	}
+	clock := clockOrReal(m.Clock)
+	start := clock.Now()
+	for i, target := range m.targets {
+		m.schedules[i] = targetSchedule{nextSend: start, timesOut: after(start, target.options.timeout)}
+	}
+	m.sendDue(connections, start)
+	// fires when a destination is due to send, or might be done
+	wake := m.scheduleWake(start)
+	probeExpiry := m.scheduleProbeExpiry(start)
+	for !m.stopPing.stopped() {
+		select {
+		// Ctrl+C, or a receiver gave up
+		case <-m.stopPing.done:
+		case <-ctx.Done():
+			m.stop()
+		case now := <-wake:
+			m.sendDue(connections, now)
+			wake = m.scheduleWake(now)
+			if probeExpiry == nil {
+				probeExpiry = m.scheduleProbeExpiry(now)
+			}
+		case now := <-probeExpiry:
+			for _, target := range m.targets {
+				target.expireProbes(now)
+			}
+			probeExpiry = m.scheduleProbeExpiry(now)
+		case receivedPacket := <-packetChannels[true]:
+			m.demultiplex(receivedPacket, true)
+		case receivedPacket := <-packetChannels[false]:
+			m.demultiplex(receivedPacket, false)
+		}
+		if m.finished(clock.Now()) {
+			m.stop()
+		}
+	}
+	// closing the connections is what gets the receivers out of a read right away
+	closeConnections(connections)
+	drainReceivers(&waitGroup, packetChannels)
+	stats := m.GetPingStatistics()
+	statsHandler := m.OnProcessComplete
+	if statsHandler != nil {
+		statsHandler(stats)
+	}
+	// the first target of a family is the one receiving for it
+	for _, isIpv4 := range []bool{true, false} {
+		if family := m.family(isIpv4); len(family) > 0 && family[0].receiveErr != nil {
+			return stats, family[0].receiveErr
+		}
+	}
+	return stats, nil
+}
+
+// GetPingStatistics gives back the statistics of every destination, in the order they were given.
+func (m *MultiPingerAgent) GetPingStatistics() []*CompletedPingStatistics {
+	stats := make([]*CompletedPingStatistics, 0, len(m.targets))
+	for _, target := range m.targets {
+		stats = append(stats, target.GetPingStatistics())
+	}
+	return stats
+}
+
+// Stop notifies all goroutines of every destination to stop.
+func (m *MultiPingerAgent) Stop() {
+	m.stop()
+}
+
+func (m *MultiPingerAgent) stop() {
+	m.stopPing.stop()
+}
+
+// sendDue sends one echo from every destination whose interval is up, that
+// hasn't reached its count or its timeout yet.
+func (m *MultiPingerAgent) sendDue(connections map[bool]Transport, now time.Time) {
+	for i, target := range m.targets {
+		schedule := &m.schedules[i]
+		if !m.sending(i, now) || now.Before(schedule.nextSend) {
+			continue
+		}
+		if err := target.SendICMPPacket(connections[target.options.isIpv4]); err != nil {
+			target.reportError(err)
+		}
+		schedule.nextSend = schedule.nextSend.Add(target.options.interval)
+		if schedule.nextSend.Before(now) {
+			// we fell behind, don't burst to catch up
+			schedule.nextSend = now.Add(target.options.interval)
+		}
+		// once everything is sent we only wait one more deadline for stragglers
+		if target.options.count > 0 && target.packetsSent >= target.options.count {
+			schedule.lastCall = now.Add(target.options.deadline)
+		}
+	}
+}
+
+// sending is true while a destination still has echo requests to send.
+func (m *MultiPingerAgent) sending(i int, now time.Time) bool {
+	target := m.targets[i]
+	if target.options.count > 0 && target.packetsSent >= target.options.count {
+		return false
+	}
+	return !reached(now, m.schedules[i].timesOut)
+}
+
+// nextWake is the earliest a destination that isn't done yet is due to send
+// or might be done, false when there is nothing left to wake up for.
+func (m *MultiPingerAgent) nextWake(now time.Time) (time.Time, bool) {
+	var earliest time.Time
+	for i := range m.targets {
+		if m.done(i, now) {
+			continue
+		}
+		schedule := m.schedules[i]
+		wakes := []time.Time{schedule.timesOut, schedule.lastCall}
+		if m.sending(i, now) {
+			wakes = append(wakes, schedule.nextSend)
+		}
+		for _, wake := range wakes {
+			// what is already past was taken care of when we woke up for it
+			if wake.After(now) && (earliest.IsZero() || wake.Before(earliest)) {
+				earliest = wake
+			}
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// scheduleWake gives back a channel that fires at nextWake, nil when there
+// is nothing left to wake up for.
+func (m *MultiPingerAgent) scheduleWake(now time.Time) <-chan time.Time {
+	wake, ok := m.nextWake(now)
+	if !ok {
+		return nil
+	}
+	return clockOrReal(m.Clock).NewTimer(wake.Sub(now)).C()
+}
+
+// scheduleProbeExpiry gives back a channel that fires when the earliest
+// unanswered probe of any destination runs out of time.
+func (m *MultiPingerAgent) scheduleProbeExpiry(now time.Time) <-chan time.Time {
+	var earliest time.Time
+	for _, target := range m.targets {
+		if target.options.probeTimeout <= 0 {
+			continue
+		}
+		deadline, ok := target.probes.nextDeadline(target.options.probeTimeout)
+		if ok && (earliest.IsZero() || deadline.Before(earliest)) {
+			earliest = deadline
+		}
+	}
+	if earliest.IsZero() {
+		return nil
+	}
+	return clockOrReal(m.Clock).NewTimer(earliest.Sub(now)).C()
+}
+
+// demultiplex hands a received packet to the destination it belongs to.
+func (m *MultiPingerAgent) demultiplex(received *PingPacket, isIpv4 bool) {
+	target := m.owner(received, isIpv4)
+	if target == nil {
+		// someone else's ping
+		return
+	}
+	if err := target.logPacket(received); err != nil {
+		target.reportError(err)
+	}
+}
+
+// owner finds the destination a received packet belongs to: by the tracker
+// of an echo reply, or by the echo request an ICMP error quotes back.
+func (m *MultiPingerAgent) owner(received *PingPacket, isIpv4 bool) *PingerAgent {
+	if tracker, ok := echoTracker(icmpProtocol(isIpv4), received.data); ok {
+		return m.trackers[tracker]
+	}
+	message, err := icmp.ParseMessage(icmpProtocol(isIpv4), received.data)
+	if err != nil {
+		return nil
+	}
+	kind, ok := icmpErrorType(message.Type)
+	if !ok {
+		return nil
+	}
+	quoted, ok := icmpErrorQuote(isIpv4, kind, received.data)
+	if !ok {
+		return nil
+	}
+	echo, ok := quotedEcho(isIpv4, quoted)
+	if !ok {
+		return nil
+	}
+	if len(echo.Data) >= 16 {
+		return m.trackers[BytesToInt(echo.Data[8:16])]
+	}
+	// only the echo header made it back. On an unprivileged socket the kernel
+	// gave all of our echo requests its own ID, so go by where it was sent
+	family := m.family(isIpv4)
+	if len(family) == 0 || !family[0].unprivileged {
+		return m.ids[echo.ID]
+	}
+	destination := quotedDestination(isIpv4, quoted)
+	for _, target := range family {
+		if destination.Equal(net.ParseIP(target.options.ipAddress)) && target.probes.lookup(echo.Seq) != nil {
+			return target
+		}
+	}
+	return nil
+}
+
+// drainReceivers waits for the receivers to stop, emptying their channels so none of them block.
+func drainReceivers(group *sync.WaitGroup, packetChannels map[bool]chan *PingPacket) {
+	done := make(chan bool)
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-packetChannels[true]:
+		case <-packetChannels[false]:
+		}
+	}
+}
+
+func closeConnections(connections map[bool]Transport) {
+	for _, connection := range connections {
+		connection.Close()
+	}
+}
+
+func (m *MultiPingerAgent) family(isIpv4 bool) []*PingerAgent {
+	var family []*PingerAgent
+	for _, target := range m.targets {
+		if target.options.isIpv4 == isIpv4 {
+			family = append(family, target)
+		}
+	}
+	return family
+}
+
+// finished is true once every destination has received its count, run
+// out of its timeout, or waited out the deadline after its last echo request.
+func (m *MultiPingerAgent) finished(now time.Time) bool {
+	for i := range m.targets {
+		if !m.done(i, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// done is true once a destination has received its count, run out of its
+// timeout, or waited out the deadline after its last echo request.
+func (m *MultiPingerAgent) done(i int, now time.Time) bool {
+	target, schedule := m.targets[i], m.schedules[i]
+	return (target.options.count > 0 && target.packetsRecieved >= target.options.count) || reached(now, schedule.timesOut) || reached(now, schedule.lastCall)
+}
+
+// after is d past start, or never (the zero time) if that doesn't fit in a time.Time.
+func after(start time.Time, d time.Duration) time.Time {
+	end := start.Add(d)
+	if d <= 0 || end.Before(start) {
+		return time.Time{}
+	}
+	return end
+}
+
+// reached is true once now is at or past a time, the zero time is never reached.
+func reached(now time.Time, at time.Time) bool {
+	return !at.IsZero() && !now.Before(at)
+}
+
+// echoTracker pulls the tracker out of an echo reply's data.
+func echoTracker(protocol int, data []byte) (int64, bool) {
+	message, err := icmp.ParseMessage(protocol, data)
+	if err != nil {
+		return 0, false
+	}
+	if message.Type != ipv4.ICMPTypeEchoReply && message.Type != ipv6.ICMPTypeEchoReply {
+		return 0, false
+	}
+	echo, ok := message.Body.(*icmp.Echo)
+	if !ok || len(echo.Data) < 16 {
+		return 0, false
+	}
+	return BytesToInt(echo.Data[8:16]), true
+}
@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Tests for the multi-target pinger
+
+func TestBuildMultiPinger(t *testing.T) {
+	tests := []struct {
+		desc         string
+		inAddresses  []string
+		expectedIpv4 int
+		expectedIpv6 int
+		expectedErr  bool
+	}{
+		{
+			desc:         "mixed-families",
+			inAddresses:  []string{"127.0.0.1", "::1", "10.0.0.1"},
+			expectedIpv4: 2,
+			expectedIpv6: 1,
+		},
+		{
+			desc:         "same-address-twice",
+			inAddresses:  []string{"127.0.0.1", "127.0.0.1"},
+			expectedIpv4: 2,
+		},
+		{
+			desc:        "invalid-address",
+			inAddresses: []string{"127.0.0.1", ""},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			m, err := BuildMultiPinger(&PresentOptions{count: 1}, tt.inAddresses)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("%s: expected error %v got %v", tt.desc, tt.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(m.family(true)) != tt.expectedIpv4 || len(m.family(false)) != tt.expectedIpv6 {
+				t.Errorf("%s: expected %d ipv4 & %d ipv6 targets, got %d & %d", tt.desc, tt.expectedIpv4,
+					tt.expectedIpv6, len(m.family(true)), len(m.family(false)))
+			}
+			// every target needs its own tracker to get its replies back
+			if len(m.trackers) != len(tt.inAddresses) {
+				t.Errorf("%s: expected %d distinct trackers got %d", tt.desc, len(tt.inAddresses), len(m.trackers))
+			}
+			for _, target := range m.targets {
+				if target.stopPing != m.stopPing {
+					t.Errorf("%s: %s does not share the stop channel", tt.desc, target.options.ipAddress)
+				}
+			}
+		})
+	}
+}
+
+func TestEchoTracker(t *testing.T) {
+	echoData := append(IntToBytes(0), IntToBytes(1299)...)
+	marshal := func(packetType icmp.Type, data []byte) []byte {
+		message := &icmp.Message{Type: packetType, Body: &icmp.Echo{ID: 1, Seq: 1, Data: data}}
+		b, _ := message.Marshal(nil)
+		return b
+	}
+	tests := []struct {
+		desc            string
+		inProtocol      int
+		in              []byte
+		expectedTracker int64
+		expectedOk      bool
+	}{
+		{
+			desc:            "ipv4-reply",
+			inProtocol:      1,
+			in:              marshal(ipv4.ICMPTypeEchoReply, echoData),
+			expectedTracker: 1299,
+			expectedOk:      true,
+		},
+		{
+			desc:            "ipv6-reply",
+			inProtocol:      58,
+			in:              marshal(ipv6.ICMPTypeEchoReply, echoData),
+			expectedTracker: 1299,
+			expectedOk:      true,
+		},
+		{
+			desc:       "echo-request",
+			inProtocol: 1,
+			in:         marshal(ipv4.ICMPTypeEcho, echoData),
+		},
+		{
+			desc:       "short-data",
+			inProtocol: 1,
+			in:         marshal(ipv4.ICMPTypeEchoReply, echoData[:10]),
+		},
+		{
+			desc:       "garbage",
+			inProtocol: 1,
+			in:         []byte{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tracker, ok := echoTracker(tt.inProtocol, tt.in); tracker != tt.expectedTracker || ok != tt.expectedOk {
+				t.Errorf("%s: expected %v %v got %v %v", tt.desc, tt.expectedTracker, tt.expectedOk, tracker, ok)
+			}
+		})
+	}
+}
+
+func TestMultiPingerAgent_Schedule(t *testing.T) {
+	fast := &PresentOptions{count: 2, interval: 100 * time.Millisecond, timeout: time.Minute, deadline: time.Second}
+	slow := &PresentOptions{count: 2, interval: time.Second, timeout: 10 * time.Second, deadline: time.Second}
+	_ = fast.ParseIPAddress("127.0.0.1")
+	_ = slow.ParseIPAddress("::1")
+	m, err := BuildMultiPingerFromOptions([]*PresentOptions{fast, slow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i, target := range m.targets {
+		m.schedules[i] = targetSchedule{nextSend: start.Add(target.options.interval), timesOut: after(start, target.options.timeout)}
+		target.packetsSent = 1
+	}
+	if wake, ok := m.nextWake(start); !ok || !wake.Equal(start.Add(100 * time.Millisecond)) {
+		t.Errorf("expected to wake for the fast target's interval, got %v", wake.Sub(start))
+	}
+	// the fast target sent everything, so the slow one is next
+	m.targets[0].packetsSent = 2
+	m.schedules[0].lastCall = start.Add(5 * time.Second)
+	if wake, ok := m.nextWake(start); !ok || !wake.Equal(start.Add(time.Second)) {
+		t.Errorf("expected to wake for the slow target's interval, got %v", wake.Sub(start))
+	}
+	// the fast target is done, its last call doesn't wake us up again
+	m.targets[1].packetsSent = 2
+	m.schedules[1].lastCall = start.Add(7 * time.Second)
+	if wake, ok := m.nextWake(start.Add(6 * time.Second)); !ok || !wake.Equal(start.Add(7*time.Second)) {
+		t.Errorf("expected to wake for the slow target's last call, got %v", wake.Sub(start))
+	}
+	if wake, ok := m.nextWake(start.Add(7 * time.Second)); ok {
+		t.Errorf("expected nothing left to wake up for, got %v", wake.Sub(start))
+	}
+	if m.finished(start.Add(5 * time.Second)) {
+		t.Errorf("the slow target isn't done before its timeout")
+	}
+	if !m.finished(start.Add(10 * time.Second)) {
+		t.Errorf("expected every target to be done once the slow one timed out")
+	}
+	if _, err := BuildMultiPingerFromOptions([]*PresentOptions{{count: 1}}); err == nil {
+		t.Errorf("expected an error for a target without an address")
+	}
+}
+
+func TestMultiPingerAgent_Owner(t *testing.T) {
+	tests := []struct {
+		desc           string
+		inUnprivileged bool
+		// how many bytes of the echo request the router quoted back
+		inQuoted int
+		inTarget int
+		inSent   bool
+		// -1 when no destination owns it
+		expectedTarget int
+	}{
+		{
+			desc:           "whole-echo",
+			inQuoted:       24,
+			inTarget:       1,
+			inSent:         true,
+			expectedTarget: 1,
+		},
+		{
+			desc:           "echo-header-by-id",
+			inQuoted:       8,
+			inTarget:       1,
+			inSent:         true,
+			expectedTarget: 1,
+		},
+		{
+			desc:           "unprivileged-echo-header-by-destination",
+			inUnprivileged: true,
+			inQuoted:       8,
+			inTarget:       1,
+			inSent:         true,
+			expectedTarget: 1,
+		},
+		{
+			desc:           "unprivileged-ipv6-echo-header-by-destination",
+			inUnprivileged: true,
+			inQuoted:       8,
+			inTarget:       2,
+			inSent:         true,
+			expectedTarget: 2,
+		},
+		{
+			desc:           "unprivileged-echo-header-never-sent",
+			inUnprivileged: true,
+			inQuoted:       8,
+			inTarget:       1,
+			expectedTarget: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			m, err := BuildMultiPinger(&PresentOptions{count: 1}, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, target := range m.targets {
+				target.unprivileged = tt.inUnprivileged
+				target.probes.sent(4, time.Now())
+			}
+			target := m.targets[tt.inTarget]
+			if !tt.inSent {
+				target.probes = probeTable{}
+			}
+			sender := BuildPinger(&target.options)
+			sender.packetId, sender.packetTracker = target.packetId, target.packetTracker
+			if tt.inUnprivileged {
+				// the kernel's ID for the socket, never one we pick
+				sender.packetId = 0xffff
+			}
+			received := timeExceeded(t, sender, 4, tt.inQuoted)
+			// where the echo request went, in the quoted IP header after the ICMP header
+			destination := net.ParseIP(target.options.ipAddress)
+			if target.options.isIpv4 {
+				copy(received.data[8+16:8+20], destination.To4())
+			} else {
+				copy(received.data[8+24:8+40], destination)
+			}
+			owner := m.owner(received, target.options.isIpv4)
+			if tt.expectedTarget < 0 && owner != nil {
+				t.Errorf("%s: expected no owner got %s", tt.desc, owner.options.ipAddress)
+			}
+			if tt.expectedTarget >= 0 && owner != m.targets[tt.expectedTarget] {
+				t.Errorf("%s: expected %s to own it got %v", tt.desc, m.targets[tt.expectedTarget].options.ipAddress, owner)
+			}
+		})
+	}
+}
@@ -3,46 +3,117 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// What can fill the echo request payload after the timestamp and tracker.
+const (
+	PatternPad       = "pad"
+	PatternRandom    = "random"
+	PatternIncrement = "increment"
+)
+
+const (
+	// the timestamp and the tracker
+	minPayloadSize = 16
+	// the biggest ICMP payload that fits in an ipv4 packet
+	maxPayloadSize = 65507
+	maxPadBytes    = 16
+)
+
+// MinUserInterval is the shortest interval a user other than root may ping at, like iputils.
+const MinUserInterval = 2 * time.Millisecond
+
+// MaxRate is the most echo requests per second a sweep may send, a microsecond apart.
+const MaxRate = 1000000
+
+// effectiveUID is who we are running as, swapped out in tests.
+var effectiveUID = os.Geteuid
+
 // interval in ms
 type PresentOptions struct {
 	count		         int
 	interval 		     time.Duration
 	timeout 			 time.Duration
 	deadline 			 time.Duration
+	// replies later than this after their echo request are flagged late
+	probeTimeout         time.Duration
 	ipAddress 			 string
 	isIpv4				 bool
 	logOutput            bool
+	// outgoing TTL / hop limit, 0 for the system default
 	timeToLive           int
+	// replies with a higher TTL than this are flagged
+	maxReceivedTTL       int
 	padding 	 		 string
+	padBytes             []byte
+	// echo request data bytes, and what fills them after the timestamp and tracker
+	payloadSize          int
+	payloadPattern       string
+	privileged           bool
+	// packets per second, for sweeps
+	rate                 int
+	// the TTLs a traceroute goes through, and how many echo requests it sends with each
+	firstHop             int
+	maxHops              int
+	queries              int
 }
 
-// In a more advanced version, these functions would have safeguards from
-// letting corrupted values enter the data structure.
+// These functions keep corrupted/invalid values from entering the data structure.
 
+// ParseCountFlag sets how many echo requests to send, 0 keeps sending until
+// the timeout or an interrupt.
 func (p *PresentOptions) ParseCountFlag(option int) error {
+	if option < 0 {
+		return errors.New("count cannot be negative")
+	}
 	p.count = option
 	return nil
 }
 
+// ParseIntervalFlag sets the time between echo requests, only root may go below MinUserInterval.
 func (p *PresentOptions) ParseIntervalFlag(option time.Duration) error {
+	if option <= 0 {
+		return errors.New("interval needs to be more than 0")
+	}
+	if option < MinUserInterval && effectiveUID() != 0 {
+		return fmt.Errorf("interval cannot be < %v unless you are root", MinUserInterval)
+	}
 	p.interval = option
 	return nil
 }
 
+// ParseTimeoutFlag sets how long the whole ping may take, 0 never times out.
 func (p *PresentOptions) ParseTimeoutFlag(option time.Duration) error {
+	if option < 0 {
+		return errors.New("timeout cannot be negative")
+	}
 	p.timeout = option
 	return nil
 }
 
+// ParseDeadlineFlag sets how long a read waits, and how long we wait for
+// replies after the last echo request.
 func (p *PresentOptions) ParseDeadlineFlag(option time.Duration) error {
+	if option <= 0 {
+		return errors.New("deadline needs to be more than 0")
+	}
 	p.deadline = option
 	return nil
 }
 
+// ParseProbeTimeoutFlag sets how long each echo request waits for its reply, 0 waits forever.
+func (p *PresentOptions) ParseProbeTimeoutFlag(option time.Duration) error {
+	if option < 0 {
+		return errors.New("probe timeout cannot be negative")
+	}
+	p.probeTimeout = option
+	return nil
+}
+
 
 func (p *PresentOptions) ParseIPAddress(option string) error {
 	var err error
@@ -67,25 +138,253 @@ func (p *PresentOptions) SetLogOption(option bool) error {
 	return nil
 }
 
+// ParseRateFlag sets how many echo requests per second a sweep may send in total.
+func (p *PresentOptions) ParseRateFlag(option int) error {
+	if option <= 0 {
+		return errors.New("rate needs to be at least 1 packet per second")
+	}
+	if option > MaxRate {
+		return fmt.Errorf("rate cannot be > %d packets per second", MaxRate)
+	}
+	p.rate = option
+	return nil
+}
+
+// ParseFirstHopFlag sets the TTL a traceroute starts at.
+func (p *PresentOptions) ParseFirstHopFlag(option int) error {
+	if option < 1 || option > 255 {
+		return errors.New("first hop needs to be between 1 and 255")
+	}
+	p.firstHop = option
+	return nil
+}
+
+// ParseMaxHopsFlag sets the TTL a traceroute gives up at.
+func (p *PresentOptions) ParseMaxHopsFlag(option int) error {
+	if option < 1 || option > 255 {
+		return errors.New("max hops needs to be between 1 and 255")
+	}
+	p.maxHops = option
+	return nil
+}
+
+// ParseQueriesFlag sets how many echo requests a traceroute sends with every TTL.
+func (p *PresentOptions) ParseQueriesFlag(option int) error {
+	if option < 1 || option > 10 {
+		return errors.New("queries needs to be between 1 and 10")
+	}
+	p.queries = option
+	return nil
+}
+
+// SetPrivilegedOption skips the unprivileged datagram socket and goes
+// straight to a raw ICMP socket.
+func (p *PresentOptions) SetPrivilegedOption(option bool) error {
+	p.privileged = option
+	return nil
+}
+
+// ParseTTL sets the TTL (hop limit on ipv6) our echo requests go out with,
+// 0 leaves the system default.
 func (p *PresentOptions) ParseTTL(option string) error {
-	result, err := strconv.Atoi(option)
+	result, err := parseTTLValue(option)
 	if err != nil {
 		return err
 	}
-	if result < 0 || result > 256 {
-		return errors.New("ttl cannot be > 256")
-	}
 	p.timeToLive = result
 	return nil
 }
 
+// ParseMaxTTL sets the threshold replies get flagged exceeded_max_ttl above.
+func (p *PresentOptions) ParseMaxTTL(option string) error {
+	result, err := parseTTLValue(option)
+	if err != nil {
+		return err
+	}
+	p.maxReceivedTTL = result
+	return nil
+}
+
+// TTLs are 8 bits on the wire.
+func parseTTLValue(option string) (int, error) {
+	result, err := strconv.Atoi(option)
+	if err != nil {
+		return 0, err
+	}
+	if result < 0 || result > 255 {
+		return 0, errors.New("ttl needs to be between 0 and 255")
+	}
+	return result, nil
+}
+
+// ParsePadding takes the pad pattern like iputils does: up to 16 bytes
+// written as hex digits, repeated to fill the payload.
 func (p *PresentOptions) ParsePadding(option string) error {
-	for _, char := range option {
-		// padding needs to be binary
-		if char != '0' && char != '1' {
-			return errors.New("Invalid Padding Format. -p option needs to be only 0s and 1s.\n")
+	if len(option) > 2*maxPadBytes {
+		return errors.New("Invalid Padding Format. -p option can be at most 16 bytes.\n")
+	}
+	// an odd digit at the end is a byte of its own, like iputils
+	var padBytes []byte
+	for i := 0; i < len(option); i += 2 {
+		end := i + 2
+		if end > len(option) {
+			end = len(option)
+		}
+		value, err := strconv.ParseUint(option[i:end], 16, 8)
+		if err != nil {
+			return errors.New("Invalid Padding Format. -p option needs to be hex digits.\n")
 		}
+		padBytes = append(padBytes, byte(value))
 	}
 	p.padding = option
+	p.padBytes = padBytes
+	return nil
+}
+
+// ParsePayloadSize sets how many data bytes go in every echo request (iputils -s),
+// the first 16 of them are our timestamp and tracker.
+func (p *PresentOptions) ParsePayloadSize(option int) error {
+	if option < minPayloadSize {
+		return fmt.Errorf("packet size needs to be at least %d bytes", minPayloadSize)
+	}
+	if option > maxPayloadSize {
+		return fmt.Errorf("packet size cannot be > %d bytes", maxPayloadSize)
+	}
+	p.payloadSize = option
 	return nil
-}
\ No newline at end of file
+}
+
+// ParsePayloadPattern sets what fills the payload after the timestamp and
+// tracker: the -p pad pattern, random bytes, or each byte's offset.
+func (p *PresentOptions) ParsePayloadPattern(option string) error {
+	switch option {
+	case PatternPad, PatternRandom, PatternIncrement:
+		p.payloadPattern = option
+		return nil
+	}
+	return fmt.Errorf("unknown payload pattern %s, it can be %s, %s or %s", option, PatternPad, PatternRandom, PatternIncrement)
+}
+
+// Options are the settings of a ping for library users, validated all at
+// once instead of one Parse* call at a time. Start from DefaultOptions(),
+// the zero value of most fields isn't valid.
+type Options struct {
+	// an ipv4 or ipv6 address or a hostname, can be left empty for BuildMultiPinger and BuildSweeper
+	Destination string
+	// how many echo requests to send, 0 keeps sending until the timeout or an interrupt
+	Count int
+	// between echo requests, at least MinUserInterval unless we are root
+	Interval time.Duration
+	// how long the whole ping may take, 0 never times out
+	Timeout time.Duration
+	// how long we wait for replies after the last echo request
+	Deadline time.Duration
+	// how long each echo request waits for its reply, 0 waits forever
+	ProbeTimeout time.Duration
+	// outgoing TTL / hop limit, 0 for the system default
+	TTL int
+	// replies with a higher TTL than this are flagged
+	MaxTTL int
+	// up to 16 bytes as hex digits, repeated to fill the payload
+	Pad string
+	// echo request data bytes, the first 16 of them are our timestamp and tracker
+	Size int
+	// PatternPad, PatternRandom or PatternIncrement
+	Pattern string
+	// skip the unprivileged datagram socket
+	Privileged bool
+	// packets per second, for sweeps
+	Rate int
+	// the TTLs a traceroute goes through, from FirstHop up to MaxHops, and
+	// how many echo requests it sends with each of them
+	FirstHop int
+	MaxHops  int
+	Queries  int
+}
+
+// DefaultOptions are the settings ping uses when no flags are given.
+func DefaultOptions() Options {
+	return Options{
+		Count:        int(^uint(0) >> 1),
+		Interval:     time.Second,
+		Timeout:      100000 * time.Second,
+		Deadline:     time.Second,
+		ProbeTimeout: 10 * time.Second,
+		MaxTTL:       255,
+		Pad:          "00000000",
+		Size:         56,
+		Pattern:      PatternPad,
+		Rate:         100,
+		FirstHop:     1,
+		MaxHops:      30,
+		Queries:      3,
+	}
+}
+
+// OptionError is an Options field with a value that isn't allowed.
+type OptionError struct {
+	Option string
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Option, strings.TrimSpace(e.Err.Error()))
+}
+
+func (e *OptionError) Unwrap() error {
+	return e.Err
+}
+
+// OptionErrors is every problem Validate found, in the order of the fields.
+type OptionErrors []*OptionError
+
+func (e OptionErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Validate checks every field, giving back all of the problems as OptionErrors.
+func (o Options) Validate() error {
+	_, err := BuildOptions(o)
+	return err
+}
+
+// BuildOptions turns Options into what BuildPinger, BuildMultiPinger,
+// BuildSweeper and BuildTraceroute take, or gives back every problem with them as OptionErrors.
+func BuildOptions(o Options) (*PresentOptions, error) {
+	p := &PresentOptions{}
+	var errs OptionErrors
+	check := func(option string, err error) {
+		if err != nil {
+			errs = append(errs, &OptionError{Option: option, Err: err})
+		}
+	}
+	if o.Destination != "" {
+		check("Destination", p.ParseIPAddress(o.Destination))
+	}
+	check("Count", p.ParseCountFlag(o.Count))
+	check("Interval", p.ParseIntervalFlag(o.Interval))
+	check("Timeout", p.ParseTimeoutFlag(o.Timeout))
+	check("Deadline", p.ParseDeadlineFlag(o.Deadline))
+	check("ProbeTimeout", p.ParseProbeTimeoutFlag(o.ProbeTimeout))
+	check("TTL", p.ParseTTL(strconv.Itoa(o.TTL)))
+	check("MaxTTL", p.ParseMaxTTL(strconv.Itoa(o.MaxTTL)))
+	check("Pad", p.ParsePadding(o.Pad))
+	check("Size", p.ParsePayloadSize(o.Size))
+	check("Pattern", p.ParsePayloadPattern(o.Pattern))
+	check("Rate", p.ParseRateFlag(o.Rate))
+	check("FirstHop", p.ParseFirstHopFlag(o.FirstHop))
+	check("MaxHops", p.ParseMaxHopsFlag(o.MaxHops))
+	check("Queries", p.ParseQueriesFlag(o.Queries))
+	if len(errs) == 0 && p.firstHop > p.maxHops {
+		check("FirstHop", errors.New("first hop can't be past max hops"))
+	}
+	_ = p.SetPrivilegedOption(o.Privileged)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return p, nil
+}
@@ -1,7 +1,9 @@
 package agent
 
 import (
+	"bytes"
 	"errors"
+	"strings"
 	"testing"
 	"time"
 )
@@ -59,6 +61,9 @@ func TestPresentOptions_ParseIntervalFlag(t *testing.T) {
 			expected: nil,
 		},
 	}
+	// below MinUserInterval is only allowed for root
+	defer func(uid func() int) { effectiveUID = uid }(effectiveUID)
+	effectiveUID = func() int { return 0 }
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t* testing.T) {
 			if err := tt.options.ParseIntervalFlag(tt.inDuration); err != tt.expected || tt.inDuration != tt.options.interval {
@@ -222,21 +227,40 @@ func TestPresentOptions_ParseTTL(t *testing.T) {
 			expectedErr: errors.New(""),
 		},
 		{
-			desc: "ttl-above-256",
+			desc: "ttl-above-255",
 			inTTL: "1055",
 			expectedTTL: 1055,
 			options: PresentOptions{},
-			expectedErr: errors.New("ttl cannot be > 256"),
+			expectedErr: errors.New("ttl needs to be between 0 and 255"),
+		},
+		{
+			desc: "ttl-256",
+			inTTL: "256",
+			expectedTTL: 256,
+			options: PresentOptions{},
+			expectedErr: errors.New("ttl needs to be between 0 and 255"),
+		},
+		{
+			desc: "ttl-minus-1",
+			inTTL: "-1",
+			expectedTTL: -1,
+			options: PresentOptions{},
+			expectedErr: errors.New("ttl needs to be between 0 and 255"),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
-			if err := tt.options.ParseTTL(tt.inTTL); (err != nil && tt.expectedErr == nil) || (err == nil && tt.expectedErr != nil) || tt.options.timeToLive != tt.expectedTTL {
+			err := tt.options.ParseTTL(tt.inTTL)
+			if (err != nil && tt.expectedErr == nil) || (err == nil && tt.expectedErr != nil) || tt.options.timeToLive != tt.expectedTTL {
 				//fmt.Printf("%v %v", tt.inTTL, tt.options.timeToLive)
 				if !(tt.expectedErr != nil && err != nil) {
 					t.Errorf("%s: expected ttl & error %v %v, got ttl & error %v %v", tt.desc, tt.inTTL, tt.expectedErr, tt.options.timeToLive, err)
 				}
 			}
+			// out of range says what the range is, both ways
+			if err != nil && tt.expectedErr != nil && tt.expectedErr.Error() != "" && err.Error() != tt.expectedErr.Error() {
+				t.Errorf("%s: expected error %q got %q", tt.desc, tt.expectedErr, err)
+			}
 		})
 	}
 }
@@ -257,8 +281,20 @@ func TestPresentOptions_ParsePadding(t *testing.T) {
 		{
 			desc: "invalid-padding",
 			options: PresentOptions{},
-			inOption: "0101f",
-			expectedError: errors.New("Invalid Padding Format. -p option needs to be only 0s and 1s.\n"),
+			inOption: "0101g",
+			expectedError: errors.New("Invalid Padding Format. -p option needs to be hex digits.\n"),
+		},
+		{
+			desc: "hex-padding",
+			options: PresentOptions{},
+			inOption: "deadbeef",
+			expectedError: nil,
+		},
+		{
+			desc: "padding-too-long",
+			options: PresentOptions{},
+			inOption: "000102030405060708090a0b0c0d0e0f10",
+			expectedError: errors.New("Invalid Padding Format. -p option can be at most 16 bytes.\n"),
 		},
 		{
 			desc: "valid-padding",
@@ -276,4 +312,352 @@ func TestPresentOptions_ParsePadding(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestPresentOptions_ParseRateFlag(t *testing.T) {
+	tests := []struct {
+		desc string
+		inRate int
+		expectedRate int
+		expectedErr error
+	}{
+		{
+			desc: "valid-rate",
+			inRate: 50,
+			expectedRate: 50,
+			expectedErr: nil,
+		},
+		{
+			desc: "zero-rate",
+			inRate: 0,
+			expectedRate: 0,
+			expectedErr: errors.New("rate needs to be at least 1 packet per second"),
+		},
+		{
+			desc: "negative-rate",
+			inRate: -5,
+			expectedRate: 0,
+			expectedErr: errors.New("rate needs to be at least 1 packet per second"),
+		},
+		{
+			desc: "too-fast",
+			inRate: 2000000000,
+			expectedRate: 0,
+			expectedErr: errors.New("rate cannot be > 1000000 packets per second"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := PresentOptions{}
+			if err := options.ParseRateFlag(tt.inRate); (err != nil) != (tt.expectedErr != nil) || options.rate != tt.expectedRate {
+				t.Errorf("%s: expected rate & error %v %v, got rate & error %v %v", tt.desc, tt.expectedRate, tt.expectedErr, options.rate, err)
+			}
+		})
+	}
+}
+
+func TestPresentOptions_ParseTracerouteFlags(t *testing.T) {
+	tests := []struct {
+		desc string
+		inFirstHop int
+		inMaxHops int
+		inQueries int
+		expectedErrs int
+	}{
+		{
+			desc: "defaults",
+			inFirstHop: 1,
+			inMaxHops: 30,
+			inQueries: 3,
+		},
+		{
+			desc: "the-widest",
+			inFirstHop: 255,
+			inMaxHops: 255,
+			inQueries: 10,
+		},
+		{
+			desc: "zeros",
+			expectedErrs: 3,
+		},
+		{
+			desc: "too-many",
+			inFirstHop: 256,
+			inMaxHops: 1000,
+			inQueries: 11,
+			expectedErrs: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := PresentOptions{}
+			var errs int
+			for _, err := range []error{options.ParseFirstHopFlag(tt.inFirstHop), options.ParseMaxHopsFlag(tt.inMaxHops),
+				options.ParseQueriesFlag(tt.inQueries)} {
+				if err != nil {
+					errs++
+				}
+			}
+			if errs != tt.expectedErrs || (errs == 0 && (options.firstHop != tt.inFirstHop || options.maxHops != tt.inMaxHops ||
+				options.queries != tt.inQueries)) {
+				t.Errorf("%s: expected %d errors got %d and %+v", tt.desc, tt.expectedErrs, errs, options)
+			}
+		})
+	}
+}
+
+func TestPresentOptions_ParseProbeTimeoutFlag(t *testing.T) {
+	tests := []struct {
+		desc string
+		inDuration time.Duration
+		expectedDuration time.Duration
+		expectedErr error
+	}{
+		{
+			desc: "valid-timeout",
+			inDuration: time.Second,
+			expectedDuration: time.Second,
+			expectedErr: nil,
+		},
+		{
+			desc: "wait-forever",
+			inDuration: 0,
+			expectedDuration: 0,
+			expectedErr: nil,
+		},
+		{
+			desc: "negative-timeout",
+			inDuration: -time.Second,
+			expectedDuration: 0,
+			expectedErr: errors.New("probe timeout cannot be negative"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := PresentOptions{}
+			if err := options.ParseProbeTimeoutFlag(tt.inDuration); (err != nil) != (tt.expectedErr != nil) || options.probeTimeout != tt.expectedDuration {
+				t.Errorf("%s: expected duration & error %v %v, got duration & error %v %v", tt.desc, tt.expectedDuration, tt.expectedErr, options.probeTimeout, err)
+			}
+		})
+	}
+}
+
+func TestPresentOptions_ParseMaxTTL(t *testing.T) {
+	tests := []struct {
+		desc string
+		inTTL string
+		expectedTTL int
+		expectedErr error
+	}{
+		{
+			desc: "valid-ttl",
+			inTTL: "64",
+			expectedTTL: 64,
+			expectedErr: nil,
+		},
+		{
+			desc: "bad-string",
+			inTTL: "foo",
+			expectedTTL: 0,
+			expectedErr: errors.New(""),
+		},
+		{
+			desc: "ttl-above-255",
+			inTTL: "300",
+			expectedTTL: 0,
+			expectedErr: errors.New("ttl needs to be between 0 and 255"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := PresentOptions{}
+			if err := options.ParseMaxTTL(tt.inTTL); (err != nil) != (tt.expectedErr != nil) || options.maxReceivedTTL != tt.expectedTTL || options.timeToLive != 0 {
+				t.Errorf("%s: expected max ttl & error %v %v, got max ttl & error %v %v", tt.desc, tt.expectedTTL, tt.expectedErr, options.maxReceivedTTL, err)
+			}
+		})
+	}
+}
+
+func TestPresentOptions_ParsePaddingBytes(t *testing.T) {
+	tests := []struct {
+		desc string
+		inOption string
+		expected []byte
+	}{
+		{
+			desc: "empty",
+			inOption: "",
+			expected: nil,
+		},
+		{
+			desc: "even",
+			inOption: "ff00Ab",
+			expected: []byte{0xff, 0x00, 0xab},
+		},
+		{
+			desc: "odd",
+			inOption: "0102f",
+			expected: []byte{0x01, 0x02, 0x0f},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := PresentOptions{}
+			if err := options.ParsePadding(tt.inOption); err != nil || !bytes.Equal(options.padBytes, tt.expected) {
+				t.Errorf("%s: expected pad bytes %v got %v %v", tt.desc, tt.expected, options.padBytes, err)
+			}
+		})
+	}
+}
+
+func TestPresentOptions_ParsePayloadSize(t *testing.T) {
+	tests := []struct {
+		desc string
+		inSize int
+		expectedSize int
+		expectedErr bool
+	}{
+		{
+			desc: "iputils-default",
+			inSize: 56,
+			expectedSize: 56,
+		},
+		{
+			desc: "just-the-timestamp-and-tracker",
+			inSize: 16,
+			expectedSize: 16,
+		},
+		{
+			desc: "too-small",
+			inSize: 15,
+			expectedErr: true,
+		},
+		{
+			desc: "too-big",
+			inSize: 65508,
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := PresentOptions{}
+			if err := options.ParsePayloadSize(tt.inSize); (err != nil) != tt.expectedErr || options.payloadSize != tt.expectedSize {
+				t.Errorf("%s: expected size & error %v %v, got size & error %v %v", tt.desc, tt.expectedSize, tt.expectedErr, options.payloadSize, err)
+			}
+		})
+	}
+}
+
+func TestPresentOptions_ParsePayloadPattern(t *testing.T) {
+	tests := []struct {
+		desc string
+		inPattern string
+		expectedErr bool
+	}{
+		{desc: "pad", inPattern: PatternPad},
+		{desc: "random", inPattern: PatternRandom},
+		{desc: "increment", inPattern: PatternIncrement},
+		{desc: "unknown", inPattern: "fooey", expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := PresentOptions{}
+			if err := options.ParsePayloadPattern(tt.inPattern); (err != nil) != tt.expectedErr || (err == nil && options.payloadPattern != tt.inPattern) {
+				t.Errorf("%s: expected error %v got %v %v", tt.desc, tt.expectedErr, options.payloadPattern, err)
+			}
+		})
+	}
+}
+
+func TestBuildOptions(t *testing.T) {
+	tests := []struct {
+		desc            string
+		inUID           int
+		inOptions       func(o *Options)
+		expectedOptions []string
+	}{
+		{
+			desc:      "defaults",
+			inUID:     1000,
+			inOptions: func(o *Options) {},
+		},
+		{
+			desc:  "root-may-flood",
+			inUID: 0,
+			inOptions: func(o *Options) {
+				o.Interval = time.Millisecond
+			},
+		},
+		{
+			desc:  "user-may-not-flood",
+			inUID: 1000,
+			inOptions: func(o *Options) {
+				o.Interval = time.Millisecond
+			},
+			expectedOptions: []string{"Interval"},
+		},
+		{
+			desc:  "everything-wrong",
+			inUID: 0,
+			inOptions: func(o *Options) {
+				o.Count = -1
+				o.Interval = 0
+				o.Timeout = -time.Second
+				o.Deadline = 0
+				o.ProbeTimeout = -time.Second
+				o.TTL = 256
+				o.MaxTTL = -1
+				o.Pad = "xyz"
+				o.Size = 8
+				o.Pattern = "zeros"
+				o.Rate = 0
+				o.FirstHop = 0
+				o.MaxHops = 256
+				o.Queries = 0
+			},
+			expectedOptions: []string{"Count", "Interval", "Timeout", "Deadline", "ProbeTimeout", "TTL", "MaxTTL", "Pad", "Size",
+				"Pattern", "Rate", "FirstHop", "MaxHops", "Queries"},
+		},
+		{
+			desc:  "first-hop-past-max-hops",
+			inUID: 1000,
+			inOptions: func(o *Options) {
+				o.FirstHop = 10
+				o.MaxHops = 5
+			},
+			expectedOptions: []string{"FirstHop"},
+		},
+	}
+	defer func(uid func() int) { effectiveUID = uid }(effectiveUID)
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			effectiveUID = func() int { return tt.inUID }
+			settings := DefaultOptions()
+			tt.inOptions(&settings)
+			options, err := BuildOptions(settings)
+			if validateErr := settings.Validate(); (validateErr == nil) != (err == nil) {
+				t.Errorf("%s: Validate gave back %v, BuildOptions %v", tt.desc, validateErr, err)
+			}
+			if len(tt.expectedOptions) == 0 {
+				if err != nil || options == nil {
+					t.Fatalf("%s: expected options got %v", tt.desc, err)
+				}
+				if options.interval != settings.Interval || options.count != settings.Count || options.payloadSize != settings.Size {
+					t.Errorf("%s: unexpected options %+v", tt.desc, options)
+				}
+				return
+			}
+			errs, ok := err.(OptionErrors)
+			if options != nil || !ok {
+				t.Fatalf("%s: expected OptionErrors got %v", tt.desc, err)
+			}
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Option)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.expectedOptions, ",") {
+				t.Errorf("%s: expected errors for %v got %v", tt.desc, tt.expectedOptions, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+)
+
+// CorruptedReplyPacket is an echo reply whose payload came back different
+// from what we sent, e.g. mangled by a middlebox or a flaky link.
+type CorruptedReplyPacket struct {
+	Destination        string
+	ICMPSequenceNumber int
+	// the first byte that differs, and what it should have been
+	Offset   int
+	Expected byte
+	Got      byte
+	// how many bytes differ in all, and both lengths (a truncated reply only differs in length)
+	MismatchedBytes int
+	ExpectedLength  int
+	GotLength       int
+}
+
+// payload builds the data of the echo request with the given sequence: our
+// timestamp and tracker, then the fill pattern up to size data bytes (the
+// payload size (-s) unless the echo request has a size of its own), at
+// least the timestamp and tracker.
+func (p *PingerAgent) payload(sequence int, sentAt time.Time, size int) []byte {
+	if size < minPayloadSize {
+		size = minPayloadSize
+	}
+	data := make([]byte, size)
+	copy(data, TimeToBytes(sentAt))
+	copy(data[8:], IntToBytes(p.packetTracker))
+	p.fillPayload(data, sequence)
+	return data
+}
+
+// fillPayload fills everything after the timestamp and tracker. Like iputils,
+// the pad pattern and the increment pattern line up with the start of the
+// data, as if the timestamp and tracker were written over them.
+func (p *PingerAgent) fillPayload(data []byte, sequence int) {
+	switch p.options.payloadPattern {
+	case PatternRandom:
+		// seeded by the tracker and the 16 bit sequence, so the bytes can be
+		// rebuilt from the reply alone
+		if p.random == nil {
+			p.random = rand.New(&fillSource{})
+		}
+		p.random.Seed(p.packetTracker ^ int64(sequence&0xffff))
+		p.random.Read(data[minPayloadSize:])
+	case PatternIncrement:
+		for i := minPayloadSize; i < len(data); i++ {
+			data[i] = byte(i)
+		}
+	default:
+		pad := p.options.padBytes
+		if len(pad) == 0 {
+			return
+		}
+		for i := minPayloadSize; i < len(data); i++ {
+			data[i] = pad[i%len(pad)]
+		}
+	}
+}
+
+// fillSource is a splitmix64 rand.Source for the random pattern. Unlike
+// rand.NewSource's it costs nothing to seed, so one of them can be reseeded
+// for every echo request we send and every reply we check.
+type fillSource struct {
+	state uint64
+}
+
+func (s *fillSource) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *fillSource) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *fillSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// payloadSize is how many data bytes our echo requests carry, at least the timestamp and tracker.
+func (p *PingerAgent) payloadSize() int {
+	if p.options.payloadSize < minPayloadSize {
+		return minPayloadSize
+	}
+	return p.options.payloadSize
+}
+
+// receiveBufferSize fits a whole echo reply, or an ICMP error quoting a whole
+// echo request (ICMP header, the biggest IP header and the request itself).
+func (p *PingerAgent) receiveBufferSize() int {
+	size := p.payloadSize() + 8 + 60 + 8
+	if size < 1024 {
+		return 1024
+	}
+	return size
+}
+
+// verifyPayload compares an echoed payload against what we sent with that
+// sequence, or gives back nil if it matches. The echoed timestamp is taken
+// as it is, logPacket checks it against the probe table on its own.
+func (p *PingerAgent) verifyPayload(data []byte, sequence int) *CorruptedReplyPacket {
+	size := p.payloadSize()
+	// echo requests can be sent with a size of their own
+	if probe := p.probes.lookup(sequence); probe != nil && probe.size > 0 {
+		size = probe.size
+	}
+	expected := p.payload(sequence, BytesToTime(data[:8]), size)
+	var corrupted *CorruptedReplyPacket
+	for offset := 0; offset < len(expected) || offset < len(data); offset++ {
+		if offset < len(expected) && offset < len(data) && expected[offset] == data[offset] {
+			continue
+		}
+		if corrupted == nil {
+			corrupted = &CorruptedReplyPacket{
+				Destination:        p.options.ipAddress,
+				ICMPSequenceNumber: sequence,
+				Offset:             offset,
+				ExpectedLength:     len(expected),
+				GotLength:          len(data),
+			}
+			if offset < len(expected) {
+				corrupted.Expected = expected[offset]
+			}
+			if offset < len(data) {
+				corrupted.Got = data[offset]
+			}
+		}
+		if offset < len(expected) && offset < len(data) {
+			corrupted.MismatchedBytes++
+		}
+	}
+	return corrupted
+}
+
+// logCorruptedReply counts a corrupted reply and initiates its callback.
+func (p *PingerAgent) logCorruptedReply(corrupted *CorruptedReplyPacket) {
+	p.numCorrupted++
+	corruptedHandler := p.OnCorruptedReply
+	if corruptedHandler != nil {
+		corruptedHandler(corrupted)
+	}
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Tests for building the echo request payload
+
+func TestPingerAgent_Payload(t *testing.T) {
+	sentAt := time.Unix(0, 1587168212973301702)
+	tests := []struct {
+		desc         string
+		options      PresentOptions
+		expectedFill []byte
+	}{
+		{
+			desc:         "default-size",
+			options:      PresentOptions{},
+			expectedFill: []byte{},
+		},
+		{
+			desc:         "no-pad-is-zeros",
+			options:      PresentOptions{payloadSize: 20},
+			expectedFill: []byte{0, 0, 0, 0},
+		},
+		{
+			desc:         "pad-lines-up-with-the-data",
+			options:      PresentOptions{payloadSize: 22, padBytes: []byte{0xaa, 0xbb, 0xcc}},
+			expectedFill: []byte{0xbb, 0xcc, 0xaa, 0xbb, 0xcc, 0xaa},
+		},
+		{
+			desc:         "increment",
+			options:      PresentOptions{payloadSize: 20, payloadPattern: PatternIncrement},
+			expectedFill: []byte{16, 17, 18, 19},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := &PingerAgent{options: tt.options, packetTracker: 1299}
+			data := p.payload(3, sentAt, p.payloadSize())
+			if !bytes.Equal(data[:8], TimeToBytes(sentAt)) || BytesToInt(data[8:16]) != 1299 || !bytes.Equal(data[16:], tt.expectedFill) {
+				t.Errorf("%s: expected fill %v got %v", tt.desc, tt.expectedFill, data)
+			}
+		})
+	}
+}
+
+func TestPingerAgent_RandomPayload(t *testing.T) {
+	p := &PingerAgent{options: PresentOptions{payloadSize: 1000, payloadPattern: PatternRandom}, packetTracker: 1299}
+	sentAt := time.Now()
+	size := p.payloadSize()
+	first, again, next := p.payload(3, sentAt, size), p.payload(3, sentAt, size), p.payload(4, sentAt, size)
+	// the same sequence has to give the same bytes so they can be checked,
+	// the wire only has 16 bits of it
+	wrapped := p.payload(65536+3, sentAt, size)
+	if !bytes.Equal(first, again) || !bytes.Equal(first, wrapped) || bytes.Equal(first[16:], next[16:]) || bytes.Equal(first[16:], make([]byte, 984)) {
+		t.Errorf("random payloads should only depend on the 16 bit sequence")
+	}
+}
+
+func TestPingerAgent_ReceiveBufferSize(t *testing.T) {
+	tests := []struct {
+		desc     string
+		inSize   int
+		expected int
+	}{
+		{desc: "small", inSize: 56, expected: 1024},
+		{desc: "jumbo", inSize: 9000, expected: 9076},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := &PingerAgent{options: PresentOptions{payloadSize: tt.inSize}}
+			if size := p.receiveBufferSize(); size != tt.expected {
+				t.Errorf("%s: expected %v got %v", tt.desc, tt.expected, size)
+			}
+		})
+	}
+}
+
+func TestPingerAgent_VerifyPayload(t *testing.T) {
+	sentAt := time.Unix(0, 1587168212973301702)
+	tests := []struct {
+		desc             string
+		pattern          string
+		inSize           int
+		mangle           func(data []byte) []byte
+		expectedOffset   int
+		expectedMismatch int
+		expectedOK       bool
+	}{
+		{
+			desc:       "untouched",
+			pattern:    PatternIncrement,
+			mangle:     func(data []byte) []byte { return data },
+			expectedOK: true,
+		},
+		{
+			desc:    "restamped",
+			pattern: PatternIncrement,
+			mangle: func(data []byte) []byte {
+				copy(data, TimeToBytes(sentAt.Add(time.Hour)))
+				return data
+			},
+			expectedOK: true,
+		},
+		{
+			desc:    "flipped-bytes",
+			pattern: PatternIncrement,
+			mangle: func(data []byte) []byte {
+				data[20] ^= 0xff
+				data[30] ^= 0x01
+				return data
+			},
+			expectedOffset:   20,
+			expectedMismatch: 2,
+		},
+		{
+			desc:           "truncated",
+			pattern:        PatternPad,
+			mangle:         func(data []byte) []byte { return data[:24] },
+			expectedOffset: 24,
+		},
+		{
+			desc:       "its-own-size",
+			pattern:    PatternIncrement,
+			inSize:     1472,
+			mangle:     func(data []byte) []byte { return data },
+			expectedOK: true,
+		},
+		{
+			desc:           "its-own-size-truncated",
+			pattern:        PatternIncrement,
+			inSize:         1472,
+			mangle:         func(data []byte) []byte { return data[:56] },
+			expectedOffset: 56,
+		},
+		{
+			desc:    "random-fill",
+			pattern: PatternRandom,
+			mangle: func(data []byte) []byte {
+				data[40]++
+				return data
+			},
+			expectedOffset:   40,
+			expectedMismatch: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := &PingerAgent{options: PresentOptions{payloadSize: 56, payloadPattern: tt.pattern, padBytes: []byte{0xab}}, packetTracker: 1299}
+			p.probes.sent(7, sentAt)
+			data := p.payload(7, sentAt, p.payloadSize())
+			if tt.inSize > 0 {
+				p.probes.carried(7, tt.inSize)
+				data = p.payload(7, sentAt, tt.inSize)
+			}
+			corrupted := p.verifyPayload(tt.mangle(data), 7)
+			if tt.expectedOK {
+				if corrupted != nil {
+					t.Errorf("%s: expected a match got %+v", tt.desc, corrupted)
+				}
+				return
+			}
+			if corrupted == nil || corrupted.Offset != tt.expectedOffset || corrupted.MismatchedBytes != tt.expectedMismatch {
+				t.Errorf("%s: expected offset %v and %v mismatched bytes got %+v", tt.desc, tt.expectedOffset, tt.expectedMismatch, corrupted)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package agent
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+	"math/rand"
 	"net"
 	"sync"
 	"syscall"
@@ -22,19 +24,63 @@ type PingerAgent struct {
 	packetsRecieved int
 	// When a user interrupts the program with ctrl+c,
 	// a signal is sent.
-	stopPing chan bool
+	stopPing *stopSignal
+	// why the receiver gave up, if it did
+	receiveErr error
 	// to make sure the packets we receive track with the packets we send.
 	packetId int
 	packetTracker int64
 	sequence int
-	// our logPacket() function logs the packet's individual RTT in roundTripTimes[]
-	roundTripTimes []time.Duration
+	// the -pattern random bytes, reseeded for every sequence
+	random *rand.Rand
+	// our logPacket() function logs the packet's individual RTT in roundTripTimes,
+	// which only keeps running statistics so week-long pings don't grow forever.
+	roundTripTimes RTTStatistics
+	// delay variation over the replies (RFC 3550 jitter, RFC 5481 IPDV)
+	jitter JitterEstimator
+	// every echo request we sent lately, to catch duplicated, reordered and late replies
+	probes probeTable
+	numDuplicates int
+	numUntracked int
+	numReordered int
+	numLate int
+	numTimedOut int
+	numTimeExceeded int
+	numUnreachable int
+	numRedirects int
+	numParameterProblems int
+	numPacketTooBig int
+	numCorrupted int
+	numStampMismatches int
+	maxReorderDistance int
 	// time to live
 	maxTTL int
 	numExceededTTL int
+	// set when we are on an unprivileged datagram (udp4/udp6) ICMP socket,
+	// in which case the kernel owns the echo ID.
+	unprivileged bool
 	// Callbacks to the main function to print statistics.
 	OnEchoComplete func(p *PingPacket, exceededTTL bool)
+	// an echo request went out, with the 16 bit icmp_seq its reply will carry
+	OnEchoSent func(sequence int, destination string)
+	// a router (or the destination) answered one of our echo requests with an
+	// ICMP error: Destination Unreachable, Time Exceeded, Redirect, Parameter
+	// Problem or Packet Too Big
+	OnICMPError func(e *ICMPErrorPacket)
+	// an echo reply's payload came back different from what we sent
+	OnCorruptedReply func(c *CorruptedReplyPacket)
+	// a probe's timeout (-W) passed without a reply
+	OnEchoTimeout func(sequence int, destination string)
+	// the same timeout, as a packet with no reply: only the destination, sequence and SentAt are set
+	OnEchoLost func(p *PingPacket)
+	// something went wrong after Run started, but the ping carries on
+	OnError func(err error)
 	OnProcessComplete func (c * CompletedPingStatistics)
+	// opens the Transport of an address family instead of an ICMP socket,
+	// e.g. a SimulatedNetwork's for tests
+	Listen func(isIpv4 bool) (Transport, error)
+	// where the time, timers and tickers come from, the real time if nil
+	Clock Clock
 }
 
 // PingPacket represents an individual ICMP packet.
@@ -45,192 +91,310 @@ type PingPacket struct {
 	ICMPSequenceNumber int
 	TimeToLive         int
 	NumberOfBytes      int
+	// RFC 3550 interarrival jitter, including this reply
+	Jitter             time.Duration
+	// DUP! - this sequence was already answered
+	Duplicate          bool
+	// a sequence we don't remember sending (it fell out of the window, or
+	// never went out), so it can't count as an answer
+	Untracked          bool
+	// a later sequence was answered first (RFC 4737)
+	Reordered          bool
+	// arrived after the per-probe timeout
+	Late               bool
+	// the echoed payload differs from what we sent
+	Corrupted          bool
+	// the echoed timestamp isn't the one we sent with this sequence, the
+	// round trip time was still timed from our own send time
+	StampMismatch      bool
+	// when the echo request went out and its reply was received
+	SentAt             time.Time
+	ReceivedAt         time.Time
+	// where the times the round trip time was measured between came from:
+	// the kernel's timestamps leave out our own scheduling delays
+	SendTimestamp      TimestampSource
+	ReceiveTimestamp   TimestampSource
 	data               []byte
+	// set once logPacket() matched it to one of our echo requests
+	echoed             bool
 }
 
 // The callback OnProcessComplete() takes in this struct
 // to print all of the statistics.
 type CompletedPingStatistics struct {
 	AverageRTT time.Duration
+	// iputils-style spread, mdev is the population standard deviation
+	MinRTT time.Duration
+	MaxRTT time.Duration
+	StdDevRTT time.Duration
+	MedianRTT time.Duration
+	P90RTT time.Duration
+	P95RTT time.Duration
+	P99RTT time.Duration
+	// a snapshot of the streaming statistics behind the numbers above,
+	// which can be merged with other pingers' (e.g. to combine targets)
+	RoundTripTimes *RTTStatistics
+	// delay variation: RFC 3550 interarrival jitter, RFC 5481 IPDV (mean and
+	// max size of the difference between consecutive RTTs) and PDV (99th
+	// percentile RTT above the minimum RTT)
+	Jitter time.Duration
+	MeanIPDV time.Duration
+	MaxIPDV time.Duration
+	PDV99 time.Duration
 	PacketsReceived int
 	PacketsLost int
 	PercentReceived float64
 	PercentLost float64
 	Destination string
 	ExceededTTL int
+	// duplicates and untracked replies are not part of PacketsReceived,
+	// reordered and late replies are. MaxReorderDistance is how many sequences
+	// behind the newest answered one the worst reordered reply was.
+	DuplicateReplies int
+	UntrackedReplies int
+	ReorderedReplies int
+	LateReplies int
+	MaxReorderDistance int
+	// probes that went past their timeout without a reply
+	TimedOutProbes int
+	// echo requests a router answered with Time Exceeded
+	TimeExceededReplies int
+	// and with the other ICMP errors, none of them count as received
+	DestinationUnreachableReplies int
+	RedirectReplies int
+	ParameterProblemReplies int
+	PacketTooBigReplies int
+	// echo replies whose payload came back different from what we sent
+	CorruptedReplies int
+	// echo replies whose echoed timestamp isn't the one we sent
+	StampMismatches int
 }
 
 // Driver is the basically the main function, this is what
-// orchestrates the sending and receiving.
+// orchestrates the sending and receiving. It is Run without a context, for
+// callers that only want the callbacks.
 func (p* PingerAgent) Driver() {
-	var connection *icmp.PacketConn
-	if p.options.isIpv4 {
-		// Listen for Incoming ipv4 ICMP packets
-		if connection = p.listenICMP("ip4:icmp"); connection != nil {
-			connection.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
-		} else {
-			return
-		}
-	} else {
-		// Listen for Incoming ipv6 ICMP Packets
-		if connection = p.listenICMP("ip6:ipv6-icmp"); connection != nil {
-			connection.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
-		} else {
-			return
-		}
+	p.Run(context.Background())
+}
+
+// Run pings until the count is reached (or the deadline passed after the last
+// echo request), the timeout passes, Stop is called or ctx is done, and gives
+// back the statistics; stopping early is not an error. It gives back an error
+// when the ping couldn't start (a *ResolutionError, a *PermissionError, or a
+// *SendError for the first echo request) or receiving failed, problems after
+// that only go to OnError.
+func (p *PingerAgent) Run(ctx context.Context) (*CompletedPingStatistics, error) {
+	if p.options.interval <= 0 {
+		p.stopPing.stop()
+		return nil, errors.New("the interval needs to be more than 0")
+	}
+	connection, err := p.openTransport()
+	if err != nil {
+		p.stopPing.stop()
+		return nil, err
 	}
-	// When the program exists, clean up.
-	defer connection.Close()
-	defer p.setStatisticsHandler()
 	// Used to let goroutines finish when the program is interrupted/finished (mutex lock)
 	var waitGroup sync.WaitGroup
 	// we send packets back from ReceiveICMPPacket() in this channel.
 	packetChannel := make(chan *PingPacket, 5)
-	defer close(packetChannel)
+	packetChannels := map[bool]chan *PingPacket{p.options.isIpv4: packetChannel}
 	waitGroup.Add(1)
 	// Receive ICMP Packets on a separate goroutine.
 	go p.ReceiveICMPPacket(connection, packetChannel, &waitGroup)
-	err := p.SendICMPPacket(connection)
-	if err != nil {
-		fmt.Printf("Could not send the ICMP packet: %s\n", err.Error())
+	if err := p.SendICMPPacket(connection); err != nil {
+		p.stopPing.stop()
+		connection.Close()
+		drainReceivers(&waitGroup, packetChannels)
+		return nil, err
 	}
 	// Set Tickers which have channels (reactive), that
 	// go to the next iteration every custom-set interval
-	timeoutTicker := time.NewTicker(p.options.timeout)
-	intervalTicker := time.NewTicker(p.options.interval)
-	defer timeoutTicker.Stop()
+	clock := clockOrReal(p.Clock)
+	var timeout <-chan time.Time
+	if p.options.timeout > 0 {
+		timeoutTimer := clock.NewTimer(p.options.timeout)
+		defer timeoutTimer.Stop()
+		timeout = timeoutTimer.C()
+	}
+	intervalTicker := clock.NewTicker(p.options.interval)
 	defer intervalTicker.Stop()
-	for {
+	// once everything is sent we only wait one more deadline for stragglers
+	var lastCall <-chan time.Time
+	// fires when the oldest unanswered probe runs out of time
+	probeExpiry := p.scheduleProbeExpiry(clock.Now())
+	for !p.stopPing.stopped() {
+		if lastCall == nil && p.options.count > 0 && p.packetsSent >= p.options.count {
+			lastCallTimer := clock.NewTimer(p.options.deadline)
+			defer lastCallTimer.Stop()
+			lastCall = lastCallTimer.C()
+		}
 		select {
-		// Ctrl+C
-		case <- p.stopPing:
-			waitGroup.Wait()
-			return
+		// Ctrl+C, or a receiver gave up
+		case <- p.stopPing.done:
+		case <- ctx.Done():
+			p.stopPing.stop()
 		// Packet Timeout exceeded
-		case <- timeoutTicker.C:
-			waitGroup.Wait()
-			close(p.stopPing)
-			return
+		case <- timeout:
+			p.stopPing.stop()
+		case <- lastCall:
+			p.stopPing.stop()
 		// every time the intervalTicker ticks, we send/receive another packet
-		case <- intervalTicker.C:
-			if p.packetsSent > 0 && p.packetsSent >= p.options.count  {
+		case <- intervalTicker.C():
+			if p.options.count > 0 && p.packetsSent >= p.options.count  {
 				continue
 			}
-			err = p.SendICMPPacket(connection)
-			if err != nil {
-				fmt.Printf("ERROR: %s\n", err.Error())
+			if err := p.SendICMPPacket(connection); err != nil {
+				p.reportError(err)
 			}
+			if probeExpiry == nil {
+				probeExpiry = p.scheduleProbeExpiry(clock.Now())
+			}
+		// A probe ran out of time, report it right away
+		case now := <- probeExpiry:
+			p.expireProbes(now)
+			probeExpiry = p.scheduleProbeExpiry(now)
 		// We received a packet from packetChannel, we log it for stats
 		case receivedPacket := <- packetChannel:
-			err := p.logPacket(receivedPacket)
-			if err != nil {
-				fmt.Printf("ERROR: %s\n", err.Error())
+			if err := p.logPacket(receivedPacket); err != nil {
+				p.reportError(err)
 			}
 		}
 		// If we reached the user-specified ount
 		if p.options.count > 0 && p.packetsRecieved >= p.options.count {
-			close(p.stopPing)
-			waitGroup.Wait()
-			return
+			p.stopPing.stop()
 		}
 	}
+	// closing the connection is what gets the receiver out of a read right away
+	connection.Close()
+	drainReceivers(&waitGroup, packetChannels)
+	stats := p.GetPingStatistics()
+	statsHandler := p.OnProcessComplete
+	if statsHandler != nil {
+		statsHandler(stats)
+	}
+	return stats, p.receiveErr
 }
 
 // GetPingStatistics() Calculates statistics to display to the user
 // based on round trip time, time to live, and the packet yield.
 func (p* PingerAgent) GetPingStatistics() *CompletedPingStatistics{
-	percentReceived := float64(p.packetsRecieved) / float64(p.packetsSent) * 100
-	percentLost := float64(p.packetsSent - p.packetsRecieved) / float64(p.packetsSent) * 100
-	var total time.Duration
-	for _, rtt := range p.roundTripTimes {
-		total += rtt
-	}
-	// average RTT
-	avg := total / time.Duration(len(p.roundTripTimes))
+	// nothing sent means nothing lost either
+	var percentReceived, percentLost float64
+	if p.packetsSent > 0 {
+		percentReceived = float64(p.packetsRecieved) / float64(p.packetsSent) * 100
+		percentLost = float64(p.packetsSent - p.packetsRecieved) / float64(p.packetsSent) * 100
+	}
+	// every RTT statistic stays 0 if we never got a reply
+	rtts := p.roundTripTimes.Clone()
 	return &CompletedPingStatistics{
-		AverageRTT:      avg,
-		PacketsReceived: p.packetsRecieved,
-		PacketsLost:     p.packetsSent - p.packetsRecieved,
-		PercentReceived: percentReceived,
-		PercentLost:     percentLost,
-		ExceededTTL: 	 p.numExceededTTL,
-		Destination:     p.options.ipAddress,
+		AverageRTT:                    rtts.Mean(),
+		MinRTT:                        rtts.Min(),
+		MaxRTT:                        rtts.Max(),
+		StdDevRTT:                     rtts.StdDev(),
+		MedianRTT:                     rtts.Percentile(50),
+		P90RTT:                        rtts.Percentile(90),
+		P95RTT:                        rtts.Percentile(95),
+		P99RTT:                        rtts.Percentile(99),
+		RoundTripTimes:                rtts,
+		Jitter:                        p.jitter.Jitter(),
+		MeanIPDV:                      p.jitter.MeanIPDV(),
+		MaxIPDV:                       p.jitter.MaxIPDV(),
+		PDV99:                         rtts.Percentile(99) - rtts.Min(),
+		PacketsReceived:               p.packetsRecieved,
+		PacketsLost:                   p.packetsSent - p.packetsRecieved,
+		PercentReceived:               percentReceived,
+		PercentLost:                   percentLost,
+		ExceededTTL:                   p.numExceededTTL,
+		Destination:                   p.options.ipAddress,
+		DuplicateReplies:              p.numDuplicates,
+		UntrackedReplies:              p.numUntracked,
+		ReorderedReplies:              p.numReordered,
+		LateReplies:                   p.numLate,
+		MaxReorderDistance:            p.maxReorderDistance,
+		TimedOutProbes:                p.numTimedOut,
+		TimeExceededReplies:           p.numTimeExceeded,
+		DestinationUnreachableReplies: p.numUnreachable,
+		RedirectReplies:               p.numRedirects,
+		ParameterProblemReplies:       p.numParameterProblems,
+		PacketTooBigReplies:           p.numPacketTooBig,
+		CorruptedReplies:              p.numCorrupted,
+		StampMismatches:               p.numStampMismatches,
 	}
 }
 
 // ReceiveICMPPacket is run as a goroutine and sends packets back via a packetChannel.
-func (p *PingerAgent) ReceiveICMPPacket(connection *icmp.PacketConn, packetChannel chan <- *PingPacket, group *sync.WaitGroup) {
+func (p *PingerAgent) ReceiveICMPPacket(connection Transport, packetChannel chan <- *PingPacket, group *sync.WaitGroup) {
 	defer group.Done()
+	clock := clockOrReal(p.Clock)
 	for {
 		select {
 		// Keyboard Interrupt (Ctrl+C)
-		case <-p.stopPing:
+		case <-p.stopPing.done:
 			return
 		default:
-			var err error
 			// We need to Read the packet by whatever the -w argument was
-			connection.SetReadDeadline(time.Now().Add(p.options.deadline))
+			err := connection.SetReadDeadline(clock.Now().Add(p.options.deadline))
 			if err != nil {
-				fmt.Printf("Couldn't set the Read Deadline on the icmp Packet Connection: %s\n", err.Error())
-			}
-			receivedBytes := make([]byte, 1024)
-			var numberOfBytes, timeToLive int
-			var source net.IP
-			if p.options.isIpv4 {
-				var message *ipv4.ControlMessage
-				// actually receive the message
-				numberOfBytes, message, _, err = connection.IPv4PacketConn().ReadFrom(receivedBytes)
-				if message != nil {
-					// build up some of the packet
-					timeToLive = message.TTL
-					source = message.Src
-				}
-
-			} else {
-				// ipv6 of ^
-				var message *ipv6.ControlMessage
-				numberOfBytes, message, _, err = connection.IPv6PacketConn().ReadFrom(receivedBytes)
-				if message != nil {
-					timeToLive = message.HopLimit
-				}
+				p.receiveErr = fmt.Errorf("could not set the read deadline: %w", err)
+				p.stopPing.stop()
+				return
 			}
+			receivedBytes := make([]byte, p.receiveBufferSize())
+			// actually receive the message
+			numberOfBytes, timeToLive, source, err := connection.ReadFrom(receivedBytes)
+			receivedAt, receivedBy := kernelReceiveTime(connection, clock.Now())
 			if err != nil {
-				if networkError, status := err.(*net.OpError); status {
-					// if the network error is timeout we are ok
-					if !networkError.Timeout() {
-						close(p.stopPing)
-						return
-					} else {
-						continue
-					}
+				// if the network error is timeout we are ok
+				if networkError, status := err.(net.Error); status && networkError.Timeout() {
+					continue
+				}
+				// whoever stopped us closed the connection too
+				if !p.stopPing.stopped() {
+					p.receiveErr = fmt.Errorf("could not receive: %w", err)
+					p.stopPing.stop()
 				}
+				return
 			}
 			// send the packet back to the channel.
 			packetChannel <- &PingPacket{
-				data:          receivedBytes,
+				data:          receivedBytes[:numberOfBytes],
 				TimeToLive:    timeToLive,
 				NumberOfBytes: numberOfBytes,
 				DestinationAddress: source.String(),
+				ReceivedAt:    receivedAt,
+				ReceiveTimestamp: receivedBy,
 			}
 		}
 	}
 }
 
 // SendICMPPacket sends an echo packet, similar to those in pings,
-func (p* PingerAgent) SendICMPPacket(connnection *icmp.PacketConn) error {
-	var packetType icmp.Type
-	if p.options.isIpv4 {
-		packetType = ipv4.ICMPTypeEcho
-	} else {
-		packetType = ipv6.ICMPTypeEchoRequest
-	}
-	destination, err := net.ResolveIPAddr("ip", p.options.ipAddress)
+func (p* PingerAgent) SendICMPPacket(connnection Transport) error {
+	return p.sendEcho(connnection, p.options.ipAddress)
+}
+
+// SendICMPPacketOfSize is SendICMPPacket with size data bytes instead of the
+// payload size (-s), at least 16 for the timestamp and tracker. Its reply is
+// checked against what it carried.
+func (p *PingerAgent) SendICMPPacketOfSize(connnection Transport, size int) error {
+	return p.sendEchoOfSize(connnection, p.options.ipAddress, size)
+}
+
+// sendEcho sends the next echo packet in our sequence to any address of our family.
+func (p *PingerAgent) sendEcho(connnection Transport, ipAddress string) error {
+	return p.sendEchoOfSize(connnection, ipAddress, p.payloadSize())
+}
+
+// sendEchoOfSize is sendEcho with size data bytes.
+func (p *PingerAgent) sendEchoOfSize(connnection Transport, ipAddress string, size int) error {
+	packetType := echoRequestType(p.options.isIpv4)
+	resolved, err := net.ResolveIPAddr("ip", ipAddress)
 	if err != nil {
-		fmt.Printf("ERROR: Could not Resolve IP: %s\n", p.options.ipAddress)
-		return err
+		return &ResolutionError{Destination: ipAddress, Err: err}
 	}
-	// Append the Tracker to the Packet Data - so we can trace
-	packetData := append(TimeToBytes(time.Now()), IntToBytes(p.packetTracker)...)
+	// Stamp the time and the Tracker into the Packet Data - so we can trace
+	sentAt := clockOrReal(p.Clock).Now()
+	packetData := p.payload(p.sequence, sentAt, size)
 	// Populate the ICMP Packet
 	packetMessage := &icmp.Message{
 		Type:     packetType,
@@ -248,41 +412,65 @@ func (p* PingerAgent) SendICMPPacket(connnection *icmp.PacketConn) error {
 		return err
 	}
 	for {
-		_, err := connnection.WriteTo(packetBytes, destination)
+		_, err = connnection.WriteTo(packetBytes, resolved)
 		if networkErr, status := err.(*net.OpError); status && err != nil {
 			if networkErr.Err == syscall.ENOBUFS {
 				// it always sends as long as it is an ENOBUFS error
 				continue
 			}
 		}
-		p.sequence++
-		p.packetsSent++
 		break
 	}
+	sequence := p.sequence & 0xffff
+	// a failed echo request still counts as sent (and lost), like iputils does
+	p.probes.sent(p.sequence, sentAt)
+	if len(packetData) != p.payloadSize() {
+		p.probes.carried(p.sequence, len(packetData))
+	}
+	if err == nil {
+		departedAt, source := kernelSendTime(connnection, sentAt)
+		p.probes.departed(p.sequence, departedAt, source)
+	}
+	p.sequence++
+	p.packetsSent++
+	if err != nil {
+		return &SendError{Destination: ipAddress, Sequence: sequence, Err: err}
+	}
+	sentHandler := p.OnEchoSent
+	if sentHandler != nil {
+		sentHandler(sequence, ipAddress)
+	}
 	return nil
 }
 
-// http://www.networksorcery.com/enp/protocol/icmpv6.htm - protocol number 58 for ipv6
+// logPacket matches a received packet against the ones we sent and logs it for statistics.
 func (p *PingerAgent) logPacket(received *PingPacket) error {
-	tripCompleted := time.Now()
-	var protocol int
-	if p.options.isIpv4 {
-		protocol = 1
-	} else {
-		protocol = 58
+	// stamped by the receiver (or the kernel), so time spent in our channel doesn't count
+	tripCompleted := received.ReceivedAt
+	if tripCompleted.IsZero() {
+		tripCompleted = clockOrReal(p.Clock).Now()
+		received.ReceiveTimestamp = TimestampUserspace
 	}
 	// get the message from the bytes
-	message, err := icmp.ParseMessage(protocol, received.data)
+	message, err := icmp.ParseMessage(icmpProtocol(p.options.isIpv4), received.data)
 	if err != nil {
 		return err
 	}
+	// a router (or the destination) telling us about one of our echo requests,
+	// e.g. dropped because the TTL ran out or the host can't be reached
+	if kind, ok := icmpErrorType(message.Type); ok {
+		p.logICMPError(received, message, kind)
+		return nil
+	}
 	// if it's not an echo response
 	if message.Type != ipv4.ICMPTypeEchoReply && message.Type != ipv6.ICMPTypeEchoReply {
 		return nil
 	}
 	switch receivedType := message.Body.(type) {
 	case *icmp.Echo:
-		if p.packetId != receivedType.ID {
+		// On datagram sockets the kernel rewrites the echo ID to the socket's
+		// local port, so only the tracker below can tell us it is ours.
+		if !p.unprivileged && p.packetId != receivedType.ID {
 			return nil
 		}
 		// we need all 16 bytes because we receive the time and tracker as well.
@@ -296,18 +484,53 @@ func (p *PingerAgent) logPacket(received *PingPacket) error {
 			// not our packet
 			return nil
 		}
-		// rtt = packet_recv_time - packet_sent_tiem
-		received.RoundTripTime = tripCompleted.Sub(packetSentTimestamp)
+		// rtt = packet_recv_time - packet_sent_tiem, timed with the monotonic
+		// clock from when we sent it, so a wall clock step (NTP, a resumed VM)
+		// can't make it negative or huge. The echoed timestamp is a wall clock
+		// reading and only stands in once the probe fell out of the table.
+		if probe := p.probes.lookup(receivedType.Seq); probe != nil {
+			received.RoundTripTime = tripCompleted.Sub(probe.departedAt)
+			received.SentAt = probe.sentAt
+			received.SendTimestamp = probe.departedBy
+			// we wrote the timestamp from this very send time
+			if !packetSentTimestamp.Equal(probe.sentAt) {
+				received.StampMismatch = true
+				p.numStampMismatches++
+			}
+		} else {
+			received.RoundTripTime = tripCompleted.Sub(packetSentTimestamp)
+			received.SentAt = packetSentTimestamp
+			received.SendTimestamp = TimestampUserspace
+		}
+		received.ReceivedAt = tripCompleted
 		received.ICMPSequenceNumber = receivedType.Seq
-		p.packetsRecieved++
+		received.echoed = true
+		// the rest of the payload has to come back the way we sent it
+		if corrupted := p.verifyPayload(receivedType.Data, receivedType.Seq); corrupted != nil {
+			received.Corrupted = true
+			p.logCorruptedReply(corrupted)
+		}
+		var reorderDistance int
+		received.Duplicate, received.Untracked, received.Late, reorderDistance = p.probes.classify(receivedType.Seq, tripCompleted,
+			p.options.probeTimeout)
+		received.Reordered = reorderDistance > 0
+		p.countReply(received, reorderDistance)
 	default:
 		return errors.New(fmt.Sprintf("bad ICMP reply"))
 	}
-	// add the time to the slice for averaging
-	p.roundTripTimes = append(p.roundTripTimes, received.RoundTripTime)
+	// add the time to the running statistics, a duplicate already was and
+	// an untracked one isn't an answer to anything we know of
+	counted := !received.Duplicate && !received.Untracked
+	if counted {
+		p.roundTripTimes.Add(received.RoundTripTime)
+		received.Jitter = p.jitter.Add(received.RoundTripTime)
+	}
 	exceeded := false
 	if received.TimeToLive > p.maxTTL {
 		exceeded = true
+		if counted {
+			p.numExceededTTL++
+		}
 	}
 	// initiate the callback to print the stats
 	onCompleteHandler := p.OnEchoComplete
@@ -317,28 +540,125 @@ func (p *PingerAgent) logPacket(received *PingPacket) error {
 	return nil
 }
 
-// listenICMP() Listens for ICMP Packets - Note: ping needs to be run in sudo mode.
-func (p* PingerAgent) listenICMP(networkProtocol string) *icmp.PacketConn {
-	connection, err := icmp.ListenPacket(networkProtocol, "")
-	if err != nil {
-		fmt.Printf("Could not listen for ICMP packets for %s: %s\n", p.options.ipAddress, err.Error())
-		fmt.Print("Did you forget to run in sudo mode?\n")
-		close(p.stopPing)
+// expireProbes fires OnEchoTimeout (and OnEchoLost) for every probe whose timeout passed
+// without a reply, so loss shows up as it happens.
+func (p *PingerAgent) expireProbes(now time.Time) {
+	if p.options.probeTimeout <= 0 {
+		return
+	}
+	for _, sequence := range p.probes.expire(now, p.options.probeTimeout) {
+		p.numTimedOut++
+		timeoutHandler := p.OnEchoTimeout
+		if timeoutHandler != nil {
+			// same 16 bit icmp_seq the replies carry
+			timeoutHandler(sequence&0xffff, p.options.ipAddress)
+		}
+		lostHandler := p.OnEchoLost
+		if lostHandler != nil {
+			lost := &PingPacket{DestinationAddress: p.options.ipAddress, ICMPSequenceNumber: sequence & 0xffff}
+			if probe := p.probes.lookup(sequence & 0xffff); probe != nil {
+				lost.SentAt = probe.sentAt
+			}
+			lostHandler(lost)
+		}
+	}
+}
+
+// scheduleProbeExpiry gives back a channel that fires when the oldest
+// unanswered probe's timeout passes, or nil if nothing is waiting.
+func (p *PingerAgent) scheduleProbeExpiry(now time.Time) <-chan time.Time {
+	if p.options.probeTimeout <= 0 {
+		return nil
+	}
+	deadline, ok := p.probes.nextDeadline(p.options.probeTimeout)
+	if !ok {
 		return nil
 	}
-	return connection
+	return clockOrReal(p.Clock).NewTimer(deadline.Sub(now)).C()
 }
 
-// setStatisticsHandler initiates the statistics callback
-func (p* PingerAgent) setStatisticsHandler() {
-	statsHandler := p.OnProcessComplete
-	if statsHandler != nil {
-		stats := p.GetPingStatistics()
-		statsHandler(stats)
+// countReply updates the reply counters, duplicates don't count as received
+// so they can't push the loss below zero.
+func (p *PingerAgent) countReply(received *PingPacket, reorderDistance int) {
+	if received.Duplicate {
+		p.numDuplicates++
+		return
+	}
+	if received.Untracked {
+		p.numUntracked++
+		return
+	}
+	p.packetsRecieved++
+	if received.Late {
+		p.numLate++
+	}
+	if received.Reordered {
+		p.numReordered++
+		if reorderDistance > p.maxReorderDistance {
+			p.maxReorderDistance = reorderDistance
+		}
 	}
 }
 
-// Stop notifies all goroutines to stop through the stopPing channel.
+// openConnection listens for incoming ICMP packets of our address family,
+// asking for the TTL (hop limit on ipv6) of every packet.
+func (p *PingerAgent) openConnection() (*icmp.PacketConn, error) {
+	if p.options.isIpv4 {
+		connection, err := p.listenICMP("udp4", "ip4:icmp")
+		if err != nil {
+			return nil, err
+		}
+		connection.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+		// -ttl, what our echo requests go out with
+		if p.options.timeToLive > 0 {
+			if err := connection.IPv4PacketConn().SetTTL(p.options.timeToLive); err != nil {
+				connection.Close()
+				return nil, fmt.Errorf("could not set the TTL to %d: %w", p.options.timeToLive, err)
+			}
+		}
+		return connection, nil
+	}
+	connection, err := p.listenICMP("udp6", "ip6:ipv6-icmp")
+	if err != nil {
+		return nil, err
+	}
+	connection.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	if p.options.timeToLive > 0 {
+		if err := connection.IPv6PacketConn().SetHopLimit(p.options.timeToLive); err != nil {
+			connection.Close()
+			return nil, fmt.Errorf("could not set the hop limit to %d: %w", p.options.timeToLive, err)
+		}
+	}
+	return connection, nil
+}
+
+// listenICMP() Listens for ICMP Packets. The unprivileged datagram network is tried
+// first (works when net.ipv4.ping_group_range covers our group), and the raw
+// network is the fallback - Note: raw sockets need to be run in sudo mode.
+func (p* PingerAgent) listenICMP(datagramProtocol string, rawProtocol string) (*icmp.PacketConn, error) {
+	if !p.options.privileged {
+		if connection, err := icmp.ListenPacket(datagramProtocol, ""); err == nil {
+			p.unprivileged = true
+			return connection, nil
+		}
+	}
+	connection, err := icmp.ListenPacket(rawProtocol, "")
+	if err != nil {
+		return nil, listenError(rawProtocol, err)
+	}
+	return connection, nil
+}
+
+// reportError hands an error the ping carries on after to OnError.
+func (p *PingerAgent) reportError(err error) {
+	errorHandler := p.OnError
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
+
+// Stop notifies all goroutines to stop through the stopPing channel,
+// it is safe to call more than once and from any goroutine.
 func (p *PingerAgent) Stop() {
-	close(p.stopPing)
-}
\ No newline at end of file
+	p.stopPing.stop()
+}
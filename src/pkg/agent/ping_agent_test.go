@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Tests for the pinger agent
+
+func TestPingerAgent_GetPingStatistics(t *testing.T) {
+	tests := []struct {
+		desc     string
+		pinger   PingerAgent
+		inRTTs   []time.Duration
+		expected CompletedPingStatistics
+	}{
+		{
+			desc:     "nothing-sent",
+			pinger:   PingerAgent{},
+			expected: CompletedPingStatistics{},
+		},
+		{
+			desc: "no-replies",
+			pinger: PingerAgent{
+				packetsSent: 4,
+			},
+			expected: CompletedPingStatistics{
+				PacketsLost: 4,
+				PercentLost: 100,
+			},
+		},
+		{
+			desc: "half-lost",
+			pinger: PingerAgent{
+				packetsSent:     4,
+				packetsRecieved: 2,
+			},
+			inRTTs: []time.Duration{3 * time.Millisecond, time.Millisecond},
+			expected: CompletedPingStatistics{
+				AverageRTT:      2 * time.Millisecond,
+				MinRTT:          time.Millisecond,
+				MaxRTT:          3 * time.Millisecond,
+				StdDevRTT:       time.Millisecond,
+				MedianRTT:       time.Millisecond,
+				P90RTT:          3 * time.Millisecond,
+				P95RTT:          3 * time.Millisecond,
+				P99RTT:          3 * time.Millisecond,
+				Jitter:          125 * time.Microsecond,
+				MeanIPDV:        2 * time.Millisecond,
+				MaxIPDV:         2 * time.Millisecond,
+				PDV99:           2 * time.Millisecond,
+				PacketsReceived: 2,
+				PacketsLost:     2,
+				PercentReceived: 50,
+				PercentLost:     50,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			for _, rtt := range tt.inRTTs {
+				tt.pinger.roundTripTimes.Add(rtt)
+				tt.pinger.jitter.Add(rtt)
+			}
+			stats := tt.pinger.GetPingStatistics()
+			if stats.RoundTripTimes == nil || stats.RoundTripTimes.Count() != len(tt.inRTTs) {
+				t.Fatalf("%s: expected a snapshot of %d round trip times got %+v", tt.desc, len(tt.inRTTs), stats.RoundTripTimes)
+			}
+			// percentiles come from the sketch, so they only need to be within its accuracy
+			if !withinAccuracy(stats.MedianRTT, tt.expected.MedianRTT) || !withinAccuracy(stats.P90RTT, tt.expected.P90RTT) ||
+				!withinAccuracy(stats.P95RTT, tt.expected.P95RTT) || !withinAccuracy(stats.P99RTT, tt.expected.P99RTT) {
+				t.Errorf("%s: expected median/p90/p95/p99 %v/%v/%v/%v got %v/%v/%v/%v", tt.desc, tt.expected.MedianRTT,
+					tt.expected.P90RTT, tt.expected.P95RTT, tt.expected.P99RTT, stats.MedianRTT, stats.P90RTT, stats.P95RTT, stats.P99RTT)
+			}
+			tt.expected.MedianRTT, tt.expected.P90RTT, tt.expected.P95RTT, tt.expected.P99RTT = stats.MedianRTT, stats.P90RTT, stats.P95RTT, stats.P99RTT
+			tt.expected.RoundTripTimes = stats.RoundTripTimes
+			if !withinAccuracy(stats.PDV99, tt.expected.PDV99) {
+				t.Errorf("%s: expected pdv %v got %v", tt.desc, tt.expected.PDV99, stats.PDV99)
+			}
+			tt.expected.PDV99 = stats.PDV99
+			if *stats != tt.expected {
+				t.Errorf("%s: expected %+v got %+v", tt.desc, tt.expected, *stats)
+			}
+		})
+	}
+}
+
+// echoReply builds the reply a destination would send back for one of p's echo requests.
+func echoReply(t *testing.T, p *PingerAgent, sequence int, sentAt time.Time) *PingPacket {
+	packetType := icmp.Type(ipv4.ICMPTypeEchoReply)
+	if !p.options.isIpv4 {
+		packetType = ipv6.ICMPTypeEchoReply
+	}
+	message := &icmp.Message{
+		Type: packetType,
+		Body: &icmp.Echo{
+			ID:   p.packetId,
+			Seq:  sequence,
+			Data: append(TimeToBytes(sentAt), IntToBytes(p.packetTracker)...),
+		},
+	}
+	data, err := message.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PingPacket{data: data, NumberOfBytes: len(data)}
+}
+
+func TestPingerAgent_LogPacket(t *testing.T) {
+	tests := []struct {
+		desc              string
+		inSent            int
+		inReplies         []int
+		expectedReceived  int
+		expectedDuplicate int
+		expectedUntracked int
+		expectedReordered int
+	}{
+		{
+			desc:             "every-reply",
+			inSent:           3,
+			inReplies:        []int{0, 1, 2},
+			expectedReceived: 3,
+		},
+		{
+			desc:              "duplicates-dont-count",
+			inSent:            2,
+			inReplies:         []int{0, 0, 0, 1},
+			expectedReceived:  2,
+			expectedDuplicate: 2,
+		},
+		{
+			desc:              "reordered",
+			inSent:            3,
+			inReplies:         []int{1, 0, 2},
+			expectedReceived:  3,
+			expectedReordered: 1,
+		},
+		{
+			desc:              "never-sent-dont-count",
+			inSent:            2,
+			inReplies:         []int{0, 7, 7, 1},
+			expectedReceived:  2,
+			expectedUntracked: 2,
+		},
+		{
+			desc:              "fell-out-of-the-window-dont-count",
+			inSent:            probeWindow + 1,
+			inReplies:         []int{0, 0, probeWindow},
+			expectedReceived:  1,
+			expectedUntracked: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			options := &PresentOptions{isIpv4: true, probeTimeout: time.Minute}
+			p := BuildPinger(options)
+			sentAt := time.Now()
+			for sequence := 0; sequence < tt.inSent; sequence++ {
+				p.probes.sent(sequence, sentAt)
+				p.packetsSent++
+			}
+			for _, sequence := range tt.inReplies {
+				if err := p.logPacket(echoReply(t, p, sequence, sentAt)); err != nil {
+					t.Fatalf("%s: %v", tt.desc, err)
+				}
+			}
+			stats := p.GetPingStatistics()
+			if stats.PacketsReceived != tt.expectedReceived || stats.DuplicateReplies != tt.expectedDuplicate ||
+				stats.UntrackedReplies != tt.expectedUntracked || stats.ReorderedReplies != tt.expectedReordered || stats.PacketsLost < 0 ||
+				stats.RoundTripTimes.Count() != tt.expectedReceived {
+				t.Errorf("%s: expected received/dup/untracked/reordered %v/%v/%v/%v got %v/%v/%v/%v lost %v", tt.desc, tt.expectedReceived,
+					tt.expectedDuplicate, tt.expectedUntracked, tt.expectedReordered, stats.PacketsReceived, stats.DuplicateReplies,
+					stats.UntrackedReplies, stats.ReorderedReplies, stats.PacketsLost)
+			}
+		})
+	}
+}
+
+func TestPingerAgent_LogPacket_RoundTripTime(t *testing.T) {
+	sentAt := time.Now()
+	tests := []struct {
+		desc             string
+		inProbe          bool
+		inStamp          time.Time
+		inDeparted       time.Duration
+		expectedRTT      time.Duration
+		expectedMismatch bool
+		expectedSource   TimestampSource
+	}{
+		{
+			desc:           "from-the-send-table",
+			inProbe:        true,
+			inStamp:        sentAt,
+			expectedRTT:    20 * time.Millisecond,
+			expectedSource: TimestampUserspace,
+		},
+		{
+			desc:           "kernel-send-timestamp",
+			inProbe:        true,
+			inStamp:        sentAt,
+			inDeparted:     time.Millisecond,
+			expectedRTT:    19 * time.Millisecond,
+			expectedSource: TimestampKernel,
+		},
+		{
+			// e.g. the wall clock stepped an hour, or a middlebox rewrote it
+			desc:             "stamp-disagrees",
+			inProbe:          true,
+			inStamp:          sentAt.Add(-time.Hour),
+			expectedRTT:      20 * time.Millisecond,
+			expectedMismatch: true,
+			expectedSource:   TimestampUserspace,
+		},
+		{
+			desc:           "fell-out-of-the-table",
+			inStamp:        sentAt.Add(-time.Second),
+			expectedRTT:    time.Second + 20*time.Millisecond,
+			expectedSource: TimestampUserspace,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			p := BuildPinger(&PresentOptions{isIpv4: true, probeTimeout: time.Minute})
+			if tt.inProbe {
+				p.probes.sent(0, sentAt)
+				if tt.inDeparted > 0 {
+					p.probes.departed(0, sentAt.Add(tt.inDeparted), TimestampKernel)
+				}
+				p.packetsSent++
+			}
+			received := echoReply(t, p, 0, tt.inStamp)
+			received.ReceivedAt = sentAt.Add(20 * time.Millisecond)
+			if err := p.logPacket(received); err != nil {
+				t.Fatalf("%s: %v", tt.desc, err)
+			}
+			if received.RoundTripTime != tt.expectedRTT || received.StampMismatch != tt.expectedMismatch ||
+				received.SendTimestamp != tt.expectedSource {
+				t.Errorf("%s: expected rtt %v, mismatch %v and a %s send time got %v, %v and %s", tt.desc, tt.expectedRTT,
+					tt.expectedMismatch, tt.expectedSource, received.RoundTripTime, received.StampMismatch, received.SendTimestamp)
+			}
+			if received.Corrupted {
+				t.Errorf("%s: expected the rest of the payload to match", tt.desc)
+			}
+			if stats := p.GetPingStatistics(); (stats.StampMismatches == 1) != tt.expectedMismatch {
+				t.Errorf("%s: expected mismatch %v counted got %d", tt.desc, tt.expectedMismatch, stats.StampMismatches)
+			}
+		})
+	}
+}
+
+func TestPingerAgent_ExpireProbes(t *testing.T) {
+	p := BuildPinger(&PresentOptions{isIpv4: true, ipAddress: "127.0.0.1", probeTimeout: time.Second})
+	var timedOut []int
+	p.OnEchoTimeout = func(sequence int, destination string) {
+		if destination != "127.0.0.1" {
+			t.Errorf("expected the timeout for 127.0.0.1 got %s", destination)
+		}
+		timedOut = append(timedOut, sequence)
+	}
+	var lost []*PingPacket
+	p.OnEchoLost = func(p *PingPacket) {
+		lost = append(lost, p)
+	}
+	sentAt := time.Now()
+	// the 16 bit icmp_seq is what gets reported
+	p.probes.sent(65536, sentAt)
+	p.probes.sent(65537, sentAt)
+	if err := p.logPacket(echoReply(t, p, 1, sentAt)); err != nil {
+		t.Fatal(err)
+	}
+	p.expireProbes(sentAt.Add(2 * time.Second))
+	if len(timedOut) != 1 || timedOut[0] != 0 || p.GetPingStatistics().TimedOutProbes != 1 {
+		t.Errorf("expected only icmp_seq=0 to time out, got %v", timedOut)
+	}
+	if len(lost) != 1 || lost[0].ICMPSequenceNumber != 0 || !lost[0].SentAt.Equal(sentAt) || lost[0].DestinationAddress != "127.0.0.1" {
+		t.Errorf("expected icmp_seq=0 to be lost with its send time, got %+v", lost)
+	}
+}
+
+func TestPingerAgent_Stop(t *testing.T) {
+	pinger := BuildPinger(&PresentOptions{})
+	// Ctrl+C twice, or Stop racing a receiver that gave up, must not panic
+	pinger.Stop()
+	pinger.Stop()
+	if !pinger.stopPing.stopped() {
+		t.Errorf("expected the pinger to be stopped")
+	}
+}
+
+func TestPingerAgent_Run_InvalidInterval(t *testing.T) {
+	pinger := BuildPinger(&PresentOptions{ipAddress: "127.0.0.1", isIpv4: true, count: 1})
+	stats, err := pinger.Run(context.Background())
+	if err == nil || stats != nil {
+		t.Errorf("expected an error and no statistics got %v and %+v", err, stats)
+	}
+}
@@ -0,0 +1,379 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// fragmentationNeeded is the ipv4 Destination Unreachable code of a router
+// that had to drop a packet with Don't Fragment set, which it says the next
+// hop MTU with.
+const fragmentationNeeded = 4
+
+// PMTUOutcome is what happened to one size of echo request.
+type PMTUOutcome string
+
+const (
+	// the destination echoed it back
+	PMTUReached PMTUOutcome = "reached"
+	// a router sent back a Fragmentation Needed (Packet Too Big on ipv6)
+	PMTUTooBig PMTUOutcome = "too-big"
+	// it was too big for our own interface to send
+	PMTULocal PMTUOutcome = "local"
+	// a router (or the destination) said it can't be reached at all
+	PMTUUnreachable PMTUOutcome = "unreachable"
+	// nothing came back for any try
+	PMTUDropped PMTUOutcome = "dropped"
+)
+
+// PMTUProbe is one size of echo request a path MTU discovery tried.
+type PMTUProbe struct {
+	// the whole packet, IP header included
+	Size    int
+	Outcome PMTUOutcome
+	// who answered, and the MTU a Fragmentation Needed (Packet Too Big) said
+	Responder     string
+	MTU           int
+	RoundTripTime time.Duration
+	// how many echo requests of this size went out
+	Tries int
+}
+
+// PMTUResult is what a path MTU discovery found out.
+type PMTUResult struct {
+	Destination string
+	// the biggest packet (IP header included) that got to the destination
+	// and back, 0 if not even the smallest one did
+	PathMTU int
+	// the router that said the smallest packet that didn't get there is too
+	// big, and the MTU it said; empty when nobody did
+	Router      string
+	ReportedMTU int
+	// the smallest packet that didn't get there was too big for our own interface
+	LocalLimit bool
+	// the smallest packet that didn't get there was dropped without any ICMP
+	// error while smaller ones got through: an MTU black hole
+	BlackHole bool
+	// every size tried, in order
+	Probes []*PMTUProbe
+}
+
+// pmtuWait is the size we are waiting on an answer for.
+type pmtuWait struct {
+	probe *PMTUProbe
+	// the wire sequences of every try, any of them answering settles the size
+	sequences []int
+	// when we give up on the latest try
+	expires time.Time
+}
+
+// PMTUAgent finds the path MTU to one destination: it binary searches the
+// biggest echo request that gets there with Don't Fragment set (ipv6 routers
+// never fragment), going straight to the MTU a router's Fragmentation Needed
+// (Packet Too Big) says. Every size gets a few (queries) tries before it
+// counts as dropped.
+type PMTUAgent struct {
+	options PresentOptions
+	// does the actual sending and matching
+	pinger *PingerAgent
+	// the biggest size known to get there and the smallest known not to, 0 until one does
+	low  int
+	high int
+	// what happened to high
+	limit *PMTUProbe
+	// an MTU a router told us about, tried next
+	hint     int
+	current  *pmtuWait
+	probes   []*PMTUProbe
+	stopPing *stopSignal
+	// Callbacks to the main function: every size once we know what happened
+	// to it, and what we found out once we are done.
+	OnProbe func(p *PMTUProbe)
+	// an echo request that couldn't be sent, or an answer we couldn't make sense of
+	OnError        func(err error)
+	OnPMTUComplete func(r *PMTUResult)
+	// opens the Transport of the destination's family instead of an ICMP
+	// socket, it has to be a DontFragmentTransport
+	Listen func(isIpv4 bool) (Transport, error)
+	// where the time, timers and tickers come from, the real time if nil
+	Clock Clock
+}
+
+// BuildPMTU builds a path MTU discovery to the options' destination, trying
+// packets up to the payload size (-s) plus the headers.
+func BuildPMTU(options *PresentOptions) (*PMTUAgent, error) {
+	if options.ipAddress == "" {
+		return nil, errors.New("a path MTU discovery needs a destination")
+	}
+	if options.queries < 1 {
+		return nil, errors.New("a path MTU discovery needs at least one try per size")
+	}
+	m := &PMTUAgent{
+		options:  *options,
+		pinger:   BuildPinger(options),
+		stopPing: newStopSignal(),
+	}
+	m.pinger.stopPing = m.stopPing
+	return m, nil
+}
+
+// Driver sends a size every interval, each one once the last one was
+// answered or given up on, until the path MTU is found.
+func (m *PMTUAgent) Driver() {
+	m.Run(context.Background())
+}
+
+// Run is Driver that also stops once ctx is done, and gives back what it
+// found out, the biggest size that got there so far if it was cut short. It
+// gives back an error when the socket couldn't be opened or set to not
+// fragment (then there is no result) or receiving failed.
+func (m *PMTUAgent) Run(ctx context.Context) (*PMTUResult, error) {
+	m.pinger.Listen = m.Listen
+	m.pinger.Clock = m.Clock
+	connection, err := m.pinger.openTransport()
+	if err != nil {
+		m.Stop()
+		return nil, err
+	}
+	unfragmented, ok := connection.(DontFragmentTransport)
+	if !ok {
+		m.Stop()
+		connection.Close()
+		return nil, errors.New("a path MTU discovery needs a transport that can set Don't Fragment")
+	}
+	if err := unfragmented.SetDontFragment(); err != nil {
+		m.Stop()
+		connection.Close()
+		return nil, err
+	}
+	packetChannels := map[bool]chan *PingPacket{m.options.isIpv4: make(chan *PingPacket, 64)}
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go m.pinger.ReceiveICMPPacket(connection, packetChannels[m.options.isIpv4], &waitGroup)
+	clock := clockOrReal(m.Clock)
+	ticker := clock.NewTicker(m.options.interval)
+	defer ticker.Stop()
+	var timeout <-chan time.Time
+	if m.options.timeout > 0 {
+		timeoutTimer := clock.NewTimer(m.options.timeout)
+		defer timeoutTimer.Stop()
+		timeout = timeoutTimer.C()
+	}
+	// the first size goes out right away
+	m.step(connection, clock.Now())
+	for !m.stopPing.stopped() {
+		select {
+		// Ctrl+C, or the receiver gave up
+		case <-m.stopPing.done:
+		case <-ctx.Done():
+			m.Stop()
+		case <-timeout:
+			m.Stop()
+		case now := <-ticker.C():
+			m.step(connection, now)
+		case receivedPacket := <-packetChannels[m.options.isIpv4]:
+			m.collect(receivedPacket)
+		}
+	}
+	// closing the connection is what gets the receiver out of a read right away
+	connection.Close()
+	drainReceivers(&waitGroup, packetChannels)
+	result := m.result()
+	completeHandler := m.OnPMTUComplete
+	if completeHandler != nil {
+		completeHandler(result)
+	}
+	return result, m.pinger.receiveErr
+}
+
+// Stop notifies all goroutines to stop.
+func (m *PMTUAgent) Stop() {
+	m.stopPing.stop()
+}
+
+// headerSize is the IP and ICMP headers in front of an echo request's data.
+func (m *PMTUAgent) headerSize() int {
+	if m.options.isIpv4 {
+		return 20 + 8
+	}
+	return 40 + 8
+}
+
+// smallest is the smallest echo request we can send, just the timestamp and tracker.
+func (m *PMTUAgent) smallest() int {
+	return m.headerSize() + minPayloadSize
+}
+
+// largest is the biggest echo request we try, the payload size (-s).
+func (m *PMTUAgent) largest() int {
+	return m.headerSize() + m.pinger.payloadSize()
+}
+
+// next is the size to try next, or false once the path MTU is found. The
+// smallest size goes first to make sure the destination answers at all,
+// then the largest in case nothing on the way is smaller.
+func (m *PMTUAgent) next() (int, bool) {
+	if m.low == 0 {
+		return m.smallest(), m.high == 0
+	}
+	if m.high == 0 {
+		return m.largest(), m.low < m.largest()
+	}
+	if m.high-m.low <= 1 {
+		return 0, false
+	}
+	if hint := m.hint; hint > m.low && hint < m.high {
+		m.hint = 0
+		return hint, true
+	}
+	return (m.low + m.high) / 2, true
+}
+
+// step gives up on a try of the current size once its deadline passes, and
+// sends the next size once the current one is settled.
+func (m *PMTUAgent) step(connection Transport, now time.Time) {
+	if wait := m.current; wait != nil {
+		if !now.After(wait.expires) {
+			return
+		}
+		if wait.probe.Tries < m.options.queries {
+			m.send(connection, wait.probe)
+			return
+		}
+		wait.probe.Outcome = PMTUDropped
+		m.settle(wait.probe)
+	}
+	size, ok := m.next()
+	if !ok {
+		m.Stop()
+		return
+	}
+	m.current = &pmtuWait{probe: &PMTUProbe{Size: size}}
+	m.send(connection, m.current.probe)
+}
+
+// send sends (another) echo request of the probe's size.
+func (m *PMTUAgent) send(connection Transport, probe *PMTUProbe) {
+	probe.Tries++
+	// the sequence goes out on the wire as 16 bits
+	m.current.sequences = append(m.current.sequences, m.pinger.sequence&0xffff)
+	m.current.expires = clockOrReal(m.Clock).Now().Add(m.options.deadline)
+	err := m.pinger.sendEchoOfSize(connection, m.options.ipAddress, probe.Size-m.headerSize())
+	if errors.Is(err, syscall.EMSGSIZE) {
+		// bigger than our own interface's MTU
+		probe.Outcome = PMTULocal
+		m.settle(probe)
+		return
+	}
+	if err != nil {
+		// tried again once the deadline passes
+		m.reportError(err)
+	}
+}
+
+// collect settles the current size with an answer to its latest try.
+func (m *PMTUAgent) collect(received *PingPacket) {
+	message, err := icmp.ParseMessage(icmpProtocol(m.options.isIpv4), received.data)
+	if err != nil {
+		m.reportError(err)
+		return
+	}
+	var sequence, mtu int
+	var roundTripTime time.Duration
+	var ours bool
+	var outcome PMTUOutcome
+	switch body := message.Body.(type) {
+	case *icmp.PacketTooBig:
+		sequence, roundTripTime, ours = m.pinger.quotedProbe(received, body.Data)
+		outcome, mtu = PMTUTooBig, body.MTU
+	case *icmp.DstUnreach:
+		sequence, roundTripTime, ours = m.pinger.quotedProbe(received, body.Data)
+		outcome = PMTUUnreachable
+		if message.Code == fragmentationNeeded && len(received.data) >= 8 {
+			// the next hop MTU is in what would be unused bytes
+			outcome, mtu = PMTUTooBig, int(received.data[6])<<8|int(received.data[7])
+		}
+	default:
+		answer, isOurs, err := m.pinger.answer(received)
+		if err != nil {
+			m.reportError(err)
+			return
+		}
+		if answer.reply != ReplyEcho {
+			return
+		}
+		sequence, roundTripTime, ours = answer.sequence, answer.roundTripTime, isOurs
+		outcome = PMTUReached
+	}
+	wait := m.current
+	if !ours || wait == nil || !wait.tried(sequence) {
+		// an answer for a size we already settled
+		return
+	}
+	probe := wait.probe
+	probe.Outcome = outcome
+	probe.Responder = received.DestinationAddress
+	probe.MTU = mtu
+	probe.RoundTripTime = roundTripTime
+	m.settle(probe)
+}
+
+// tried is true if one of the tries went out with a wire sequence.
+func (w *pmtuWait) tried(sequence int) bool {
+	for _, tried := range w.sequences {
+		if tried == sequence {
+			return true
+		}
+	}
+	return false
+}
+
+// settle narrows the search down with what happened to a size.
+func (m *PMTUAgent) settle(probe *PMTUProbe) {
+	m.current = nil
+	m.probes = append(m.probes, probe)
+	if probe.Outcome == PMTUReached {
+		if probe.Size > m.low {
+			m.low = probe.Size
+		}
+	} else if m.high == 0 || probe.Size <= m.high {
+		m.high, m.limit = probe.Size, probe
+		// everything bigger than the MTU the router said doesn't get past it either
+		if probe.Outcome == PMTUTooBig && probe.MTU > m.low && probe.MTU < probe.Size {
+			m.high, m.hint = probe.MTU+1, probe.MTU
+		}
+	}
+	probeHandler := m.OnProbe
+	if probeHandler != nil {
+		probeHandler(probe)
+	}
+}
+
+// result is what we found out so far.
+func (m *PMTUAgent) result() *PMTUResult {
+	result := &PMTUResult{Destination: m.options.ipAddress, PathMTU: m.low, Probes: m.probes}
+	if m.limit == nil || m.low == 0 {
+		return result
+	}
+	switch m.limit.Outcome {
+	case PMTUTooBig:
+		result.Router, result.ReportedMTU = m.limit.Responder, m.limit.MTU
+	case PMTULocal:
+		result.LocalLimit = true
+	case PMTUDropped:
+		result.BlackHole = true
+	}
+	return result
+}
+
+func (m *PMTUAgent) reportError(err error) {
+	errorHandler := m.OnError
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPMTUAgent_Run_SimulatedNetwork(t *testing.T) {
+	tests := []struct {
+		desc          string
+		inDestination string
+		inNetwork     func(n *SimulatedNetwork)
+		expected      PMTUResult
+	}{
+		{
+			desc:          "nothing-smaller-on-the-way",
+			inDestination: "192.0.2.1",
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1"}
+			},
+			expected: PMTUResult{PathMTU: 1500},
+		},
+		{
+			desc:          "fragmentation-needed",
+			inDestination: "192.0.2.1",
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1", "198.51.100.2"}
+				n.RouteMTU = []int{0, 1400}
+			},
+			expected: PMTUResult{PathMTU: 1400, Router: "198.51.100.2", ReportedMTU: 1400},
+		},
+		{
+			desc:          "ipv6-packet-too-big",
+			inDestination: "2001:db8::1",
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"2001:db8:ff::1"}
+				n.RouteMTU = []int{1280}
+			},
+			expected: PMTUResult{PathMTU: 1280, Router: "2001:db8:ff::1", ReportedMTU: 1280},
+		},
+		{
+			desc:          "black-hole",
+			inDestination: "192.0.2.1",
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1"}
+				n.RouteMTU = []int{1400}
+				n.Alive = func(address string) bool {
+					return address != "198.51.100.1"
+				}
+			},
+			expected: PMTUResult{PathMTU: 1400, BlackHole: true},
+		},
+		{
+			desc:          "destination-never-answers",
+			inDestination: "192.0.2.1",
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Alive = func(address string) bool {
+					return address != "192.0.2.1"
+				}
+			},
+			expected: PMTUResult{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			network := NewSimulatedNetwork(1)
+			tt.inNetwork(network)
+			options := tracerouteOptions(t, tt.inDestination, 1, 30)
+			options.queries = 2
+			// a 1500 byte packet with either header
+			options.payloadSize = 1472
+			if !options.isIpv4 {
+				options.payloadSize = 1452
+			}
+			pmtu, err := BuildPMTU(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pmtu.Listen = network.Listen
+			var reported []*PMTUProbe
+			pmtu.OnProbe = func(p *PMTUProbe) {
+				reported = append(reported, p)
+			}
+			result, err := pmtu.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.PathMTU != tt.expected.PathMTU || result.Router != tt.expected.Router || result.ReportedMTU != tt.expected.ReportedMTU ||
+				result.BlackHole != tt.expected.BlackHole || result.LocalLimit {
+				t.Errorf("%s: expected %+v got %+v", tt.desc, tt.expected, result)
+			}
+			if len(reported) != len(result.Probes) || len(reported) == 0 {
+				t.Errorf("%s: expected every size reported got %d of %d", tt.desc, len(reported), len(result.Probes))
+			}
+			for _, probe := range result.Probes {
+				reached := probe.Outcome == PMTUReached
+				if reached != (probe.Size <= tt.expected.PathMTU) || probe.Tries < 1 || probe.Tries > 2 {
+					t.Errorf("%s: expected sizes up to %d to get there in 1 or 2 tries got %+v", tt.desc, tt.expected.PathMTU, probe)
+				}
+			}
+			// every reply was checked against the size it was sent with
+			if pmtu.pinger.numCorrupted != 0 {
+				t.Errorf("%s: expected no corrupted replies got %d", tt.desc, pmtu.pinger.numCorrupted)
+			}
+		})
+	}
+}
+
+func TestBuildPMTU(t *testing.T) {
+	if _, err := BuildPMTU(tracerouteOptions(t, "192.0.2.1", 1, 30)); err != nil {
+		t.Errorf("expected a path MTU discovery got %v", err)
+	}
+	if _, err := BuildPMTU(tracerouteOptions(t, "", 1, 30)); err == nil {
+		t.Errorf("expected an error without a destination")
+	}
+	// options from the Parse* calls alone have no tries per size
+	if _, err := BuildPMTU(&PresentOptions{ipAddress: "192.0.2.1", isIpv4: true}); err == nil {
+		t.Errorf("expected an error without tries")
+	}
+}
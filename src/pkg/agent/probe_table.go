@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"time"
+)
+
+// probeWindow is how many of the latest echo requests we remember. It divides
+// 65536, so a slot can be found from the 16 bit sequence on the wire alone.
+const probeWindow = 1024
+
+// probeState is what we remember about one sent echo request.
+type probeState struct {
+	// the full sequence, not just the 16 bits that go on the wire
+	sequence int
+	// when we sent it, by our clock; what its echoed timestamp should say
+	sentAt time.Time
+	// when it left, the kernel's send timestamp (on our clock) if there is one
+	departedAt time.Time
+	departedBy TimestampSource
+	// how many data bytes it carried, 0 for the payload size (-s)
+	size    int
+	replies int
+}
+
+// probeTable remembers the latest echo requests we sent in a fixed ring, so
+// replies can be told apart as duplicated, reordered or late without the
+// table growing on long pings.
+type probeTable struct {
+	probes []probeState
+	// RFC 4737 NextExp: one past the highest sequence a reply came back for
+	nextExpected int
+	// one past the highest sequence sent
+	sentUpTo int
+	// the oldest sequence whose timeout hasn't been checked yet
+	nextToExpire int
+}
+
+// sent remembers an echo request, pushing out the one probeWindow sequences ago.
+func (t *probeTable) sent(sequence int, at time.Time) {
+	if t.probes == nil {
+		t.probes = make([]probeState, probeWindow)
+	}
+	t.probes[sequence%probeWindow] = probeState{sequence: sequence, sentAt: at, departedAt: at, departedBy: TimestampUserspace}
+	t.sentUpTo = sequence + 1
+}
+
+// departed records when an echo request we sent actually left.
+func (t *probeTable) departed(sequence int, at time.Time, source TimestampSource) {
+	probe := &t.probes[sequence%probeWindow]
+	if probe.sequence == sequence {
+		probe.departedAt, probe.departedBy = at, source
+	}
+}
+
+// carried records an echo request that didn't carry the payload size (-s).
+func (t *probeTable) carried(sequence int, size int) {
+	probe := &t.probes[sequence%probeWindow]
+	if probe.sequence == sequence {
+		probe.size = size
+	}
+}
+
+// lookup finds the echo request a reply's wire sequence belongs to, or nil
+// if it fell out of the window (or was never sent).
+func (t *probeTable) lookup(wireSequence int) *probeState {
+	if t.probes == nil {
+		return nil
+	}
+	probe := &t.probes[wireSequence%probeWindow]
+	if probe.sentAt.IsZero() || probe.sequence&0xffff != wireSequence {
+		return nil
+	}
+	return probe
+}
+
+// classify flags a reply for the probe with the given wire sequence as a
+// duplicate, untracked (it fell out of the window, or was never sent, so
+// there is no telling if it is a duplicate), late (arrived more than timeout
+// after it was sent) and/or reordered, in the RFC 4737 sense: its sequence is
+// below NextExp, so a later probe was answered first. The reorder distance is
+// how many sequences behind NextExp it was.
+func (t *probeTable) classify(wireSequence int, arrived time.Time, timeout time.Duration) (duplicate bool, untracked bool, late bool, reorderDistance int) {
+	probe := t.lookup(wireSequence)
+	if probe == nil {
+		return false, true, false, 0
+	}
+	probe.replies++
+	if probe.replies > 1 {
+		return true, false, false, 0
+	}
+	late = timeout > 0 && arrived.Sub(probe.sentAt) > timeout
+	if probe.sequence < t.nextExpected {
+		return false, false, late, t.nextExpected - probe.sequence
+	}
+	t.nextExpected = probe.sequence + 1
+	return false, false, late, 0
+}
+
+// expire gives back the sequences whose timeout passed without a reply, each
+// of them only once. Probes go out in order, so their deadlines do too.
+func (t *probeTable) expire(now time.Time, timeout time.Duration) []int {
+	var expired []int
+	for ; t.nextToExpire < t.sentUpTo; t.nextToExpire++ {
+		probe := &t.probes[t.nextToExpire%probeWindow]
+		if probe.sequence != t.nextToExpire {
+			// pushed out of the window before anyone checked it
+			continue
+		}
+		if now.Sub(probe.sentAt) < timeout {
+			break
+		}
+		if probe.replies == 0 {
+			expired = append(expired, probe.sequence)
+		}
+	}
+	return expired
+}
+
+// nextDeadline is when the oldest probe we haven't checked yet runs out of time.
+func (t *probeTable) nextDeadline(timeout time.Duration) (time.Time, bool) {
+	if t.nextToExpire >= t.sentUpTo {
+		return time.Time{}, false
+	}
+	return t.probes[t.nextToExpire%probeWindow].sentAt.Add(timeout), true
+}
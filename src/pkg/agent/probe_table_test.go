@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests for the sent echo request table
+
+func TestProbeTable_Classify(t *testing.T) {
+	start := time.Unix(1587168212, 0)
+	type reply struct {
+		wireSequence      int
+		after             time.Duration
+		expectedDup       bool
+		expectedUntracked bool
+		expectedLate      bool
+		expectedReorder   int
+	}
+	tests := []struct {
+		desc      string
+		inSent    int
+		inTimeout time.Duration
+		replies   []reply
+	}{
+		{
+			desc:   "in-order",
+			inSent: 3,
+			replies: []reply{
+				{wireSequence: 0},
+				{wireSequence: 1},
+				{wireSequence: 2},
+			},
+		},
+		{
+			desc:   "duplicate",
+			inSent: 2,
+			replies: []reply{
+				{wireSequence: 0},
+				{wireSequence: 0, expectedDup: true},
+				{wireSequence: 1},
+			},
+		},
+		{
+			desc:   "reordered",
+			inSent: 4,
+			replies: []reply{
+				{wireSequence: 3},
+				{wireSequence: 1, expectedReorder: 3},
+				{wireSequence: 2, expectedReorder: 2},
+				{wireSequence: 0, expectedReorder: 4},
+			},
+		},
+		{
+			desc:      "late",
+			inSent:    2,
+			inTimeout: time.Second,
+			replies: []reply{
+				{wireSequence: 0, after: 500 * time.Millisecond},
+				{wireSequence: 1, after: 3 * time.Second, expectedLate: true},
+			},
+		},
+		{
+			desc:   "never-sent",
+			inSent: 1,
+			replies: []reply{
+				{wireSequence: 5, expectedUntracked: true},
+			},
+		},
+		{
+			desc:   "fell-out-of-the-window",
+			inSent: probeWindow + 1,
+			replies: []reply{
+				{wireSequence: 0, expectedUntracked: true},
+				// and so is a DUP! of it
+				{wireSequence: 0, expectedUntracked: true},
+				{wireSequence: probeWindow},
+			},
+		},
+		{
+			desc:   "wire-sequence-wraps",
+			inSent: 65537,
+			replies: []reply{
+				{wireSequence: 0},
+				{wireSequence: 65535, expectedReorder: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var table probeTable
+			for sequence := 0; sequence < tt.inSent; sequence++ {
+				table.sent(sequence, start)
+			}
+			for _, r := range tt.replies {
+				dup, untracked, late, reorder := table.classify(r.wireSequence, start.Add(r.after), tt.inTimeout)
+				if dup != r.expectedDup || untracked != r.expectedUntracked || late != r.expectedLate || reorder != r.expectedReorder {
+					t.Errorf("%s: seq %d expected dup/untracked/late/reorder %v/%v/%v/%v got %v/%v/%v/%v", tt.desc, r.wireSequence,
+						r.expectedDup, r.expectedUntracked, r.expectedLate, r.expectedReorder, dup, untracked, late, reorder)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTable_Expire(t *testing.T) {
+	start := time.Unix(1587168212, 0)
+	tests := []struct {
+		desc             string
+		inSent           int
+		inAnswered       []int
+		inNow            time.Duration
+		expectedExpired  []int
+		expectedDeadline time.Duration
+		expectedPending  bool
+	}{
+		{
+			desc:             "nothing-due",
+			inSent:           3,
+			inNow:            500 * time.Millisecond,
+			expectedDeadline: time.Second,
+			expectedPending:  true,
+		},
+		{
+			desc:             "some-due",
+			inSent:           3,
+			inNow:            2500 * time.Millisecond,
+			expectedExpired:  []int{0, 1},
+			expectedDeadline: 3 * time.Second,
+			expectedPending:  true,
+		},
+		{
+			desc:            "answered-are-not-expired",
+			inSent:          3,
+			inAnswered:      []int{1},
+			inNow:           10 * time.Second,
+			expectedExpired: []int{0, 2},
+		},
+		{
+			desc:   "nothing-sent",
+			inSent: 0,
+			inNow:  10 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var table probeTable
+			// one probe a second, each with a second to be answered
+			for sequence := 0; sequence < tt.inSent; sequence++ {
+				table.sent(sequence, start.Add(time.Duration(sequence)*time.Second))
+			}
+			for _, sequence := range tt.inAnswered {
+				table.classify(sequence, start, time.Second)
+			}
+			expired := table.expire(start.Add(tt.inNow), time.Second)
+			if len(expired) != len(tt.expectedExpired) {
+				t.Fatalf("%s: expected %v expired got %v", tt.desc, tt.expectedExpired, expired)
+			}
+			for i := range expired {
+				if expired[i] != tt.expectedExpired[i] {
+					t.Errorf("%s: expected %v expired got %v", tt.desc, tt.expectedExpired, expired)
+				}
+			}
+			// a probe is only ever reported once
+			if again := table.expire(start.Add(tt.inNow), time.Second); len(again) != 0 {
+				t.Errorf("%s: expired %v twice", tt.desc, again)
+			}
+			deadline, pending := table.nextDeadline(time.Second)
+			if pending != tt.expectedPending || (pending && !deadline.Equal(start.Add(tt.expectedDeadline))) {
+				t.Errorf("%s: expected next deadline %v %v got %v %v", tt.desc, start.Add(tt.expectedDeadline), tt.expectedPending, deadline, pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// sketchAccuracy is the relative error of every quantile the sketch gives back (1%).
+const sketchAccuracy = 0.01
+
+// maxSketchBuckets bounds the sketch's memory. 1% buckets from 1µs to an hour
+// only need about 1100 of them, so collapsing should never happen in practice.
+const maxSketchBuckets = 2048
+
+// RTTStatistics keeps round trip time statistics in constant memory, no matter
+// how long the ping runs: a running mean/variance (Welford), the min and max,
+// and a DDSketch for percentiles. Two of them can be merged, e.g. to combine
+// targets. The zero value is ready to use.
+type RTTStatistics struct {
+	count int
+	// Welford's running mean and sum of squared differences from it, in nanoseconds
+	mean float64
+	m2   float64
+	min  time.Duration
+	max  time.Duration
+	// DDSketch: bucket i counts the RTTs in (gamma^(i-1), gamma^i] nanoseconds
+	buckets   map[int]int
+	zeroCount int
+}
+
+// Add logs one round trip time.
+func (r *RTTStatistics) Add(rtt time.Duration) {
+	if r.count == 0 || rtt < r.min {
+		r.min = rtt
+	}
+	if r.count == 0 || rtt > r.max {
+		r.max = rtt
+	}
+	r.count++
+	delta := float64(rtt) - r.mean
+	r.mean += delta / float64(r.count)
+	r.m2 += delta * (float64(rtt) - r.mean)
+	if rtt <= 0 {
+		r.zeroCount++
+		return
+	}
+	if r.buckets == nil {
+		r.buckets = make(map[int]int)
+	}
+	r.buckets[sketchIndex(rtt)]++
+	if len(r.buckets) > maxSketchBuckets {
+		r.collapse()
+	}
+}
+
+// Merge folds other's round trip times into r.
+func (r *RTTStatistics) Merge(other *RTTStatistics) {
+	if other == nil || other.count == 0 {
+		return
+	}
+	if r.count == 0 || other.min < r.min {
+		r.min = other.min
+	}
+	if r.count == 0 || other.max > r.max {
+		r.max = other.max
+	}
+	// Chan et al. parallel variance
+	total := float64(r.count + other.count)
+	delta := other.mean - r.mean
+	r.m2 += other.m2 + delta*delta*float64(r.count)*float64(other.count)/total
+	r.mean += delta * float64(other.count) / total
+	r.count += other.count
+	r.zeroCount += other.zeroCount
+	if r.buckets == nil {
+		r.buckets = make(map[int]int)
+	}
+	for index, count := range other.buckets {
+		r.buckets[index] += count
+	}
+	for len(r.buckets) > maxSketchBuckets {
+		r.collapse()
+	}
+}
+
+// Clone gives back a copy that doesn't change when r does.
+func (r *RTTStatistics) Clone() *RTTStatistics {
+	clone := *r
+	clone.buckets = make(map[int]int, len(r.buckets))
+	for index, count := range r.buckets {
+		clone.buckets[index] = count
+	}
+	return &clone
+}
+
+// Count is how many round trip times were logged.
+func (r *RTTStatistics) Count() int {
+	return r.count
+}
+
+func (r *RTTStatistics) Min() time.Duration {
+	return r.min
+}
+
+func (r *RTTStatistics) Max() time.Duration {
+	return r.max
+}
+
+func (r *RTTStatistics) Mean() time.Duration {
+	return time.Duration(r.mean)
+}
+
+// StdDev is the population standard deviation, which is what iputils calls mdev.
+func (r *RTTStatistics) StdDev() time.Duration {
+	if r.count == 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(r.m2 / float64(r.count)))
+}
+
+// Percentile gives the nearest-rank percentile (0-100), within 1% of the
+// exact value, or 0 when nothing was logged.
+func (r *RTTStatistics) Percentile(percent float64) time.Duration {
+	if r.count == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(percent / 100 * float64(r.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank <= r.zeroCount {
+		return r.clamp(0)
+	}
+	indexes := make([]int, 0, len(r.buckets))
+	for index := range r.buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	seen := r.zeroCount
+	for _, index := range indexes {
+		seen += r.buckets[index]
+		if seen >= rank {
+			return r.clamp(sketchValue(index))
+		}
+	}
+	return r.max
+}
+
+// clamp keeps a bucket's estimate inside what we actually saw.
+func (r *RTTStatistics) clamp(rtt time.Duration) time.Duration {
+	if rtt < r.min {
+		return r.min
+	}
+	if rtt > r.max {
+		return r.max
+	}
+	return rtt
+}
+
+// collapse merges the two lowest buckets, trading accuracy on the fastest
+// replies for bounded memory.
+func (r *RTTStatistics) collapse() {
+	lowest, second := math.MaxInt64, math.MaxInt64
+	for index := range r.buckets {
+		if index < lowest {
+			lowest, second = index, lowest
+		} else if index < second {
+			second = index
+		}
+	}
+	r.buckets[second] += r.buckets[lowest]
+	delete(r.buckets, lowest)
+}
+
+func sketchGamma() float64 {
+	return (1 + sketchAccuracy) / (1 - sketchAccuracy)
+}
+
+// sketchIndex is the bucket a (positive) round trip time falls in.
+func sketchIndex(rtt time.Duration) int {
+	return int(math.Ceil(math.Log(float64(rtt)) / math.Log(sketchGamma())))
+}
+
+// sketchValue is the estimate for a bucket, within sketchAccuracy of anything in it.
+func sketchValue(index int) time.Duration {
+	gamma := sketchGamma()
+	return time.Duration(2 * math.Pow(gamma, float64(index)) / (gamma + 1))
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Tests for the streaming round trip time statistics
+
+// withinAccuracy is true when got is within the sketch's relative accuracy of expected.
+func withinAccuracy(got time.Duration, expected time.Duration) bool {
+	difference := float64(got - expected)
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference <= sketchAccuracy*float64(expected)
+}
+
+func TestRTTStatistics_Spread(t *testing.T) {
+	tests := []struct {
+		desc         string
+		in           []time.Duration
+		expectedMin  time.Duration
+		expectedMax  time.Duration
+		expectedMean time.Duration
+		expectedMdev time.Duration
+	}{
+		{
+			desc: "no-replies",
+			in:   nil,
+		},
+		{
+			desc:         "one-reply",
+			in:           []time.Duration{5 * time.Millisecond},
+			expectedMin:  5 * time.Millisecond,
+			expectedMax:  5 * time.Millisecond,
+			expectedMean: 5 * time.Millisecond,
+		},
+		{
+			desc:         "spread",
+			in:           []time.Duration{2, 4, 4, 4, 5, 5, 7, 9},
+			expectedMin:  2,
+			expectedMax:  9,
+			expectedMean: 5,
+			expectedMdev: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var r RTTStatistics
+			for _, rtt := range tt.in {
+				r.Add(rtt)
+			}
+			if r.Min() != tt.expectedMin || r.Max() != tt.expectedMax || r.Mean() != tt.expectedMean || r.StdDev() != tt.expectedMdev || r.Count() != len(tt.in) {
+				t.Errorf("%s: expected min/avg/max/mdev %v/%v/%v/%v got %v/%v/%v/%v", tt.desc, tt.expectedMin, tt.expectedMean,
+					tt.expectedMax, tt.expectedMdev, r.Min(), r.Mean(), r.Max(), r.StdDev())
+			}
+		})
+	}
+}
+
+func TestRTTStatistics_Percentile(t *testing.T) {
+	// log-normal-ish RTTs around a millisecond, compared against the exact nearest rank
+	random := rand.New(rand.NewSource(1))
+	var rtts []time.Duration
+	for i := 0; i < 100000; i++ {
+		rtts = append(rtts, time.Duration(float64(time.Millisecond)*random.ExpFloat64())+time.Microsecond)
+	}
+	var r RTTStatistics
+	for _, rtt := range rtts {
+		r.Add(rtt)
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	tests := []struct {
+		desc      string
+		inPercent float64
+		expected  time.Duration
+	}{
+		{desc: "p0", inPercent: 0, expected: rtts[0]},
+		{desc: "median", inPercent: 50, expected: rtts[49999]},
+		{desc: "p90", inPercent: 90, expected: rtts[89999]},
+		{desc: "p99", inPercent: 99, expected: rtts[98999]},
+		{desc: "p100", inPercent: 100, expected: rtts[99999]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if percentile := r.Percentile(tt.inPercent); !withinAccuracy(percentile, tt.expected) {
+				t.Errorf("%s: expected %v got %v", tt.desc, tt.expected, percentile)
+			}
+		})
+	}
+	if len(r.buckets) > maxSketchBuckets {
+		t.Errorf("sketch grew to %d buckets", len(r.buckets))
+	}
+}
+
+func TestRTTStatistics_Merge(t *testing.T) {
+	var all, first, second RTTStatistics
+	for i := 1; i <= 1000; i++ {
+		rtt := time.Duration(i) * time.Microsecond
+		all.Add(rtt)
+		if i%3 == 0 {
+			first.Add(rtt)
+		} else {
+			second.Add(rtt)
+		}
+	}
+	first.Merge(&second)
+	if first.Count() != all.Count() || first.Min() != all.Min() || first.Max() != all.Max() ||
+		first.Mean() != all.Mean() || !withinAccuracy(first.StdDev(), all.StdDev()) || first.Percentile(90) != all.Percentile(90) {
+		t.Errorf("merged statistics differ: expected %v %v/%v/%v/%v p90 %v got %v %v/%v/%v/%v p90 %v", all.Count(), all.Min(), all.Mean(),
+			all.Max(), all.StdDev(), all.Percentile(90), first.Count(), first.Min(), first.Mean(), first.Max(), first.StdDev(), first.Percentile(90))
+	}
+}
+
+func TestRTTStatistics_Clone(t *testing.T) {
+	var r RTTStatistics
+	r.Add(time.Millisecond)
+	clone := r.Clone()
+	r.Add(time.Second)
+	if clone.Count() != 1 || clone.Percentile(100) != time.Millisecond {
+		t.Errorf("clone changed with the original: %v %v", clone.Count(), clone.Percentile(100))
+	}
+}
@@ -0,0 +1,327 @@
+package agent
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// SimulatedNetwork is an in-memory network that answers echo requests,
+// for testing pingers without root or a network: point a pinger's Listen
+// at its Listen. Every random decision comes from its seed, so the same
+// seed loses, duplicates and reorders the same replies every time.
+type SimulatedNetwork struct {
+	// how long a reply takes to come back, plus up to Jitter more
+	Latency time.Duration
+	Jitter  time.Duration
+	// chance (0 to 1) an echo request or its reply gets lost
+	Loss float64
+	// chance a reply comes back twice
+	Duplication float64
+	// chance a reply is held back ReorderDelay more, so later ones overtake it
+	Reordering   float64
+	ReorderDelay time.Duration
+	// what replies arrive with, 64 if unset
+	TTL int
+	// which addresses answer (routers on the Route too), every one of them if unset
+	Alive func(address string) bool
+	// the routers between us and every destination, nearest first: an echo
+	// request whose TTL runs out at one of them gets a Time Exceeded from it
+	Route []string
+	// routes a load balancer spreads echo requests over by their sequence,
+	// one after another; Route is the only one if unset
+	Paths [][]string
+	// the MTU of the link after each router on the route, 0 for no limit: a
+	// bigger echo request with Don't Fragment set (always on ipv6) is dropped
+	// there and the router sends back a Fragmentation Needed (Packet Too Big)
+	// with the MTU, unless Alive says it doesn't answer
+	RouteMTU []int
+	// where replies wait their latency, give it the pinger's FakeClock to
+	// run in fake time; the real time if nil
+	Clock Clock
+
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+// NewSimulatedNetwork makes a network that answers every echo request right away, losing none of them.
+func NewSimulatedNetwork(seed int64) *SimulatedNetwork {
+	return &SimulatedNetwork{random: rand.New(rand.NewSource(seed))}
+}
+
+// Listen opens a Transport of an address family on the network.
+func (n *SimulatedNetwork) Listen(isIpv4 bool) (Transport, error) {
+	return &simulatedTransport{
+		network: n,
+		isIpv4:  isIpv4,
+		inbox:   make(chan simulatedMessage, simulatedInboxSize),
+		closed:  make(chan bool),
+	}, nil
+}
+
+// simulatedInboxSize is how many replies can wait to be read, like a socket
+// buffer the ones that don't fit are dropped.
+const simulatedInboxSize = 1024
+
+// simulatedDelivery is what happens to one echo request.
+type simulatedDelivery struct {
+	// nothing comes back
+	lost bool
+	// when its replies come back
+	delays []time.Duration
+}
+
+// deliver decides what happens to an echo request to an address.
+func (n *SimulatedNetwork) deliver(address string) simulatedDelivery {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.random == nil {
+		n.random = rand.New(rand.NewSource(0))
+	}
+	if n.Alive != nil && !n.Alive(address) {
+		return simulatedDelivery{lost: true}
+	}
+	if n.random.Float64() < n.Loss {
+		return simulatedDelivery{lost: true}
+	}
+	delay := n.Latency
+	if n.Jitter > 0 {
+		delay += time.Duration(n.random.Int63n(int64(n.Jitter)))
+	}
+	if n.random.Float64() < n.Reordering {
+		delay += n.ReorderDelay
+	}
+	delays := []time.Duration{delay}
+	if n.random.Float64() < n.Duplication {
+		delays = append(delays, delay)
+	}
+	return simulatedDelivery{delays: delays}
+}
+
+// route is the routers an echo request with a sequence goes through.
+func (n *SimulatedNetwork) route(sequence int) []string {
+	if len(n.Paths) == 0 {
+		return n.Route
+	}
+	return n.Paths[sequence%len(n.Paths)]
+}
+
+// mtu is the MTU of the link after the router at an index of the route.
+func (n *SimulatedNetwork) mtu(index int) int {
+	if index >= len(n.RouteMTU) {
+		return 0
+	}
+	return n.RouteMTU[index]
+}
+
+func (n *SimulatedNetwork) ttl() int {
+	if n.TTL == 0 {
+		return 64
+	}
+	return n.TTL
+}
+
+// simulatedMessage is a reply waiting to be read.
+type simulatedMessage struct {
+	data   []byte
+	ttl    int
+	source net.IP
+}
+
+// simulatedTransport is one address family's end of a SimulatedNetwork.
+type simulatedTransport struct {
+	network *SimulatedNetwork
+	isIpv4  bool
+	inbox   chan simulatedMessage
+	closed  chan bool
+	once    sync.Once
+	lock    sync.Mutex
+	// zero reads forever
+	deadline time.Time
+	// what echo requests go out with, 0 for the default of 64
+	outgoingTTL  int
+	dontFragment bool
+}
+
+func (t *simulatedTransport) WriteTo(b []byte, destination *net.IPAddr) (int, error) {
+	if t.isClosed() {
+		return 0, errClosedTransport
+	}
+	message, err := icmp.ParseMessage(icmpProtocol(t.isIpv4), b)
+	if err != nil {
+		return 0, err
+	}
+	echo, ok := message.Body.(*icmp.Echo)
+	if !ok || message.Type != echoRequestType(t.isIpv4) {
+		// only echo requests get an answer
+		return len(b), nil
+	}
+	reply := &icmp.Message{Type: echoReplyType(t.isIpv4), Body: &icmp.Echo{ID: echo.ID, Seq: echo.Seq, Data: echo.Data}}
+	source := destination.IP
+	hop := t.hop()
+	for i, router := range t.network.route(echo.Seq) {
+		if hop == i+1 {
+			// it ran out of TTL on the way
+			source = net.ParseIP(router)
+			reply = &icmp.Message{Type: timeExceededType(t.isIpv4), Body: &icmp.TimeExceeded{Data: t.quote(b, destination.IP)}}
+			break
+		}
+		if mtu := t.network.mtu(i); mtu > 0 && t.packetSize(b) > mtu && t.unfragmented() {
+			source = net.ParseIP(router)
+			reply = t.tooBig(b, destination.IP, mtu)
+			break
+		}
+	}
+	delivery := t.network.deliver(source.String())
+	if delivery.lost {
+		return len(b), nil
+	}
+	data, err := reply.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	received := simulatedMessage{data: data, ttl: t.network.ttl(), source: source}
+	for _, delay := range delivery.delays {
+		clockOrReal(t.network.Clock).AfterFunc(delay, func() {
+			t.receive(received)
+		})
+	}
+	return len(b), nil
+}
+
+// hop is how far our echo requests get before their TTL runs out.
+func (t *simulatedTransport) hop() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.outgoingTTL == 0 {
+		return 64
+	}
+	return t.outgoingTTL
+}
+
+// packetSize is how big an echo request is with its IP header.
+func (t *simulatedTransport) packetSize(request []byte) int {
+	if t.isIpv4 {
+		return len(request) + 20
+	}
+	return len(request) + 40
+}
+
+// unfragmented is true when routers can't fragment our echo requests.
+func (t *simulatedTransport) unfragmented() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dontFragment || !t.isIpv4
+}
+
+// tooBig is a router's Fragmentation Needed (Packet Too Big on ipv6) for an
+// echo request bigger than the next link's MTU.
+func (t *simulatedTransport) tooBig(request []byte, destination net.IP, mtu int) *icmp.Message {
+	quoted := t.quote(request, destination)
+	if !t.isIpv4 {
+		return &icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Body: &icmp.PacketTooBig{MTU: mtu, Data: quoted}}
+	}
+	// the next hop MTU goes where a Destination Unreachable has unused bytes
+	body := append([]byte{0, 0, byte(mtu >> 8), byte(mtu)}, quoted...)
+	return &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: fragmentationNeeded, Body: &icmp.RawBody{Data: body}}
+}
+
+// quote is what a router sends back of an echo request it dropped: the IP
+// header it came with, then the request itself.
+func (t *simulatedTransport) quote(request []byte, destination net.IP) []byte {
+	var header []byte
+	if t.isIpv4 {
+		header = make([]byte, 20)
+		header[0] = 0x45
+		header[9] = 1
+		copy(header[16:], destination.To4())
+	} else {
+		header = make([]byte, 40)
+		header[0] = 0x60
+		header[6] = 58
+		copy(header[24:], destination.To16())
+	}
+	return append(header, request...)
+}
+
+// receive puts a reply in the inbox, unless it is full or closed.
+func (t *simulatedTransport) receive(message simulatedMessage) {
+	select {
+	case <-t.closed:
+	case t.inbox <- message:
+	default:
+	}
+}
+
+func (t *simulatedTransport) ReadFrom(b []byte) (int, int, net.IP, error) {
+	t.lock.Lock()
+	deadline := t.deadline
+	t.lock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		clock := clockOrReal(t.network.Clock)
+		timer := clock.NewTimer(deadline.Sub(clock.Now()))
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case <-t.closed:
+		return 0, 0, nil, errClosedTransport
+	case <-timeout:
+		return 0, 0, nil, simulatedTimeout{}
+	case message := <-t.inbox:
+		return copy(b, message.data), message.ttl, message.source, nil
+	}
+}
+
+func (t *simulatedTransport) SetTTL(ttl int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.outgoingTTL = ttl
+	return nil
+}
+
+func (t *simulatedTransport) SetDontFragment() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.dontFragment = true
+	return nil
+}
+
+func (t *simulatedTransport) SetReadDeadline(deadline time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.deadline = deadline
+	return nil
+}
+
+func (t *simulatedTransport) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+func (t *simulatedTransport) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+var errClosedTransport = errors.New("use of a closed simulated transport")
+
+// simulatedTimeout is what reads give back once their deadline passes.
+type simulatedTimeout struct{}
+
+func (simulatedTimeout) Error() string   { return "i/o timeout" }
+func (simulatedTimeout) Timeout() bool   { return true }
+func (simulatedTimeout) Temporary() bool { return true }
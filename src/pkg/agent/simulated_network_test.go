@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+// End to end tests of the pingers over a SimulatedNetwork
+
+// simulatedOptions are quick settings for pinging over a simulated network.
+func simulatedOptions(t *testing.T, destination string, count int) *PresentOptions {
+	settings := DefaultOptions()
+	settings.Destination = destination
+	settings.Count = count
+	settings.Interval = 10 * time.Millisecond
+	settings.Deadline = 100 * time.Millisecond
+	settings.ProbeTimeout = 50 * time.Millisecond
+	options, err := BuildOptions(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+func TestPingerAgent_Run_SimulatedNetwork(t *testing.T) {
+	tests := []struct {
+		desc               string
+		inDestination      string
+		inCount            int
+		inNetwork          func(n *SimulatedNetwork)
+		expectedReceived   int
+		expectedLost       int
+		expectedTimedOut   int
+		expectedDuplicates bool
+		expectedReordered  bool
+	}{
+		{
+			desc:          "clean",
+			inDestination: "192.0.2.1",
+			inCount:       5,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Latency = time.Millisecond
+				n.TTL = 57
+			},
+			expectedReceived: 5,
+		},
+		{
+			desc:          "clean-ipv6",
+			inDestination: "2001:db8::1",
+			inCount:       5,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Latency = time.Millisecond
+			},
+			expectedReceived: 5,
+		},
+		{
+			desc:          "everything-lost",
+			inDestination: "192.0.2.1",
+			inCount:       3,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Loss = 1
+			},
+			expectedLost:     3,
+			expectedTimedOut: 3,
+		},
+		{
+			desc:          "duplicated",
+			inDestination: "192.0.2.1",
+			inCount:       5,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Latency = time.Millisecond
+				n.Duplication = 1
+			},
+			expectedReceived:   5,
+			expectedDuplicates: true,
+		},
+		{
+			desc:          "reordered",
+			inDestination: "192.0.2.1",
+			inCount:       10,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Latency = time.Millisecond
+				n.Reordering = 0.5
+				n.ReorderDelay = 25 * time.Millisecond
+			},
+			expectedReceived:  10,
+			expectedReordered: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			network := NewSimulatedNetwork(1)
+			tt.inNetwork(network)
+			pinger := BuildPinger(simulatedOptions(t, tt.inDestination, tt.inCount))
+			pinger.Listen = network.Listen
+			var sent, replies []int
+			pinger.OnEchoSent = func(sequence int, destination string) {
+				sent = append(sent, sequence)
+			}
+			pinger.OnEchoComplete = func(p *PingPacket, exceededTTL bool) {
+				if p.DestinationAddress != tt.inDestination || p.TimeToLive != network.ttl() {
+					t.Errorf("%s: unexpected reply %+v", tt.desc, p)
+				}
+				if !p.Duplicate {
+					replies = append(replies, p.ICMPSequenceNumber)
+				}
+			}
+			stats, err := pinger.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.PacketsReceived != tt.expectedReceived || stats.PacketsLost != tt.expectedLost || stats.TimedOutProbes != tt.expectedTimedOut {
+				t.Errorf("%s: expected %d received, %d lost, %d timed out got %+v", tt.desc, tt.expectedReceived, tt.expectedLost,
+					tt.expectedTimedOut, stats)
+			}
+			if (stats.DuplicateReplies > 0) != tt.expectedDuplicates || (stats.ReorderedReplies > 0) != tt.expectedReordered {
+				t.Errorf("%s: expected duplicates %v and reordering %v got %+v", tt.desc, tt.expectedDuplicates, tt.expectedReordered, stats)
+			}
+			if len(sent) != tt.inCount {
+				t.Errorf("%s: expected %d echo requests got %v", tt.desc, tt.inCount, sent)
+			}
+			// every reply is one of ours, once
+			sort.Ints(replies)
+			for i, sequence := range replies {
+				if sequence != i {
+					t.Errorf("%s: expected replies to sequences 0 to %d got %v", tt.desc, len(replies)-1, replies)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestPingerAgent_Run_Cancelled(t *testing.T) {
+	network := NewSimulatedNetwork(1)
+	network.Loss = 1
+	pinger := BuildPinger(simulatedOptions(t, "192.0.2.1", 1000))
+	pinger.Listen = network.Listen
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stats, err := pinger.Run(ctx)
+	if err != nil || stats == nil {
+		t.Fatalf("expected statistics and no error got %+v and %v", stats, err)
+	}
+	if sent := stats.PacketsReceived + stats.PacketsLost; sent == 0 || sent >= 1000 {
+		t.Errorf("expected the ping to be cut short got %d echo requests", sent)
+	}
+	// stopping afterwards is fine too
+	pinger.Stop()
+}
+
+func TestMultiPingerAgent_Run_SimulatedNetwork(t *testing.T) {
+	network := NewSimulatedNetwork(1)
+	network.Latency = time.Millisecond
+	network.Alive = func(address string) bool {
+		return address != "192.0.2.2"
+	}
+	options := simulatedOptions(t, "", 3)
+	pinger, err := BuildMultiPinger(options, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinger.Listen = network.Listen
+	stats, err := pinger.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"192.0.2.1": 3, "192.0.2.2": 0, "2001:db8::1": 3}
+	for _, target := range stats {
+		if target.PacketsReceived != expected[target.Destination] || target.PacketsReceived+target.PacketsLost != 3 {
+			t.Errorf("expected %d replies from %s got %+v", expected[target.Destination], target.Destination, target)
+		}
+	}
+}
+
+func TestSweepAgent_Run_SimulatedNetwork(t *testing.T) {
+	network := NewSimulatedNetwork(1)
+	network.Alive = func(address string) bool {
+		return address == "192.0.2.1" || address == "192.0.2.6"
+	}
+	options := simulatedOptions(t, "", 1)
+	// without a timeout the sweep is done once every address is
+	options.timeout = 0
+	sweeper, err := BuildSweeper(options, []string{"192.0.2.0/29"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sweeper.Listen = network.Listen
+	var alive []string
+	sweeper.OnHostAlive = func(r *SweepResult) {
+		alive = append(alive, r.Address)
+	}
+	results, err := sweeper.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 6 || len(alive) != 2 || alive[0] != "192.0.2.1" || alive[1] != "192.0.2.6" {
+		t.Errorf("expected 192.0.2.1 and 192.0.2.6 alive out of 6 got %v out of %d", alive, len(results))
+	}
+}
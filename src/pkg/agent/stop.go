@@ -0,0 +1,29 @@
+package agent
+
+import "sync"
+
+// stopSignal is closed once to tell every goroutine of a ping to stop,
+// no matter how many of them (or how many times) ask for it.
+type stopSignal struct {
+	once sync.Once
+	done chan bool
+}
+
+func newStopSignal() *stopSignal {
+	return &stopSignal{done: make(chan bool)}
+}
+
+func (s *stopSignal) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *stopSignal) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
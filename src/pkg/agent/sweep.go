@@ -0,0 +1,387 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSweepAddresses caps a sweep so a typo like /8 doesn't send 16 million packets.
+// It also keeps every probe's 16 bit ICMP sequence number unique.
+const maxSweepAddresses = 65536
+
+// SweepResult is what a sweep found out about one address.
+type SweepResult struct {
+	Address       string
+	Alive         bool
+	RoundTripTime time.Duration
+	TimeToLive    int
+}
+
+// sweepProbe is an echo request we are still waiting on an answer for.
+type sweepProbe struct {
+	result  *SweepResult
+	expires time.Time
+}
+
+// AddressFilter decides which addresses a sweep is allowed to touch.
+// Blocked networks always win, and when there is an allowlist an address
+// needs to be inside it.
+type AddressFilter struct {
+	allowed []*net.IPNet
+	blocked []*net.IPNet
+}
+
+// SweepAgent sends one echo request to every address of a set of CIDR blocks
+// or ranges, at a global packet rate, and reports which hosts answered.
+type SweepAgent struct {
+	options PresentOptions
+	// one result per address, in the order they are probed
+	results []*SweepResult
+	// one pinger per address family, they do the actual sending and matching
+	pingers map[bool]*PingerAgent
+	// address family -> ICMP sequence -> probe still waiting on a reply
+	outstanding map[bool]map[int]*sweepProbe
+	stopPing    *stopSignal
+	// Callbacks to the main function, one per live host and one when we are done.
+	OnHostAlive func(r *SweepResult)
+	// a probe that couldn't be sent, or a reply we couldn't make sense of
+	OnError         func(err error)
+	OnSweepComplete func(r []*SweepResult)
+	// opens the Transport of an address family instead of an ICMP socket
+	Listen func(isIpv4 bool) (Transport, error)
+	// where the time, timers and tickers come from, the real time if nil
+	Clock Clock
+}
+
+// BuildSweeper expands every CIDR block or range, drops what the filter
+// doesn't permit, and builds the pingers to probe what's left.
+func BuildSweeper(options *PresentOptions, specs []string, filter *AddressFilter) (*SweepAgent, error) {
+	s := &SweepAgent{
+		options:     *options,
+		pingers:     make(map[bool]*PingerAgent),
+		outstanding: make(map[bool]map[int]*sweepProbe),
+		stopPing:    newStopSignal(),
+	}
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		addresses, err := ExpandAddresses(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			if seen[address.String()] || (filter != nil && !filter.Permits(address)) {
+				continue
+			}
+			seen[address.String()] = true
+			s.results = append(s.results, &SweepResult{Address: address.String()})
+		}
+		if len(s.results) > maxSweepAddresses {
+			return nil, fmt.Errorf("a sweep can cover at most %d addresses", maxSweepAddresses)
+		}
+	}
+	if len(s.results) == 0 {
+		return nil, errors.New("nothing left to sweep after the allow/block lists")
+	}
+	for _, result := range s.results {
+		isIpv4 := net.ParseIP(result.Address).To4() != nil
+		if _, ok := s.pingers[isIpv4]; ok {
+			continue
+		}
+		familyOptions := *options
+		if err := familyOptions.ParseIPAddress(result.Address); err != nil {
+			return nil, err
+		}
+		pinger := BuildPinger(&familyOptions)
+		pinger.stopPing = s.stopPing
+		s.pingers[isIpv4] = pinger
+		s.outstanding[isIpv4] = make(map[int]*sweepProbe)
+	}
+	return s, nil
+}
+
+// Driver probes every address at the configured rate, collects the replies
+// and gives up on each probe once its deadline passes.
+func (s *SweepAgent) Driver() {
+	s.Run(context.Background())
+}
+
+// Run is Driver that also stops once ctx is done, and gives back a result
+// for every address. It gives back an error when a socket couldn't be
+// opened (then there are no results) or receiving failed.
+func (s *SweepAgent) Run(ctx context.Context) ([]*SweepResult, error) {
+	connections := make(map[bool]Transport)
+	packetChannels := make(map[bool]chan *PingPacket)
+	var waitGroup sync.WaitGroup
+	for isIpv4, pinger := range s.pingers {
+		pinger.Listen = s.Listen
+		pinger.Clock = s.Clock
+		connection, err := pinger.openTransport()
+		if err != nil {
+			s.stop()
+			closeConnections(connections)
+			drainReceivers(&waitGroup, packetChannels)
+			return nil, err
+		}
+		connections[isIpv4] = connection
+		packetChannels[isIpv4] = make(chan *PingPacket, 64)
+		waitGroup.Add(1)
+		go pinger.ReceiveICMPPacket(connection, packetChannels[isIpv4], &waitGroup)
+	}
+	clock := clockOrReal(s.Clock)
+	rateTicker := clock.NewTicker(time.Second / time.Duration(s.options.rate))
+	defer rateTicker.Stop()
+	var timeout <-chan time.Time
+	if s.options.timeout > 0 {
+		timeoutTimer := clock.NewTimer(s.options.timeout)
+		defer timeoutTimer.Stop()
+		timeout = timeoutTimer.C()
+	}
+	next := 0
+	var lastCall <-chan time.Time
+	for !s.stopPing.stopped() {
+		select {
+		// Ctrl+C, or a receiver gave up
+		case <-s.stopPing.done:
+		case <-ctx.Done():
+			s.stop()
+		case <-timeout:
+			s.stop()
+		case <-lastCall:
+			s.stop()
+		case now := <-rateTicker.C():
+			s.expire(now)
+			if next < len(s.results) {
+				s.probe(connections, s.results[next])
+				next++
+			}
+		case receivedPacket := <-packetChannels[true]:
+			s.collect(receivedPacket, true)
+		case receivedPacket := <-packetChannels[false]:
+			s.collect(receivedPacket, false)
+		}
+		if next == len(s.results) {
+			if len(s.outstanding[true])+len(s.outstanding[false]) == 0 {
+				s.stop()
+			}
+			if lastCall == nil {
+				lastCallTimer := clock.NewTimer(s.options.deadline)
+				defer lastCallTimer.Stop()
+				lastCall = lastCallTimer.C()
+			}
+		}
+	}
+	// closing the connections is what gets the receivers out of a read right away
+	closeConnections(connections)
+	drainReceivers(&waitGroup, packetChannels)
+	completeHandler := s.OnSweepComplete
+	if completeHandler != nil {
+		completeHandler(s.results)
+	}
+	for _, pinger := range s.pingers {
+		if pinger.receiveErr != nil {
+			return s.results, pinger.receiveErr
+		}
+	}
+	return s.results, nil
+}
+
+// Stop notifies all goroutines to stop, whatever hasn't answered yet is reported as down.
+func (s *SweepAgent) Stop() {
+	s.stop()
+}
+
+func (s *SweepAgent) stop() {
+	s.stopPing.stop()
+}
+
+// probe sends the echo request for one address and starts waiting on it.
+func (s *SweepAgent) probe(connections map[bool]Transport, result *SweepResult) {
+	isIpv4 := net.ParseIP(result.Address).To4() != nil
+	pinger := s.pingers[isIpv4]
+	// the sequence goes out on the wire as 16 bits
+	sequence := pinger.sequence & 0xffff
+	if err := pinger.sendEcho(connections[isIpv4], result.Address); err != nil {
+		s.reportError(err)
+		return
+	}
+	s.outstanding[isIpv4][sequence] = &sweepProbe{
+		result:  result,
+		expires: clockOrReal(s.Clock).Now().Add(s.options.deadline),
+	}
+}
+
+// collect matches a reply to the probe that caused it and marks the host alive.
+func (s *SweepAgent) collect(received *PingPacket, isIpv4 bool) {
+	if err := s.pingers[isIpv4].logPacket(received); err != nil {
+		s.reportError(err)
+	}
+	if !received.echoed {
+		return
+	}
+	probe, ok := s.outstanding[isIpv4][received.ICMPSequenceNumber]
+	if !ok {
+		// a duplicate, or it showed up after we gave up on it
+		return
+	}
+	delete(s.outstanding[isIpv4], received.ICMPSequenceNumber)
+	probe.result.Alive = true
+	probe.result.RoundTripTime = received.RoundTripTime
+	probe.result.TimeToLive = received.TimeToLive
+	if s.OnHostAlive != nil {
+		s.OnHostAlive(probe.result)
+	}
+}
+
+// expire stops waiting on every probe whose deadline has passed.
+func (s *SweepAgent) expire(now time.Time) {
+	for _, outstanding := range s.outstanding {
+		for sequence, probe := range outstanding {
+			if now.After(probe.expires) {
+				delete(outstanding, sequence)
+			}
+		}
+	}
+}
+
+func (s *SweepAgent) reportError(err error) {
+	errorHandler := s.OnError
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
+
+// ParseAddressFilter builds a filter out of comma separated CIDR blocks or
+// addresses. Either list can be empty.
+func ParseAddressFilter(allow string, block string) (*AddressFilter, error) {
+	allowed, err := parseNetworks(allow)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := parseNetworks(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AddressFilter{allowed: allowed, blocked: blocked}, nil
+}
+
+// Permits is true when the address is not blocked, and inside the allowlist if there is one.
+func (f *AddressFilter) Permits(ip net.IP) bool {
+	for _, network := range f.blocked {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allowed) == 0 {
+		return true
+	}
+	for _, network := range f.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandAddresses turns a CIDR block (10.0.0.0/22), a range (10.0.0.1-10.0.0.50
+// or 10.0.0.1-50) or a single address into every address it covers. IPv4
+// blocks bigger than a /31 leave out their network and broadcast addresses.
+func ExpandAddresses(spec string) ([]net.IP, error) {
+	if strings.Contains(spec, "/") {
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones > 16 {
+			return nil, fmt.Errorf("%s is too big to sweep, it can cover at most %d addresses", spec, maxSweepAddresses)
+		}
+		var addresses []net.IP
+		for ip := network.IP; network.Contains(ip); ip = nextIP(ip) {
+			addresses = append(addresses, ip)
+		}
+		if bits == 32 && ones < 31 {
+			addresses = addresses[1 : len(addresses)-1]
+		}
+		return addresses, nil
+	}
+	if dash := strings.Index(spec, "-"); dash >= 0 {
+		start := net.ParseIP(spec[:dash])
+		if start == nil {
+			return nil, fmt.Errorf("%s is not a valid address", spec[:dash])
+		}
+		end := net.ParseIP(spec[dash+1:])
+		// 10.0.0.1-50 only gives the last octet of the end
+		if octet, err := strconv.Atoi(spec[dash+1:]); err == nil && start.To4() != nil && octet >= 0 && octet <= 255 {
+			end = net.IPv4(start.To4()[0], start.To4()[1], start.To4()[2], byte(octet))
+		}
+		if end == nil {
+			return nil, fmt.Errorf("%s is not a valid address", spec[dash+1:])
+		}
+		if (start.To4() == nil) != (end.To4() == nil) || bytes.Compare(start.To16(), end.To16()) > 0 {
+			return nil, fmt.Errorf("%s is not a valid range", spec)
+		}
+		var addresses []net.IP
+		for ip := start; ; ip = nextIP(ip) {
+			if len(addresses) == maxSweepAddresses {
+				return nil, fmt.Errorf("%s is too big to sweep, it can cover at most %d addresses", spec, maxSweepAddresses)
+			}
+			addresses = append(addresses, ip)
+			if ip.Equal(end) {
+				return addresses, nil
+			}
+		}
+	}
+	ip := net.ParseIP(spec)
+	if ip == nil {
+		return nil, fmt.Errorf("%s is neither a CIDR block, a range or an address", spec)
+	}
+	return []net.IP{ip}, nil
+}
+
+// nextIP is the address right after ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// parseNetworks parses comma separated CIDR blocks, a bare address is its own block.
+func parseNetworks(option string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, spec := range strings.Split(option, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("%s is neither a CIDR block or an address", spec)
+			}
+			if ip.To4() != nil {
+				spec += "/32"
+			} else {
+				spec += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
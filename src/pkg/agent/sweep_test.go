@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"net"
+	"testing"
+)
+
+// Tests for the sweep address expansion and filtering
+
+func TestExpandAddresses(t *testing.T) {
+	tests := []struct {
+		desc          string
+		in            string
+		expectedFirst string
+		expectedLast  string
+		expectedCount int
+		expectedErr   bool
+	}{
+		{
+			desc:          "cidr-22",
+			in:            "10.0.0.0/22",
+			expectedFirst: "10.0.0.1",
+			expectedLast:  "10.0.3.254",
+			expectedCount: 1022,
+		},
+		{
+			desc:          "cidr-31",
+			in:            "10.0.0.0/31",
+			expectedFirst: "10.0.0.0",
+			expectedLast:  "10.0.0.1",
+			expectedCount: 2,
+		},
+		{
+			desc:          "cidr-ipv6",
+			in:            "2001:db8::/126",
+			expectedFirst: "2001:db8::",
+			expectedLast:  "2001:db8::3",
+			expectedCount: 4,
+		},
+		{
+			desc:          "full-range",
+			in:            "10.0.0.250-10.0.1.4",
+			expectedFirst: "10.0.0.250",
+			expectedLast:  "10.0.1.4",
+			expectedCount: 11,
+		},
+		{
+			desc:          "last-octet-range",
+			in:            "192.168.1.10-50",
+			expectedFirst: "192.168.1.10",
+			expectedLast:  "192.168.1.50",
+			expectedCount: 41,
+		},
+		{
+			desc:          "single-address",
+			in:            "1.1.1.1",
+			expectedFirst: "1.1.1.1",
+			expectedLast:  "1.1.1.1",
+			expectedCount: 1,
+		},
+		{
+			desc:        "cidr-too-big",
+			in:          "10.0.0.0/8",
+			expectedErr: true,
+		},
+		{
+			desc:        "backwards-range",
+			in:          "10.0.0.50-10.0.0.10",
+			expectedErr: true,
+		},
+		{
+			desc:        "mixed-family-range",
+			in:          "10.0.0.1-::1",
+			expectedErr: true,
+		},
+		{
+			desc:        "garbage",
+			in:          "fooey",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			addresses, err := ExpandAddresses(tt.in)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("%s: expected error %v got %v", tt.desc, tt.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(addresses) != tt.expectedCount || !addresses[0].Equal(net.ParseIP(tt.expectedFirst)) ||
+				!addresses[len(addresses)-1].Equal(net.ParseIP(tt.expectedLast)) {
+				t.Errorf("%s: expected %d addresses %s...%s got %d addresses %s...%s", tt.desc, tt.expectedCount,
+					tt.expectedFirst, tt.expectedLast, len(addresses), addresses[0], addresses[len(addresses)-1])
+			}
+		})
+	}
+}
+
+func TestAddressFilter_Permits(t *testing.T) {
+	tests := []struct {
+		desc     string
+		allow    string
+		block    string
+		in       string
+		expected bool
+	}{
+		{
+			desc:     "no-lists",
+			in:       "10.0.0.1",
+			expected: true,
+		},
+		{
+			desc:     "blocked",
+			block:    "10.0.0.0/24",
+			in:       "10.0.0.1",
+			expected: false,
+		},
+		{
+			desc:     "blocked-single-address",
+			block:    "10.0.0.2, 10.0.0.1",
+			in:       "10.0.0.1",
+			expected: false,
+		},
+		{
+			desc:     "outside-allowlist",
+			allow:    "192.168.0.0/16",
+			in:       "10.0.0.1",
+			expected: false,
+		},
+		{
+			desc:     "inside-allowlist",
+			allow:    "192.168.0.0/16,10.0.0.0/8",
+			in:       "10.0.0.1",
+			expected: true,
+		},
+		{
+			desc:     "block-beats-allow",
+			allow:    "10.0.0.0/8",
+			block:    "10.0.0.0/30",
+			in:       "10.0.0.1",
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			filter, err := ParseAddressFilter(tt.allow, tt.block)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.desc, err)
+			}
+			if permitted := filter.Permits(net.ParseIP(tt.in)); permitted != tt.expected {
+				t.Errorf("%s: expected %v got %v", tt.desc, tt.expected, permitted)
+			}
+		})
+	}
+}
+
+func TestBuildSweeper(t *testing.T) {
+	filter, _ := ParseAddressFilter("", "10.0.0.2")
+	tests := []struct {
+		desc          string
+		in            []string
+		expectedCount int
+		expectedErr   bool
+	}{
+		{
+			desc:          "overlapping-specs",
+			in:            []string{"10.0.0.0/29", "10.0.0.1-3"},
+			expectedCount: 5,
+		},
+		{
+			desc:        "everything-blocked",
+			in:          []string{"10.0.0.2"},
+			expectedErr: true,
+		},
+		{
+			desc:        "too-many-addresses",
+			in:          []string{"10.0.0.0/16", "10.1.0.0/16"},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			sweeper, err := BuildSweeper(&PresentOptions{rate: 1}, tt.in, filter)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("%s: expected error %v got %v", tt.desc, tt.expectedErr, err)
+			}
+			if err == nil && len(sweeper.results) != tt.expectedCount {
+				t.Errorf("%s: expected %d addresses got %d", tt.desc, tt.expectedCount, len(sweeper.results))
+			}
+		})
+	}
+}
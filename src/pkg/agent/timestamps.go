@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"time"
+)
+
+// TimestampSource is where a PingPacket's send or receive time came from.
+type TimestampSource string
+
+const (
+	// our own clock, before the echo request was written or after the
+	// reply was read (so including the time it took us to get to it)
+	TimestampUserspace TimestampSource = "userspace"
+	// the kernel's software timestamp, taken as the packet left or arrived
+	TimestampKernel TimestampSource = "kernel"
+)
+
+// maxKernelStampOffset is how far a kernel timestamp may be from our own one
+// for the same packet. Kernel timestamps are wall clock readings, so one much
+// further off (or on the wrong side of ours) means the wall clock stepped in
+// between and it can't be trusted.
+const maxKernelStampOffset = time.Second
+
+// kernelTimestamper is a Transport that knows when the kernel received the
+// message its last ReadFrom gave back and sent the one its last WriteTo
+// wrote, zero when the kernel didn't say.
+type kernelTimestamper interface {
+	lastReceived() time.Time
+	lastSent() time.Time
+}
+
+// kernelReceiveTime moves receivedAt, read from our clock once ReadFrom gave
+// the message back, to when the kernel received it. It stays a reading of our
+// clock (monotonic included), just earlier by how long the message waited.
+func kernelReceiveTime(connection Transport, receivedAt time.Time) (time.Time, TimestampSource) {
+	timestamper, ok := connection.(kernelTimestamper)
+	if !ok {
+		return receivedAt, TimestampUserspace
+	}
+	kernelAt := timestamper.lastReceived()
+	if kernelAt.IsZero() {
+		return receivedAt, TimestampUserspace
+	}
+	// kernelAt has no monotonic reading, so this is wall clock against wall clock
+	waited := receivedAt.Sub(kernelAt)
+	if waited < 0 || waited > maxKernelStampOffset {
+		return receivedAt, TimestampUserspace
+	}
+	return receivedAt.Add(-waited), TimestampKernel
+}
+
+// kernelSendTime moves sentAt, read from our clock before WriteTo, to when the
+// kernel sent the echo request, the same way.
+func kernelSendTime(connection Transport, sentAt time.Time) (time.Time, TimestampSource) {
+	timestamper, ok := connection.(kernelTimestamper)
+	if !ok {
+		return sentAt, TimestampUserspace
+	}
+	kernelAt := timestamper.lastSent()
+	if kernelAt.IsZero() {
+		return sentAt, TimestampUserspace
+	}
+	took := kernelAt.Sub(sentAt)
+	if took < 0 || took > maxKernelStampOffset {
+		return sentAt, TimestampUserspace
+	}
+	return sentAt.Add(took), TimestampKernel
+}
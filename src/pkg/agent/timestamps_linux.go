@@ -0,0 +1,285 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// SO_TIMESTAMPING flags, from linux/net_tstamp.h
+const (
+	timestampingTxSoftware = 1 << 1
+	timestampingRxSoftware = 1 << 3
+	timestampingSoftware   = 1 << 4
+	// number every packet we send, so a send timestamp can be matched to its packet
+	timestampingOptID = 1 << 7
+	// only the timestamp comes back on the error queue, not the packet
+	timestampingOptTSOnly = 1 << 11
+)
+
+// linux/errqueue.h
+const (
+	errOriginTimestamping = 4
+	timestampSent         = 0
+)
+
+// socketStamps reads an ICMP socket's kernel timestamps, and the ICMP errors
+// the kernel keeps on a datagram socket's error queue. Only the receiver reads
+// (and touches received), only the sender writes (and touches sent).
+type socketStamps struct {
+	raw          syscall.RawConn
+	isIpv4       bool
+	unprivileged bool
+	// SO_TIMESTAMPING gives send timestamps too, SO_TIMESTAMPNS only receive ones
+	transmit bool
+	// IP_RECVERR is on, so the receiver reads ICMP errors off the error queue
+	queuesErrors bool
+	// the receiver and the sender both read the error queue, one at a time
+	errorQueue sync.Mutex
+	// a send timestamp the receiver took off the error queue, for the sender
+	stashedSent time.Time
+	stashedKey  uint32
+	// the lowest SO_TIMESTAMPING key a send timestamp of ours can still carry
+	nextKey  uint32
+	received time.Time
+	sent     time.Time
+}
+
+// enableKernelTimestamps asks the kernel to timestamp the packets of an ICMP
+// socket, the ones we send too where it can, and to keep the ICMP errors about
+// what a datagram socket sent for us. It gives back nil when it can do neither.
+func enableKernelTimestamps(connection *icmp.PacketConn, isIpv4 bool, unprivileged bool) *socketStamps {
+	raw, err := socketRawConn(connection, isIpv4)
+	if err != nil {
+		return nil
+	}
+	stamps := &socketStamps{raw: raw, isIpv4: isIpv4, unprivileged: unprivileged}
+	var optionErr error
+	err = raw.Control(func(fd uintptr) {
+		optionErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, timestampingRxSoftware|
+			timestampingTxSoftware|timestampingSoftware|timestampingOptID|timestampingOptTSOnly)
+		if optionErr == nil {
+			stamps.transmit = true
+			return
+		}
+		optionErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+	// raw sockets receive ICMP errors like any other ICMP message
+	stamps.queuesErrors = unprivileged && enableICMPErrors(raw, isIpv4) == nil
+	if (err != nil || optionErr != nil) && !stamps.queuesErrors {
+		return nil
+	}
+	return stamps
+}
+
+// read is ReadFrom with the kernel's receive timestamp kept in received.
+func (s *socketStamps) read(b []byte) (int, int, net.IP, error) {
+	s.received = time.Time{}
+	buffer := b
+	raw := s.isIpv4 && !s.unprivileged
+	if raw {
+		// raw ipv4 sockets give us the IP header too
+		buffer = make([]byte, len(b)+60)
+	}
+	oob := make([]byte, 512)
+	var n, oobn int
+	var from syscall.Sockaddr
+	var receiveErr error
+	var queued bool
+	var source net.IP
+	err := s.raw.Read(func(fd uintptr) bool {
+		if s.queuesErrors {
+			if n, source, queued = s.readErrorQueue(fd, b); queued {
+				// not what an earlier try failed with
+				receiveErr = nil
+				return true
+			}
+		}
+		n, oobn, _, from, receiveErr = syscall.Recvmsg(int(fd), buffer, oob, 0)
+		// an ICMP error on the error queue fails the next read with its errno once,
+		// the error itself is read off the queue when we try again
+		if s.queuesErrors && receiveErr != nil {
+			return false
+		}
+		// wait for the socket to become readable (or the deadline) and try again
+		return receiveErr != syscall.EAGAIN && receiveErr != syscall.EINTR
+	})
+	if err == nil {
+		err = receiveErr
+	}
+	if err != nil {
+		return 0, 0, nil, &net.OpError{Op: "read", Net: "icmp", Err: err}
+	}
+	if queued {
+		return n, 0, source, nil
+	}
+	if raw {
+		headerLength := int(buffer[0]&0x0f) << 2
+		if n < headerLength {
+			return 0, 0, nil, &net.OpError{Op: "read", Net: "icmp", Err: syscall.EBADMSG}
+		}
+		n = copy(b, buffer[headerLength:n])
+	}
+	var ttl int
+	if s.isIpv4 {
+		var message ipv4.ControlMessage
+		if message.Parse(oob[:oobn]) == nil {
+			ttl = message.TTL
+		}
+	} else {
+		var message ipv6.ControlMessage
+		if message.Parse(oob[:oobn]) == nil {
+			ttl = message.HopLimit
+		}
+	}
+	s.received, _, _ = parseTimestamps(oob[:oobn])
+	return n, ttl, sockaddrIP(from), nil
+}
+
+// wrote picks up the kernel's send timestamp for what was just written, if it
+// is there already: one that only turns up later is left for the next write to
+// throw away.
+func (s *socketStamps) wrote() {
+	s.sent = time.Time{}
+	if !s.transmit {
+		return
+	}
+	s.errorQueue.Lock()
+	defer s.errorQueue.Unlock()
+	s.sentAt(s.stashedSent, s.stashedKey)
+	s.stashedSent = time.Time{}
+	flags := syscall.MSG_ERRQUEUE | syscall.MSG_DONTWAIT
+	if s.queuesErrors {
+		// only look, ICMP errors (and whatever is behind them) are the receiver's
+		flags |= syscall.MSG_PEEK
+	}
+	data, oob := make([]byte, 64), make([]byte, 512)
+	s.raw.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, _, err := syscall.Recvmsg(int(fd), data, oob, flags)
+			if err != nil {
+				// nothing (more) on the error queue
+				return
+			}
+			at, key, ok := parseTimestamps(oob[:oobn])
+			if s.queuesErrors {
+				if !ok {
+					return
+				}
+				// it is ours, take it off the queue
+				syscall.Recvmsg(int(fd), data, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			}
+			if ok {
+				s.sentAt(at, key)
+			}
+		}
+	})
+}
+
+// sentAt keeps a send timestamp with its key if it can be the one of what was just written.
+func (s *socketStamps) sentAt(at time.Time, key uint32) {
+	// an older key belongs to an echo request whose timestamp came too late,
+	// a newer one means sends that failed still used up keys
+	if !at.IsZero() && key >= s.nextKey {
+		s.sent = at
+		s.nextKey = key + 1
+	}
+}
+
+// readErrorQueue takes everything off the error queue up to the first ICMP
+// error, which it gives back (with who sent it) as the ICMP message a raw
+// socket would have received. Send timestamps on the way are kept for the
+// sender, anything else is thrown away.
+func (s *socketStamps) readErrorQueue(fd uintptr, b []byte) (int, net.IP, bool) {
+	s.errorQueue.Lock()
+	defer s.errorQueue.Unlock()
+	payload, oob := make([]byte, len(b)), make([]byte, 512)
+	for {
+		n, oobn, _, from, err := syscall.Recvmsg(int(fd), payload, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		if err != nil {
+			return 0, nil, false
+		}
+		at, key, sent := parseTimestamps(oob[:oobn])
+		if sent {
+			if !at.IsZero() {
+				s.stashedSent, s.stashedKey = at, key
+			}
+			continue
+		}
+		message, source, ok := queuedICMPError(s.isIpv4, oob[:oobn], sockaddrIP(from), payload[:n])
+		if !ok {
+			continue
+		}
+		s.received = at
+		return copy(b, message), source, true
+	}
+}
+
+// parseTimestamps finds the timestamp in a message's control messages and, for
+// a send timestamp from the error queue, the key of the packet it belongs to.
+func parseTimestamps(oob []byte) (at time.Time, key uint32, sent bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	for _, message := range messages {
+		switch {
+		case message.Header.Level == syscall.SOL_SOCKET && message.Header.Type == syscall.SCM_TIMESTAMPING:
+			// three timestamps, the software one is first and the rest are hardware ones
+			if len(message.Data) >= 3*int(unsafe.Sizeof(syscall.Timespec{})) {
+				stamp := (*syscall.Timespec)(unsafe.Pointer(&message.Data[0]))
+				if stamp.Sec != 0 || stamp.Nsec != 0 {
+					at = time.Unix(stamp.Unix())
+				}
+			}
+		case message.Header.Level == syscall.SOL_SOCKET && message.Header.Type == syscall.SCM_TIMESTAMPNS:
+			if len(message.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+				at = time.Unix((*syscall.Timespec)(unsafe.Pointer(&message.Data[0])).Unix())
+			}
+		case message.Header.Level == syscall.SOL_IP && message.Header.Type == syscall.IP_RECVERR,
+			message.Header.Level == syscall.SOL_IPV6 && message.Header.Type == syscall.IPV6_RECVERR:
+			// struct sock_extended_err: errno, origin, type, code, pad, info, data (the key)
+			if len(message.Data) >= 16 && message.Data[4] == errOriginTimestamping &&
+				*(*uint32)(unsafe.Pointer(&message.Data[8])) == timestampSent {
+				key = *(*uint32)(unsafe.Pointer(&message.Data[12]))
+				sent = true
+			}
+		}
+	}
+	return at, key, sent
+}
+
+// socketRawConn is the socket under an ICMP connection, for the options the
+// icmp package has no setters for.
+func socketRawConn(connection *icmp.PacketConn, isIpv4 bool) (syscall.RawConn, error) {
+	// the icmp package doesn't give the socket away, its ipv4/ipv6 wrappers do
+	var packetConn net.PacketConn
+	if isIpv4 {
+		packetConn = connection.IPv4PacketConn().PacketConn
+	} else {
+		packetConn = connection.IPv6PacketConn().PacketConn
+	}
+	conn, ok := packetConn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("the ICMP connection has no socket under it")
+	}
+	return conn.SyscallConn()
+}
+
+// sockaddrIP is the IP of a socket address Recvmsg gave back.
+func sockaddrIP(address syscall.Sockaddr) net.IP {
+	switch address := address.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(address.Addr[:]).To16()
+	case *syscall.SockaddrInet6:
+		return net.IP(address.Addr[:])
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// controlMessage builds one control message the way the kernel lays them out.
+func controlMessage(level int32, kind int32, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	header.Level, header.Type = level, kind
+	header.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+// timespecBytes is a struct timespec.
+func timespecBytes(at time.Time) []byte {
+	stamp := syscall.NsecToTimespec(at.UnixNano())
+	return (*[unsafe.Sizeof(syscall.Timespec{})]byte)(unsafe.Pointer(&stamp))[:]
+}
+
+// extendedErr is a struct sock_extended_err.
+func extendedErr(origin byte, info uint32, key uint32) []byte {
+	b := make([]byte, 16)
+	b[4] = origin
+	*(*uint32)(unsafe.Pointer(&b[8])) = info
+	*(*uint32)(unsafe.Pointer(&b[12])) = key
+	return b
+}
+
+func TestParseTimestamps(t *testing.T) {
+	at := time.Unix(1587168212, 973301702)
+	software := append(append(timespecBytes(at), timespecBytes(time.Unix(0, 0))...), timespecBytes(time.Unix(0, 0))...)
+	tests := []struct {
+		desc         string
+		inOOB        []byte
+		expectedAt   time.Time
+		expectedKey  uint32
+		expectedSent bool
+	}{
+		{
+			desc:       "timestampns",
+			inOOB:      controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMPNS, timespecBytes(at)),
+			expectedAt: at,
+		},
+		{
+			desc: "timestamping-after-the-ttl",
+			inOOB: append(controlMessage(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}),
+				controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMPING, software)...),
+			expectedAt: at,
+		},
+		{
+			desc: "sent",
+			inOOB: append(controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMPING, software),
+				controlMessage(syscall.SOL_IPV6, syscall.IPV6_RECVERR, extendedErr(errOriginTimestamping, timestampSent, 7))...),
+			expectedAt:   at,
+			expectedKey:  7,
+			expectedSent: true,
+		},
+		{
+			desc:  "a-real-error",
+			inOOB: controlMessage(syscall.SOL_IP, syscall.IP_RECVERR, extendedErr(2, 0, 7)),
+		},
+		{
+			desc: "nothing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			at, key, sent := parseTimestamps(tt.inOOB)
+			if !at.Equal(tt.expectedAt) || key != tt.expectedKey || sent != tt.expectedSent {
+				t.Errorf("%s: expected %v, key %d and sent %v got %v, %d and %v", tt.desc, tt.expectedAt, tt.expectedKey,
+					tt.expectedSent, at, key, sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// socketStamps would read an ICMP socket's kernel timestamps, which we only
+// ask for on Linux.
+type socketStamps struct {
+	received time.Time
+	sent     time.Time
+}
+
+// enableKernelTimestamps leaves the timestamps to us everywhere but Linux.
+func enableKernelTimestamps(connection *icmp.PacketConn, isIpv4 bool, unprivileged bool) *socketStamps {
+	return nil
+}
+
+func (s *socketStamps) read(b []byte) (int, int, net.IP, error) {
+	return 0, 0, nil, errors.New("kernel timestamps are only supported on Linux")
+}
+
+func (s *socketStamps) wrote() {}
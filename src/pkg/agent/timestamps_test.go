@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// stampedTransport is a Transport whose kernel timestamps are whatever the test says.
+type stampedTransport struct {
+	Transport
+	received time.Time
+	sent     time.Time
+}
+
+func (s *stampedTransport) lastReceived() time.Time {
+	return s.received
+}
+
+func (s *stampedTransport) lastSent() time.Time {
+	return s.sent
+}
+
+func TestKernelReceiveTime(t *testing.T) {
+	readAt := time.Now()
+	tests := []struct {
+		desc           string
+		inTransport    Transport
+		expectedAt     time.Time
+		expectedSource TimestampSource
+	}{
+		{
+			desc:           "no-kernel-timestamps",
+			inTransport:    &simulatedTransport{},
+			expectedAt:     readAt,
+			expectedSource: TimestampUserspace,
+		},
+		{
+			desc:           "kernel-didnt-say",
+			inTransport:    &stampedTransport{},
+			expectedAt:     readAt,
+			expectedSource: TimestampUserspace,
+		},
+		{
+			desc:           "waited-in-the-socket",
+			inTransport:    &stampedTransport{received: readAt.Round(0).Add(-300 * time.Microsecond)},
+			expectedAt:     readAt.Add(-300 * time.Microsecond),
+			expectedSource: TimestampKernel,
+		},
+		{
+			// the wall clock stepped back between the kernel's timestamp and ours
+			desc:           "after-our-own",
+			inTransport:    &stampedTransport{received: readAt.Round(0).Add(time.Hour)},
+			expectedAt:     readAt,
+			expectedSource: TimestampUserspace,
+		},
+		{
+			desc:           "too-far-off",
+			inTransport:    &stampedTransport{received: readAt.Round(0).Add(-time.Hour)},
+			expectedAt:     readAt,
+			expectedSource: TimestampUserspace,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			at, source := kernelReceiveTime(tt.inTransport, readAt)
+			if !at.Equal(tt.expectedAt) || source != tt.expectedSource {
+				t.Errorf("%s: expected %v from %s got %v from %s", tt.desc, tt.expectedAt, tt.expectedSource, at, source)
+			}
+			// still on the monotonic clock
+			if at.Sub(readAt) != tt.expectedAt.Sub(readAt) || at.Round(0) == at {
+				t.Errorf("%s: expected a monotonic reading got %v", tt.desc, at)
+			}
+		})
+	}
+}
+
+func TestKernelSendTime(t *testing.T) {
+	sentAt := time.Now()
+	tests := []struct {
+		desc           string
+		inSent         time.Time
+		expectedAt     time.Time
+		expectedSource TimestampSource
+	}{
+		{
+			desc:           "kernel-didnt-say",
+			expectedAt:     sentAt,
+			expectedSource: TimestampUserspace,
+		},
+		{
+			desc:           "left-a-bit-later",
+			inSent:         sentAt.Round(0).Add(40 * time.Microsecond),
+			expectedAt:     sentAt.Add(40 * time.Microsecond),
+			expectedSource: TimestampKernel,
+		},
+		{
+			desc:           "before-we-sent-it",
+			inSent:         sentAt.Round(0).Add(-time.Millisecond),
+			expectedAt:     sentAt,
+			expectedSource: TimestampUserspace,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			at, source := kernelSendTime(&stampedTransport{sent: tt.inSent}, sentAt)
+			if !at.Equal(tt.expectedAt) || source != tt.expectedSource {
+				t.Errorf("%s: expected %v from %s got %v from %s", tt.desc, tt.expectedAt, tt.expectedSource, at, source)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// TracerouteReply is what answered one of a traceroute's echo requests.
+type TracerouteReply string
+
+const (
+	// a router on the way, the echo request ran out of TTL there
+	ReplyTimeExceeded TracerouteReply = "time-exceeded"
+	// the destination itself
+	ReplyEcho TracerouteReply = "echo-reply"
+	// a router (or the destination) that can't get it any further, see Code
+	ReplyUnreachable TracerouteReply = "unreachable"
+)
+
+// TracerouteProbe is one echo request of a traceroute, and what came back for it.
+type TracerouteProbe struct {
+	TTL int
+	// the 16 bit icmp_seq it went out with
+	Sequence int
+	// who answered and how, both empty if nothing did within the deadline (-w)
+	Responder string
+	Reply     TracerouteReply
+	// the ICMP code of a Destination Unreachable
+	Code          int
+	RoundTripTime time.Duration
+}
+
+// TracerouteHop is every echo request a traceroute sent with one TTL.
+type TracerouteHop struct {
+	TTL    int
+	Probes []*TracerouteProbe
+}
+
+// tracerouteWait is a probe we are still waiting on an answer for.
+type tracerouteWait struct {
+	probe   *TracerouteProbe
+	expires time.Time
+}
+
+// TracerouteAgent sends echo requests to one destination with the TTL going
+// up from the first hop, a few (queries) per TTL, and finds out which router
+// each TTL runs out at from the Time Exceeded it sends back. It stops going
+// up once the destination answers (or someone says it can't be reached) or
+// at the max hops.
+type TracerouteAgent struct {
+	options PresentOptions
+	// does the actual sending and matching
+	pinger *PingerAgent
+	// one per TTL we started sending with, from the first hop on
+	hops []*TracerouteHop
+	// ICMP sequence -> probe still waiting on an answer
+	outstanding map[int]*tracerouteWait
+	// the TTL and query the next echo request goes out with
+	nextTTL   int
+	nextQuery int
+	// the lowest TTL the destination (or an unreachable) answered at, 0 until one does
+	reachedAt int
+	// how many hops OnHop was called for
+	reported int
+	stopPing *stopSignal
+	// Callbacks to the main function: every hop in order once each of its
+	// probes was answered or given up on, and the whole route once we are done.
+	OnHop func(h *TracerouteHop)
+	// a probe that couldn't be sent, or an answer we couldn't make sense of
+	OnError              func(err error)
+	OnTracerouteComplete func(hops []*TracerouteHop)
+	// opens the Transport of the destination's family instead of an ICMP
+	// socket, it has to be a TTLTransport
+	Listen func(isIpv4 bool) (Transport, error)
+	// where the time, timers and tickers come from, the real time if nil
+	Clock Clock
+}
+
+// BuildTraceroute builds a traceroute to the options' destination.
+func BuildTraceroute(options *PresentOptions) (*TracerouteAgent, error) {
+	if options.ipAddress == "" {
+		return nil, errors.New("a traceroute needs a destination")
+	}
+	if options.firstHop < 1 || options.firstHop > options.maxHops || options.queries < 1 {
+		return nil, errors.New("a traceroute needs a first hop up to its max hops, and at least one query per hop")
+	}
+	t := &TracerouteAgent{
+		options:     *options,
+		pinger:      BuildPinger(options),
+		outstanding: make(map[int]*tracerouteWait),
+		nextTTL:     options.firstHop,
+		stopPing:    newStopSignal(),
+	}
+	t.pinger.stopPing = t.stopPing
+	return t, nil
+}
+
+// Driver sends the probes one interval apart, collects the answers and gives
+// up on each probe once its deadline passes.
+func (t *TracerouteAgent) Driver() {
+	t.Run(context.Background())
+}
+
+// Run is Driver that also stops once ctx is done, and gives back every hop
+// up to the destination (or the max hops). It gives back an error when the
+// socket couldn't be opened (then there are no hops) or receiving failed.
+func (t *TracerouteAgent) Run(ctx context.Context) ([]*TracerouteHop, error) {
+	t.pinger.Listen = t.Listen
+	t.pinger.Clock = t.Clock
+	connection, err := t.pinger.openTTLTransport()
+	if err != nil {
+		t.Stop()
+		return nil, err
+	}
+	packetChannels := map[bool]chan *PingPacket{t.options.isIpv4: make(chan *PingPacket, 64)}
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go t.pinger.ReceiveICMPPacket(connection, packetChannels[t.options.isIpv4], &waitGroup)
+	clock := clockOrReal(t.Clock)
+	ticker := clock.NewTicker(t.options.interval)
+	defer ticker.Stop()
+	var timeout <-chan time.Time
+	if t.options.timeout > 0 {
+		timeoutTimer := clock.NewTimer(t.options.timeout)
+		defer timeoutTimer.Stop()
+		timeout = timeoutTimer.C()
+	}
+	// the first probe goes out right away
+	t.send(connection)
+	for !t.stopPing.stopped() {
+		select {
+		// Ctrl+C, or the receiver gave up
+		case <-t.stopPing.done:
+		case <-ctx.Done():
+			t.Stop()
+		case <-timeout:
+			t.Stop()
+		case now := <-ticker.C():
+			t.expire(now)
+			if t.sending() {
+				t.send(connection)
+			}
+		case receivedPacket := <-packetChannels[t.options.isIpv4]:
+			t.collect(receivedPacket)
+		}
+		t.report()
+		if t.done() {
+			t.Stop()
+		}
+	}
+	// closing the connection is what gets the receiver out of a read right away
+	connection.Close()
+	drainReceivers(&waitGroup, packetChannels)
+	// cut short, what we have of the rest of the hops is all there is
+	hops := t.route()
+	hopHandler := t.OnHop
+	for ; t.reported < len(hops); t.reported++ {
+		if hopHandler != nil {
+			hopHandler(hops[t.reported])
+		}
+	}
+	completeHandler := t.OnTracerouteComplete
+	if completeHandler != nil {
+		completeHandler(hops)
+	}
+	return hops, t.pinger.receiveErr
+}
+
+// Stop notifies all goroutines to stop, the hops still waiting on answers are reported as they are.
+func (t *TracerouteAgent) Stop() {
+	t.stopPing.stop()
+}
+
+// lastHop is the TTL the destination answered at, or the max hops until it does.
+func (t *TracerouteAgent) lastHop() int {
+	if t.reachedAt > 0 {
+		return t.reachedAt
+	}
+	return t.options.maxHops
+}
+
+// sending is true while there are echo requests left to send.
+func (t *TracerouteAgent) sending() bool {
+	return t.nextTTL <= t.lastHop()
+}
+
+// send sends the next echo request, with the next query's TTL.
+func (t *TracerouteAgent) send(connection TTLTransport) {
+	ttl := t.nextTTL
+	if t.nextQuery == 0 {
+		t.hops = append(t.hops, &TracerouteHop{TTL: ttl})
+	}
+	hop := t.hops[len(t.hops)-1]
+	t.nextQuery++
+	if t.nextQuery == t.options.queries {
+		t.nextQuery = 0
+		t.nextTTL++
+	}
+	// the sequence goes out on the wire as 16 bits
+	probe := &TracerouteProbe{TTL: ttl, Sequence: t.pinger.sequence & 0xffff}
+	hop.Probes = append(hop.Probes, probe)
+	if err := connection.SetTTL(ttl); err != nil {
+		t.reportError(fmt.Errorf("could not set the TTL to %d: %w", ttl, err))
+		return
+	}
+	if err := t.pinger.sendEcho(connection, t.options.ipAddress); err != nil {
+		t.reportError(err)
+		return
+	}
+	t.outstanding[probe.Sequence] = &tracerouteWait{
+		probe:   probe,
+		expires: clockOrReal(t.Clock).Now().Add(t.options.deadline),
+	}
+}
+
+// collect matches an answer to the probe it is about.
+func (t *TracerouteAgent) collect(received *PingPacket) {
+	answer, ours, err := t.pinger.answer(received)
+	if err != nil {
+		t.reportError(err)
+		return
+	}
+	if !ours {
+		return
+	}
+	wait, ok := t.outstanding[answer.sequence]
+	if !ok {
+		// a duplicate, or it showed up after we gave up on it
+		return
+	}
+	delete(t.outstanding, answer.sequence)
+	probe := wait.probe
+	probe.Responder = answer.responder
+	probe.Reply = answer.reply
+	probe.Code = answer.code
+	probe.RoundTripTime = answer.roundTripTime
+	// nothing gets any further than this
+	if answer.reply != ReplyTimeExceeded && (t.reachedAt == 0 || probe.TTL < t.reachedAt) {
+		t.reachedAt = probe.TTL
+	}
+}
+
+// expire stops waiting on every probe whose deadline has passed.
+func (t *TracerouteAgent) expire(now time.Time) {
+	for sequence, wait := range t.outstanding {
+		if now.After(wait.expires) {
+			delete(t.outstanding, sequence)
+		}
+	}
+}
+
+// settled is true once every probe of a hop was sent and answered or given up on.
+func (t *TracerouteAgent) settled(hop *TracerouteHop) bool {
+	if len(hop.Probes) < t.options.queries {
+		return false
+	}
+	for _, probe := range hop.Probes {
+		if _, ok := t.outstanding[probe.Sequence]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// report calls OnHop for every hop up to the last one that settled, in order.
+func (t *TracerouteAgent) report() {
+	hops := t.route()
+	for t.reported < len(hops) && t.settled(hops[t.reported]) {
+		hopHandler := t.OnHop
+		if hopHandler != nil {
+			hopHandler(hops[t.reported])
+		}
+		t.reported++
+	}
+}
+
+// done is true once every hop up to the last one settled.
+func (t *TracerouteAgent) done() bool {
+	return !t.sending() && t.reported == len(t.route())
+}
+
+// route is the hops up to the last one, leaving out the ones we sent past
+// the destination before it answered.
+func (t *TracerouteAgent) route() []*TracerouteHop {
+	last := t.lastHop() - t.options.firstHop + 1
+	if last < len(t.hops) {
+		return t.hops[:last]
+	}
+	return t.hops
+}
+
+func (t *TracerouteAgent) reportError(err error) {
+	errorHandler := t.OnError
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
+
+// hopAnswer is what came back for one of our TTL limited echo requests.
+type hopAnswer struct {
+	sequence      int
+	responder     string
+	reply         TracerouteReply
+	code          int
+	roundTripTime time.Duration
+}
+
+// answer works out which of p's echo requests a packet answers: a router's
+// Time Exceeded or a Destination Unreachable quote it, the destination's echo
+// reply carries it. ours is false when it isn't about one of them.
+func (p *PingerAgent) answer(received *PingPacket) (hopAnswer, bool, error) {
+	message, err := icmp.ParseMessage(icmpProtocol(p.options.isIpv4), received.data)
+	if err != nil {
+		return hopAnswer{}, false, err
+	}
+	answer := hopAnswer{responder: received.DestinationAddress}
+	var ours bool
+	switch body := message.Body.(type) {
+	case *icmp.TimeExceeded:
+		answer.sequence, answer.roundTripTime, ours = p.quotedProbe(received, body.Data)
+		answer.reply = ReplyTimeExceeded
+	case *icmp.DstUnreach:
+		answer.sequence, answer.roundTripTime, ours = p.quotedProbe(received, body.Data)
+		answer.reply = ReplyUnreachable
+		answer.code = message.Code
+	default:
+		if err := p.logPacket(received); err != nil {
+			return hopAnswer{}, false, err
+		}
+		answer.sequence, answer.roundTripTime, ours = received.ICMPSequenceNumber, received.RoundTripTime, received.echoed
+		answer.reply = ReplyEcho
+	}
+	return answer, ours, nil
+}
+
+// openTTLTransport opens p's socket (or Listen's Transport), which has to be
+// able to set the TTL its echo requests go out with.
+func (p *PingerAgent) openTTLTransport() (TTLTransport, error) {
+	connection, err := p.openTransport()
+	if err != nil {
+		return nil, err
+	}
+	ttlConnection, ok := connection.(TTLTransport)
+	if !ok {
+		connection.Close()
+		return nil, errors.New("probing hop by hop needs a transport that can set the TTL")
+	}
+	return ttlConnection, nil
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// tracerouteOptions are quick settings for a traceroute over a simulated network.
+func tracerouteOptions(t *testing.T, destination string, firstHop int, maxHops int) *PresentOptions {
+	settings := DefaultOptions()
+	settings.Destination = destination
+	settings.Interval = 5 * time.Millisecond
+	settings.Deadline = 50 * time.Millisecond
+	settings.FirstHop = firstHop
+	settings.MaxHops = maxHops
+	options, err := BuildOptions(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+func TestTracerouteAgent_Run_SimulatedNetwork(t *testing.T) {
+	tests := []struct {
+		desc          string
+		inDestination string
+		inFirstHop    int
+		inMaxHops     int
+		inNetwork     func(n *SimulatedNetwork)
+		// who answered every query of every hop, "" for nobody
+		expectedResponders []string
+		expectedReply      TracerouteReply
+	}{
+		{
+			desc:          "reaches-the-destination",
+			inDestination: "192.0.2.1",
+			inFirstHop:    1,
+			inMaxHops:     30,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1", "198.51.100.2"}
+			},
+			expectedResponders: []string{"198.51.100.1", "198.51.100.2", "192.0.2.1"},
+			expectedReply:      ReplyEcho,
+		},
+		{
+			desc:          "ipv6",
+			inDestination: "2001:db8::1",
+			inFirstHop:    1,
+			inMaxHops:     30,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"2001:db8:ff::1"}
+			},
+			expectedResponders: []string{"2001:db8:ff::1", "2001:db8::1"},
+			expectedReply:      ReplyEcho,
+		},
+		{
+			desc:          "silent-router",
+			inDestination: "192.0.2.1",
+			inFirstHop:    1,
+			inMaxHops:     30,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1", "198.51.100.2"}
+				n.Alive = func(address string) bool {
+					return address != "198.51.100.2"
+				}
+			},
+			expectedResponders: []string{"198.51.100.1", "", "192.0.2.1"},
+			expectedReply:      ReplyEcho,
+		},
+		{
+			desc:          "destination-never-answers",
+			inDestination: "192.0.2.1",
+			inFirstHop:    1,
+			inMaxHops:     3,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1"}
+				n.Alive = func(address string) bool {
+					return address != "192.0.2.1"
+				}
+			},
+			expectedResponders: []string{"198.51.100.1", "", ""},
+		},
+		{
+			desc:          "first-hop",
+			inDestination: "192.0.2.1",
+			inFirstHop:    2,
+			inMaxHops:     30,
+			inNetwork: func(n *SimulatedNetwork) {
+				n.Route = []string{"198.51.100.1", "198.51.100.2"}
+			},
+			expectedResponders: []string{"198.51.100.2", "192.0.2.1"},
+			expectedReply:      ReplyEcho,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			network := NewSimulatedNetwork(1)
+			network.Latency = time.Millisecond
+			tt.inNetwork(network)
+			traceroute, err := BuildTraceroute(tracerouteOptions(t, tt.inDestination, tt.inFirstHop, tt.inMaxHops))
+			if err != nil {
+				t.Fatal(err)
+			}
+			traceroute.Listen = network.Listen
+			var reported []*TracerouteHop
+			traceroute.OnHop = func(h *TracerouteHop) {
+				reported = append(reported, h)
+			}
+			hops, err := traceroute.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hops) != len(tt.expectedResponders) || len(reported) != len(hops) {
+				t.Fatalf("%s: expected %d hops got %d, %d of them reported", tt.desc, len(tt.expectedResponders), len(hops), len(reported))
+			}
+			for i, hop := range hops {
+				if hop.TTL != tt.inFirstHop+i || reported[i] != hop || len(hop.Probes) != 3 {
+					t.Errorf("%s: expected hop %d to be TTL %d with 3 probes got %+v", tt.desc, i, tt.inFirstHop+i, hop)
+				}
+				for _, probe := range hop.Probes {
+					if probe.Responder != tt.expectedResponders[i] || probe.TTL != hop.TTL {
+						t.Errorf("%s: expected TTL %d answered by %q got %+v", tt.desc, hop.TTL, tt.expectedResponders[i], probe)
+					}
+					if probe.Responder != "" && probe.RoundTripTime < time.Millisecond {
+						t.Errorf("%s: expected a round trip time of at least the latency got %+v", tt.desc, probe)
+					}
+				}
+			}
+			last := hops[len(hops)-1].Probes[0]
+			if last.Reply != tt.expectedReply {
+				t.Errorf("%s: expected the last hop to answer with %q got %+v", tt.desc, tt.expectedReply, last)
+			}
+		})
+	}
+}
+
+func TestBuildTraceroute(t *testing.T) {
+	options := tracerouteOptions(t, "192.0.2.1", 1, 30)
+	if _, err := BuildTraceroute(options); err != nil {
+		t.Errorf("expected a traceroute got %v", err)
+	}
+	if _, err := BuildTraceroute(tracerouteOptions(t, "", 1, 30)); err == nil {
+		t.Errorf("expected an error without a destination")
+	}
+	// options from the Parse* calls alone have no hops
+	if _, err := BuildTraceroute(&PresentOptions{ipAddress: "192.0.2.1", isIpv4: true}); err == nil {
+		t.Errorf("expected an error without hops")
+	}
+}
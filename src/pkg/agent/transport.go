@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// Transport is what a pinger sends its echo requests and receives ICMP
+// messages over, an ICMP socket unless Listen says otherwise. Messages are
+// ICMP only, without an IP header.
+type Transport interface {
+	// ReadFrom receives one ICMP message, with the TTL (hop limit on ipv6) it
+	// arrived with and who sent it. It gives back a net.Error that is a
+	// Timeout() once the read deadline passes.
+	ReadFrom(b []byte) (n int, ttl int, source net.IP, err error)
+	WriteTo(b []byte, destination *net.IPAddr) (int, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// TTLTransport is a Transport whose outgoing TTL (hop limit on ipv6) can be
+// changed between writes, which a traceroute needs.
+type TTLTransport interface {
+	Transport
+	SetTTL(ttl int) error
+}
+
+// DontFragmentTransport is a Transport whose echo requests can be kept from
+// being fragmented on the way, which path MTU discovery needs.
+type DontFragmentTransport interface {
+	Transport
+	SetDontFragment() error
+}
+
+// socketTransport is an ICMP socket, raw or unprivileged datagram.
+type socketTransport struct {
+	connection *icmp.PacketConn
+	isIpv4     bool
+	// datagram ICMP sockets want a UDPAddr, raw sockets an IPAddr.
+	unprivileged bool
+	// the kernel's timestamps, nil if it doesn't give us any
+	stamps *socketStamps
+}
+
+func (s *socketTransport) ReadFrom(b []byte) (int, int, net.IP, error) {
+	if s.stamps != nil {
+		return s.stamps.read(b)
+	}
+	if s.isIpv4 {
+		n, message, peer, err := s.connection.IPv4PacketConn().ReadFrom(b)
+		if message != nil && message.Src != nil {
+			return n, message.TTL, message.Src, err
+		}
+		var ttl int
+		if message != nil {
+			ttl = message.TTL
+		}
+		return n, ttl, AddressIP(peer), err
+	}
+	// the ipv6 control message doesn't carry the source, so use the peer.
+	n, message, peer, err := s.connection.IPv6PacketConn().ReadFrom(b)
+	var hopLimit int
+	if message != nil {
+		hopLimit = message.HopLimit
+	}
+	return n, hopLimit, AddressIP(peer), err
+}
+
+func (s *socketTransport) WriteTo(b []byte, destination *net.IPAddr) (int, error) {
+	var address net.Addr = destination
+	if s.unprivileged {
+		address = &net.UDPAddr{IP: destination.IP, Zone: destination.Zone}
+	}
+	n, err := s.connection.WriteTo(b, address)
+	if err == nil && s.stamps != nil {
+		s.stamps.wrote()
+	}
+	return n, err
+}
+
+func (s *socketTransport) lastReceived() time.Time {
+	if s.stamps == nil {
+		return time.Time{}
+	}
+	return s.stamps.received
+}
+
+func (s *socketTransport) lastSent() time.Time {
+	if s.stamps == nil {
+		return time.Time{}
+	}
+	return s.stamps.sent
+}
+
+func (s *socketTransport) SetTTL(ttl int) error {
+	if s.isIpv4 {
+		return s.connection.IPv4PacketConn().SetTTL(ttl)
+	}
+	return s.connection.IPv6PacketConn().SetHopLimit(ttl)
+}
+
+func (s *socketTransport) SetDontFragment() error {
+	return setDontFragment(s.connection, s.isIpv4)
+}
+
+func (s *socketTransport) SetReadDeadline(t time.Time) error {
+	return s.connection.SetReadDeadline(t)
+}
+
+func (s *socketTransport) Close() error {
+	return s.connection.Close()
+}
+
+// openTransport opens what our address family sends and receives over: Listen's
+// Transport if there is one, otherwise an ICMP socket.
+func (p *PingerAgent) openTransport() (Transport, error) {
+	listen := p.Listen
+	if listen != nil {
+		return listen(p.options.isIpv4)
+	}
+	connection, err := p.openConnection()
+	if err != nil {
+		return nil, err
+	}
+	return &socketTransport{
+		connection:   connection,
+		isIpv4:       p.options.isIpv4,
+		unprivileged: p.unprivileged,
+		stamps:       enableKernelTimestamps(connection, p.options.isIpv4, p.unprivileged),
+	}, nil
+}
@@ -2,7 +2,10 @@ package agent
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"math"
 	"math/rand"
 	"net"
@@ -21,11 +24,11 @@ func BuildPinger(options *PresentOptions) *PingerAgent {
 		options:           *options,
 		packetsSent:       0,
 		packetsRecieved:   0,
-		stopPing:          make(chan bool),
+		stopPing:          newStopSignal(),
 		packetId:          tracker.Intn(math.MaxInt16),
 		packetTracker:     tracker.Int63n(math.MaxInt64),
 		numExceededTTL:    0,
-		maxTTL: 	       options.timeToLive,
+		maxTTL: 	       options.maxReceivedTTL,
 		sequence:          0,
 	}
 }
@@ -57,21 +60,65 @@ func BytesToTime(b []byte) time.Time {
 	return time.Unix(nsec/1000000000, nsec%1000000000)
 }
 
+// IsIPv4 tells ipv6 literals apart from everything else, a hostname that
+// doesn't resolve is a *ResolutionError.
 func IsIPv4(address string) (bool, error) {
 	if strings.Count(address, ":") >= 2 {
 		return false, nil
 	}
 	ips, err := net.LookupIP(address)
+	if err != nil {
+		return false, &ResolutionError{Destination: address, Err: err}
+	}
 	if len(ips) == 0 {
-		fmt.Printf("Invalid Host. %s\n", err.Error())
-		return false, err
+		return false, &ResolutionError{Destination: address, Err: errors.New("no addresses")}
+	}
+	return net.ParseIP(ips[0].String()) != nil, nil
+}
+
+// AddressIP pulls the IP out of the addresses ReadFrom() gives back,
+// which are IPAddrs on raw sockets and UDPAddrs on datagram sockets.
+func AddressIP(address net.Addr) net.IP {
+	switch addr := address.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
 	}
-	if net.ParseIP(ips[0].String()) != nil {
-		return true, nil
+	return nil
+}
+
+// icmpProtocol is the protocol number icmp.ParseMessage() wants,
+// http://www.networksorcery.com/enp/protocol/icmpv6.htm - protocol number 58 for ipv6
+func icmpProtocol(isIpv4 bool) int {
+	if isIpv4 {
+		return 1
+	}
+	return 58
+}
+
+// echoRequestType is the ICMP type of an echo request for the address family.
+func echoRequestType(isIpv4 bool) icmp.Type {
+	if isIpv4 {
+		return ipv4.ICMPTypeEcho
+	}
+	return ipv6.ICMPTypeEchoRequest
+}
+
+// echoReplyType is the ICMP type of an echo reply for the address family.
+func echoReplyType(isIpv4 bool) icmp.Type {
+	if isIpv4 {
+		return ipv4.ICMPTypeEchoReply
+	}
+	return ipv6.ICMPTypeEchoReply
+}
+
+// timeExceededType is the ICMP type of a Time Exceeded for the address family.
+func timeExceededType(isIpv4 bool) icmp.Type {
+	if isIpv4 {
+		return ipv4.ICMPTypeTimeExceeded
 	}
-	fmt.Print(err)
-	return false, err
-	//return net.ParseIP(address) != nil
+	return ipv6.ICMPTypeTimeExceeded
 }
 
 func isIPv6(address string) bool {
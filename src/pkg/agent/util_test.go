@@ -3,6 +3,7 @@ package agent
 import (
 	"bytes"
 	"errors"
+	"net"
 	"testing"
 	"time"
 )
@@ -177,4 +178,34 @@ func TestIsIPv4(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestAddressIP(t *testing.T) {
+	tests := []struct {
+		desc     string
+		in       net.Addr
+		expected net.IP
+	}{
+		{
+			desc:     "raw-socket",
+			in:       &net.IPAddr{IP: net.ParseIP("127.0.0.1")},
+			expected: net.ParseIP("127.0.0.1"),
+		},
+		{
+			desc:     "datagram-socket",
+			in:       &net.UDPAddr{IP: net.ParseIP("::1"), Port: 7},
+			expected: net.ParseIP("::1"),
+		},
+		{
+			desc:     "nil",
+			in:       nil,
+			expected: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if ip := AddressIP(tt.in); !ip.Equal(tt.expected) {
+				t.Errorf("%s: expected %v got %v", tt.desc, tt.expected, ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// pmtu finds the path MTU to a destination, printing every packet size it
+// tries as it goes and what it found out once it is done.
+func pmtu(arguments []string) {
+	flags := flag.NewFlagSet("pmtu", flag.ExitOnError)
+	settings := agent.DefaultOptions()
+	maxMTU := flags.Int("m", 1500, "")
+	tries := flags.Int("q", settings.Queries, "")
+	deadline := flags.Duration("w", time.Second, "")
+	interval := flags.Duration("i", 100*time.Millisecond, "")
+	flags.Usage = func() {
+		fmt.Printf(howToUse)
+	}
+	flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	ip, err := resolveDestination(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	// -m is the whole packet, -s only what comes after the IP and ICMP headers
+	headers := 20 + 8
+	if net.ParseIP(ip).To4() == nil {
+		headers = 40 + 8
+	}
+	settings.Destination = ip
+	settings.Size = *maxMTU - headers
+	settings.Queries = *tries
+	settings.Deadline = *deadline
+	settings.Interval = *interval
+	options, err := agent.BuildOptions(settings)
+	if err != nil {
+		printOptionErrors(err)
+		os.Exit(1)
+	}
+	discovery, err := agent.BuildPMTU(options)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	interruptChannel := make(chan os.Signal, 1)
+	signal.Notify(interruptChannel, os.Interrupt)
+	go func() {
+		for range interruptChannel {
+			discovery.Stop()
+		}
+	}()
+	discovery.OnProbe = func(p *agent.PMTUProbe) {
+		fmt.Println(pmtuProbeLine(p))
+	}
+	discovery.OnError = printError
+	fmt.Printf("pmtu to %s (%s), up to %d byte packets\n", flags.Arg(0), ip, *maxMTU)
+	result, err := discovery.Run(context.Background())
+	exitOnRunError(err)
+	fmt.Println(pmtuResultLine(flags.Arg(0), result))
+	if result.PathMTU == 0 {
+		os.Exit(1)
+	}
+}
+
+// pmtuProbeLine is what happened to one packet size.
+func pmtuProbeLine(p *agent.PMTUProbe) string {
+	switch p.Outcome {
+	case agent.PMTUReached:
+		return fmt.Sprintf("%d bytes: reply from %s time=%.3f ms", p.Size, p.Responder, milliseconds(p.RoundTripTime))
+	case agent.PMTUTooBig:
+		return fmt.Sprintf("%d bytes: too big, %s says its MTU is %d", p.Size, p.Responder, p.MTU)
+	case agent.PMTULocal:
+		return fmt.Sprintf("%d bytes: too big for our own interface", p.Size)
+	case agent.PMTUUnreachable:
+		return fmt.Sprintf("%d bytes: %s says the destination can't be reached", p.Size, p.Responder)
+	}
+	return fmt.Sprintf("%d bytes: no answer to %d tries", p.Size, p.Tries)
+}
+
+// pmtuResultLine is the path MTU, and who (or what) limits it.
+func pmtuResultLine(destination string, r *agent.PMTUResult) string {
+	if r.PathMTU == 0 {
+		if len(r.Probes) > 0 && r.Probes[len(r.Probes)-1].Outcome == agent.PMTUUnreachable {
+			return fmt.Sprintf("%s can't be reached", destination)
+		}
+		return fmt.Sprintf("no answer from %s, not even to the smallest packet", destination)
+	}
+	line := fmt.Sprintf("path MTU to %s is %d bytes", destination, r.PathMTU)
+	switch {
+	case r.Router != "":
+		line += fmt.Sprintf(", signalled by %s (MTU %d)", r.Router, r.ReportedMTU)
+	case r.LocalLimit:
+		line += ", our own interface's MTU"
+	case r.BlackHole:
+		line += ", bigger packets are dropped without an ICMP error (MTU black hole)"
+	}
+	return line
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"testing"
+	"time"
+)
+
+func TestPmtuProbeLine(t *testing.T) {
+	tests := []struct {
+		desc     string
+		in       *agent.PMTUProbe
+		expected string
+	}{
+		{
+			desc:     "reached",
+			in:       &agent.PMTUProbe{Size: 1500, Outcome: agent.PMTUReached, Responder: "192.0.2.1", RoundTripTime: 1500 * time.Microsecond},
+			expected: "1500 bytes: reply from 192.0.2.1 time=1.500 ms",
+		},
+		{
+			desc:     "too-big",
+			in:       &agent.PMTUProbe{Size: 1500, Outcome: agent.PMTUTooBig, Responder: "198.51.100.1", MTU: 1400},
+			expected: "1500 bytes: too big, 198.51.100.1 says its MTU is 1400",
+		},
+		{
+			desc:     "dropped",
+			in:       &agent.PMTUProbe{Size: 1450, Outcome: agent.PMTUDropped, Tries: 3},
+			expected: "1450 bytes: no answer to 3 tries",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if line := pmtuProbeLine(tt.in); line != tt.expected {
+				t.Errorf("%s: expected %q got %q", tt.desc, tt.expected, line)
+			}
+		})
+	}
+}
+
+func TestPmtuResultLine(t *testing.T) {
+	tests := []struct {
+		desc     string
+		in       *agent.PMTUResult
+		expected string
+	}{
+		{
+			desc:     "signalled",
+			in:       &agent.PMTUResult{PathMTU: 1400, Router: "198.51.100.1", ReportedMTU: 1400},
+			expected: "path MTU to example.com is 1400 bytes, signalled by 198.51.100.1 (MTU 1400)",
+		},
+		{
+			desc:     "black-hole",
+			in:       &agent.PMTUResult{PathMTU: 1400, BlackHole: true},
+			expected: "path MTU to example.com is 1400 bytes, bigger packets are dropped without an ICMP error (MTU black hole)",
+		},
+		{
+			desc:     "nothing-smaller-on-the-way",
+			in:       &agent.PMTUResult{PathMTU: 1500},
+			expected: "path MTU to example.com is 1500 bytes",
+		},
+		{
+			desc:     "unreachable",
+			in:       &agent.PMTUResult{Probes: []*agent.PMTUProbe{{Size: 44, Outcome: agent.PMTUUnreachable}}},
+			expected: "example.com can't be reached",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if line := pmtuResultLine("example.com", tt.in); line != tt.expected {
+				t.Errorf("%s: expected %q got %q", tt.desc, tt.expected, line)
+			}
+		})
+	}
+}
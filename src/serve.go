@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// serve pings its targets forever and exposes what it sees on /metrics for
+// Prometheus to scrape, until it is interrupted.
+func serve(arguments []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	defaults := agent.DefaultOptions()
+	listen := flags.String("listen", ":9427", "")
+	interval := flags.Duration("i", defaults.Interval, "")
+	probeTimeout := flags.Duration("W", defaults.ProbeTimeout, "")
+	packetSize := flags.Int("s", defaults.Size, "")
+	ttl := flags.Int("ttl", defaults.TTL, "")
+	privileged := flags.Bool("privileged", defaults.Privileged, "")
+	targetFile := flags.String("f", "", "")
+	configFile := flags.String("config", "", "")
+	flags.Usage = func() {
+		fmt.Printf(howToUse)
+	}
+	flags.Parse(arguments)
+	names := flags.Args()
+	if *targetFile != "" {
+		fileDestinations, err := readDestinations(*targetFile)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		names = append(names, fileDestinations...)
+	}
+	if len(names) == 0 && *configFile == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *configFile != "" && len(names) > 0 {
+		fmt.Printf("error: -config: the targets come from the config file\n")
+		os.Exit(1)
+	}
+	var targets *configuredTargets
+	if *configFile != "" {
+		targets = loadConfig(*configFile)
+	} else {
+		targets = flagTargets(names, *interval, *probeTimeout, *packetSize, *ttl, *privileged)
+	}
+	seen := make(map[string]string)
+	for i, address := range targets.addresses {
+		// replies only carry the address, so it has to tell the targets apart
+		if other, ok := seen[canonicalAddress(address)]; ok {
+			fmt.Printf("error: %s and %s are both %s\n", other, targets.names[i], address)
+			os.Exit(1)
+		}
+		seen[canonicalAddress(address)] = targets.names[i]
+		for label := range targets.labels[i] {
+			if !validLabelName(label) {
+				fmt.Printf("error: %s: %s can't be a Prometheus label\n", targets.names[i], label)
+				os.Exit(1)
+			}
+		}
+		// a config file's count and timeout are for one-off pings, serve never stops
+		_ = targets.options[i].ParseCountFlag(0)
+		_ = targets.options[i].ParseTimeoutFlag(time.Duration(math.MaxInt64))
+	}
+	pinger, err := agent.BuildMultiPingerFromOptions(targets.options)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	metrics := newExporter(targets.names, targets.addresses, targets.labels)
+	metrics.watch(pinger)
+
+	server, listener, err := serveMetrics(*listen, metrics, pinger)
+	if err != nil {
+		fmt.Printf("error: -listen: %s\n", err.Error())
+		os.Exit(1)
+	}
+	interruptChannel := make(chan os.Signal, 1)
+	signal.Notify(interruptChannel, os.Interrupt)
+	go func() {
+		for range interruptChannel {
+			pinger.Stop()
+		}
+	}()
+	fmt.Printf("serving metrics for %d targets on http://%s/metrics\n", len(targets.names), listener.Addr())
+	pinger.OnError = printError
+	// only comes back once interrupted, or if the socket couldn't be opened
+	_, err = pinger.Run(context.Background())
+	server.Close()
+	exitOnRunError(err)
+}
+
+// serveMetrics serves the exporter on /metrics at the listen address until the
+// server is closed, stopping the pinger if serving fails.
+func serveMetrics(listen string, metrics *exporter, pinger *agent.MultiPingerAgent) (*http.Server, net.Listener, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("error: %s\n", err.Error())
+			pinger.Stop()
+		}
+	}()
+	return server, listener, nil
+}
+
+// flagTargets builds the targets of serve from the command line, all of them
+// with the same settings.
+func flagTargets(names []string, interval time.Duration, probeTimeout time.Duration, packetSize int, ttl int,
+	privileged bool) *configuredTargets {
+	// a loss is only counted once a probe times out
+	if probeTimeout <= 0 {
+		fmt.Printf("error: -W: serve needs a probe timeout to count lost packets\n")
+		os.Exit(1)
+	}
+	settings := agent.DefaultOptions()
+	settings.Interval = interval
+	settings.ProbeTimeout = probeTimeout
+	settings.Size = packetSize
+	settings.TTL = ttl
+	settings.Privileged = privileged
+	options, err := agent.BuildOptions(settings)
+	if err != nil {
+		printOptionErrors(err)
+		os.Exit(1)
+	}
+	targets := &configuredTargets{}
+	for _, name := range names {
+		address, err := resolveDestination(name)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		targetOptions := *options
+		if err := targetOptions.ParseIPAddress(address); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		targets.names = append(targets.names, name)
+		targets.addresses = append(targets.addresses, address)
+		targets.options = append(targets.options, &targetOptions)
+		targets.labels = append(targets.labels, nil)
+	}
+	return targets
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMetrics(t *testing.T) {
+	targets := flagTargets([]string{"192.0.2.1"}, 10*time.Millisecond, time.Second, 56, 0, false)
+	if err := targets.options[0].ParseCountFlag(3); err != nil {
+		t.Fatal(err)
+	}
+	pinger, err := agent.BuildMultiPingerFromOptions(targets.options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinger.Listen = agent.NewSimulatedNetwork(1).Listen
+	metrics := newExporter(targets.names, targets.addresses, targets.labels)
+	metrics.watch(pinger)
+	server, listener, err := serveMetrics(":0", metrics, pinger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, err := pinger.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", listener.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`ping_packets_sent_total{target="192.0.2.1"} 3`,
+		`ping_packets_received_total{target="192.0.2.1"} 3`,
+		`ping_up{target="192.0.2.1"} 1`,
+	} {
+		if !strings.Contains(string(body), expected+"\n") {
+			t.Errorf("expected %s in\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"os"
+	"os/signal"
+)
+
+// sweep probes every address of the given CIDR blocks/ranges once and reports which hosts are alive.
+func sweep(options *agent.PresentOptions, specs []string, allow string, block string, quietOutput bool) {
+	filter, err := agent.ParseAddressFilter(allow, block)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	sweeper, err := agent.BuildSweeper(options, specs, filter)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	interruptChannel := make(chan os.Signal, 1)
+	signal.Notify(interruptChannel, os.Interrupt)
+	go func() {
+		for range interruptChannel {
+			sweeper.Stop()
+		}
+	}()
+	if !quietOutput {
+		sweeper.OnHostAlive = func(r *agent.SweepResult) {
+			fmt.Printf("%s is alive: time=%v ttl=%v\n", r.Address, r.RoundTripTime, r.TimeToLive)
+		}
+	}
+	sweeper.OnSweepComplete = func(results []*agent.SweepResult) {
+		alive := 0
+		fmt.Printf("\n-----------sweep statistics-----------\n")
+		for _, r := range results {
+			if r.Alive {
+				alive++
+				fmt.Printf("%s time=%v ttl=%v\n", r.Address, r.RoundTripTime, r.TimeToLive)
+			}
+		}
+		fmt.Printf("%d of %d addresses alive\n", alive, len(results))
+	}
+	fmt.Println("Aditya's Pinger!")
+	fmt.Printf("SWEEP: %v:\n", specs)
+	sweeper.OnError = printError
+	_, err = sweeper.Run(context.Background())
+	exitOnRunError(err)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// traceroute finds the routers on the way to a destination, printing every
+// hop like traceroute does as soon as all of its probes are answered or given up on.
+func traceroute(arguments []string) {
+	flags := flag.NewFlagSet("traceroute", flag.ExitOnError)
+	settings := agent.DefaultOptions()
+	firstHop := flags.Int("f", settings.FirstHop, "")
+	maxHops := flags.Int("m", settings.MaxHops, "")
+	queries := flags.Int("q", settings.Queries, "")
+	deadline := flags.Duration("w", 5*time.Second, "")
+	interval := flags.Duration("i", 50*time.Millisecond, "")
+	packetSize := flags.Int("s", settings.Size, "")
+	flags.Usage = func() {
+		fmt.Printf(howToUse)
+	}
+	flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	ip, err := resolveDestination(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	settings.Destination = ip
+	settings.FirstHop = *firstHop
+	settings.MaxHops = *maxHops
+	settings.Queries = *queries
+	settings.Deadline = *deadline
+	settings.Interval = *interval
+	settings.Size = *packetSize
+	options, err := agent.BuildOptions(settings)
+	if err != nil {
+		printOptionErrors(err)
+		os.Exit(1)
+	}
+	tracer, err := agent.BuildTraceroute(options)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	interruptChannel := make(chan os.Signal, 1)
+	signal.Notify(interruptChannel, os.Interrupt)
+	go func() {
+		for range interruptChannel {
+			tracer.Stop()
+		}
+	}()
+	isIpv4 := net.ParseIP(ip).To4() != nil
+	tracer.OnHop = func(h *agent.TracerouteHop) {
+		fmt.Println(hopLine(h, isIpv4))
+	}
+	tracer.OnError = printError
+	fmt.Printf("traceroute to %s (%s), %d hops max, %d byte packets\n", flags.Arg(0), ip, *maxHops, *packetSize+8)
+	_, err = tracer.Run(context.Background())
+	exitOnRunError(err)
+}
+
+// hopLine prints a hop like traceroute: its TTL, then every probe's round trip
+// time (or * if nothing came back), with the responder's address whenever it
+// changes and a !H-style flag after a Destination Unreachable.
+func hopLine(h *agent.TracerouteHop, isIpv4 bool) string {
+	line := fmt.Sprintf("%2d ", h.TTL)
+	responder := ""
+	for _, probe := range h.Probes {
+		if probe.Responder == "" {
+			line += " *"
+			continue
+		}
+		if probe.Responder != responder {
+			responder = probe.Responder
+			line += " " + responder
+		}
+		line += fmt.Sprintf("  %.3f ms", milliseconds(probe.RoundTripTime))
+		if probe.Reply == agent.ReplyUnreachable {
+			line += " " + unreachableFlag(probe.Code, isIpv4)
+		}
+	}
+	return strings.TrimRight(line, " ")
+}
+
+// unreachableFlag is how traceroute marks a Destination Unreachable code.
+func unreachableFlag(code int, isIpv4 bool) string {
+	flags := map[int]string{0: "!N", 1: "!H", 2: "!P", 4: "!F", 5: "!S", 9: "!X", 10: "!X", 13: "!X"}
+	if !isIpv4 {
+		flags = map[int]string{0: "!N", 1: "!X", 3: "!H", 4: "!P", 5: "!S", 6: "!X"}
+	}
+	if flag, ok := flags[code]; ok {
+		return flag
+	}
+	return fmt.Sprintf("!<%d>", code)
+}
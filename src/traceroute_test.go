@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/adiprerepa/ping-go/src/pkg/agent"
+	"testing"
+	"time"
+)
+
+func TestHopLine(t *testing.T) {
+	tests := []struct {
+		desc     string
+		inHop    *agent.TracerouteHop
+		inIpv4   bool
+		expected string
+	}{
+		{
+			desc: "one-router",
+			inHop: &agent.TracerouteHop{TTL: 1, Probes: []*agent.TracerouteProbe{
+				{Responder: "192.0.2.1", RoundTripTime: 263 * time.Microsecond},
+				{Responder: "192.0.2.1", RoundTripTime: 199 * time.Microsecond},
+			}},
+			inIpv4:   true,
+			expected: " 1  192.0.2.1  0.263 ms  0.199 ms",
+		},
+		{
+			desc:     "nothing-came-back",
+			inHop:    &agent.TracerouteHop{TTL: 12, Probes: []*agent.TracerouteProbe{{}, {}, {}}},
+			inIpv4:   true,
+			expected: "12  * * *",
+		},
+		{
+			desc: "two-routers-and-a-star",
+			inHop: &agent.TracerouteHop{TTL: 3, Probes: []*agent.TracerouteProbe{
+				{Responder: "198.51.100.1", RoundTripTime: time.Millisecond},
+				{},
+				{Responder: "198.51.100.2", RoundTripTime: 2 * time.Millisecond},
+			}},
+			inIpv4:   true,
+			expected: " 3  198.51.100.1  1.000 ms * 198.51.100.2  2.000 ms",
+		},
+		{
+			desc: "host-unreachable-ipv6",
+			inHop: &agent.TracerouteHop{TTL: 4, Probes: []*agent.TracerouteProbe{
+				{Responder: "2001:db8::1", RoundTripTime: time.Millisecond, Reply: agent.ReplyUnreachable, Code: 3},
+				{Responder: "2001:db8::1", RoundTripTime: time.Millisecond, Reply: agent.ReplyUnreachable, Code: 7},
+			}},
+			expected: " 4  2001:db8::1  1.000 ms !H  1.000 ms !<7>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if line := hopLine(tt.inHop, tt.inIpv4); line != tt.expected {
+				t.Errorf("%s: expected %q got %q", tt.desc, tt.expected, line)
+			}
+		})
+	}
+}